@@ -0,0 +1,1157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Assemble translate NASM source into machine code.
+//
+// Only the subset of NASM that the decoder understand is supported: labels,
+// `bits 16`, `org`, `byte`/`word` size specifiers, effective address
+// expressions and the `db`/`dw` directives. Everything is encoded with the
+// same tables that are used for decoding so that what we decode can always be
+// assembled back.
+//
+// Jumps accept a label, a `$` relative expression (`$-12`) or a bare number.
+// Like NASM a bare number is the address of the target, not a displacement.
+// Decode print the jumps relative to `$` so decoded output can be fed back to
+// the assembler. A far jump give the segment and the offset.
+func Assemble(source io.Reader) ([]byte, error) {
+	machineCode, _, err := assemble(source)
+	return machineCode, err
+}
+
+// Same as Assemble but also return the statements, with their line and their
+// offset in the machine code.
+func assemble(source io.Reader) ([]byte, []asmStatement, error) {
+	statements, err := parseAssembly(source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Every encoding we choose only depend on whether an expression use a
+	// label, never on the value of the label. So a first pass with unknown
+	// labels give us the final size of each statement and thus the address
+	// of every label.
+	symbols := map[string]int{}
+	address := 0
+	for i := range statements {
+		s := &statements[i]
+		if s.operator == "org" {
+			address, err = s.origin(symbols)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		s.address = address
+		if s.label != "" {
+			if _, exist := symbols[s.label]; exist {
+				return nil, nil, s.errorf("label %s is already defined", s.label)
+			}
+			symbols[s.label] = address
+		}
+		code, err := s.encode(symbols, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		address += len(code)
+	}
+
+	machineCode := []byte{}
+	for i := range statements {
+		s := &statements[i]
+		code, err := s.encode(symbols, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		s.offset = len(machineCode)
+		s.size = len(code)
+		machineCode = append(machineCode, code...)
+	}
+	return machineCode, statements, nil
+}
+
+type asmStatement struct {
+	line     int
+	label    string
+	operator string
+	operands []string
+	address  int // Address as seen by the program, it depend on `org`
+	offset   int // Offset in the machine code
+	size     int // Size in the machine code
+}
+
+func (s *asmStatement) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", s.line, fmt.Sprintf(format, args...))
+}
+
+func parseAssembly(source io.Reader) ([]asmStatement, error) {
+	statements := []asmStatement{}
+	scanner := bufio.NewScanner(source)
+	lastGlobal := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		s := asmStatement{line: line}
+
+		// Labels
+		if colon := strings.Index(text, ":"); colon > 0 && isIdentifier(text[:colon]) {
+			s.label = text[:colon]
+			if strings.HasPrefix(s.label, ".") {
+				s.label = lastGlobal + s.label
+			} else {
+				lastGlobal = s.label
+			}
+			text = strings.TrimSpace(text[colon+1:])
+		}
+
+		// Operator and operands
+		if text != "" {
+			operator, operands := text, ""
+			if space := strings.IndexAny(text, " \t"); space >= 0 {
+				operator, operands = text[:space], text[space+1:]
+			}
+			s.operator = strings.ToLower(operator)
+			for _, operand := range splitOperands(operands) {
+				if strings.HasPrefix(operand, ".") {
+					operand = lastGlobal + operand
+				}
+				s.operands = append(s.operands, operand)
+			}
+		}
+
+		statements = append(statements, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return statements, nil
+}
+
+func (s *asmStatement) origin(symbols map[string]int) (int, error) {
+	if len(s.operands) != 1 {
+		return 0, s.errorf("org expect one operand")
+	}
+	value, _, err := evaluate(s.operands[0], symbols, s.address, true)
+	if err != nil {
+		return 0, s.errorf("%s", err)
+	}
+	return value, nil
+}
+
+// Encode a statement. When final is false unknown labels are allowed so that
+// the size of the statement can be computed before every label is known.
+func (s *asmStatement) encode(symbols map[string]int, final bool) ([]byte, error) {
+	switch s.operator {
+	case "":
+		return nil, nil
+	case "bits":
+		if len(s.operands) != 1 || s.operands[0] != "16" {
+			return nil, s.errorf("only `bits 16` is supported")
+		}
+		return nil, nil
+	case "org":
+		return nil, nil
+	case "db", "dw":
+		return s.encodeData(symbols, final)
+	}
+
+	if operator, ok := jumpAliases[s.operator]; ok {
+		s.operator = operator
+	}
+	if _, ok := jumpEncodings[s.operator]; ok {
+		return s.encodeJump(symbols, final)
+	}
+	if s.operator == "jmp" {
+		return s.encodeUnconditionalJump(symbols, final)
+	}
+	if s.operator == "mov" {
+		for _, operand := range s.operands {
+			if _, ok := asmSegmentRegisters[strings.ToLower(strings.TrimSpace(operand))]; ok {
+				return s.encodeMovSegment(symbols, final)
+			}
+		}
+	}
+	if opcode, ok := asmSingleByte[s.operator]; ok {
+		if len(s.operands) != 0 {
+			return nil, s.errorf("%s does not take operands", s.operator)
+		}
+		return []byte{opcode}, nil
+	}
+
+	if s.operator == "in" || s.operator == "out" {
+		return s.encodePort()
+	}
+	if s.operator == "int" {
+		return s.encodeInterrupt(symbols, final)
+	}
+	if escapes, ok := asmEscapes[s.operator]; ok {
+		return s.encodeEscape(escapes, symbols, final)
+	}
+	if code, ok := asmEscapeNoOperand[s.operator]; ok {
+		if len(s.operands) != 0 {
+			return nil, s.errorf("%s does not take operands", s.operator)
+		}
+		return []byte{byte(code >> 8), byte(code)}, nil
+	}
+
+	forms, ok := asmEncodings[s.operator]
+	if !ok {
+		return nil, s.errorf("unknown instruction %s", s.operator)
+	}
+	if len(s.operands) != 2 {
+		return nil, s.errorf("%s expect two operands", s.operator)
+	}
+
+	dst, err := parseOperand(s.operands[0], symbols, s.address, final)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	src, err := parseOperand(s.operands[1], symbols, s.address, final)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+
+	// Operand size
+	w := byte(0)
+	switch {
+	case dst.kind == operandRegister:
+		w = dst.w
+		if src.kind == operandRegister && src.w != w {
+			return nil, s.errorf("operand size mismatch")
+		}
+	case src.kind == operandRegister:
+		w = src.w
+	case dst.size != 0:
+		w = dst.size - 1
+	case src.size != 0:
+		w = src.size - 1
+	default:
+		return nil, s.errorf("operation size not specified")
+	}
+
+	code, err := forms.encode(dst, src, w)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	return code, nil
+}
+
+func (s *asmStatement) encodeJump(symbols map[string]int, final bool) ([]byte, error) {
+	if len(s.operands) != 1 {
+		return nil, s.errorf("%s expect one operand", s.operator)
+	}
+
+	// Like NASM the target is always an address, use $+n for a jump
+	// relative to the start of the instruction.
+	address, _, err := evaluate(strings.TrimSpace(s.operands[0]), symbols, s.address, final)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	displacement := address - (s.address + 2)
+
+	if final && (displacement < -128 || displacement > 127) {
+		return nil, s.errorf("jump out of range (%d)", displacement)
+	}
+	return []byte{jumpEncodings[s.operator], byte(displacement)}, nil
+}
+
+// JMP use the short form when the displacement fit in a byte, a label always
+// use the near form so the size never depend on its value. A far jump give
+// the segment and the offset like `jmp 0xf000:0xe05b`.
+func (s *asmStatement) encodeUnconditionalJump(symbols map[string]int, final bool) ([]byte, error) {
+	if len(s.operands) != 1 {
+		return nil, s.errorf("jmp expect one operand")
+	}
+	target := strings.TrimSpace(s.operands[0])
+
+	if segment, offset, found := strings.Cut(target, ":"); found {
+		cs, _, err := evaluate(strings.TrimSpace(segment), symbols, s.address, final)
+		if err != nil {
+			return nil, s.errorf("%s", err)
+		}
+		ip, _, err := evaluate(strings.TrimSpace(offset), symbols, s.address, final)
+		if err != nil {
+			return nil, s.errorf("%s", err)
+		}
+		if cs < 0 || cs > 0xFFFF || ip < 0 || ip > 0xFFFF {
+			return nil, s.errorf("far jump target %s out of range", target)
+		}
+		return []byte{asmJump | 0b10, byte(ip), byte(ip >> 8), byte(cs), byte(cs >> 8)}, nil
+	}
+
+	address, symbolic, err := evaluate(target, symbols, s.address, final)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	displacement := address - (s.address + 2)
+	if !symbolic && displacement >= -128 && displacement <= 127 {
+		return []byte{asmJump | 0b11, byte(displacement)}, nil
+	}
+	// The near jump wrap around in the segment
+	displacement = address - (s.address + 3)
+	return []byte{asmJump | 0b01, byte(displacement), byte(displacement >> 8)}, nil
+}
+
+// MOV to or from a segment register, the other operand is a word register or
+// memory.
+func (s *asmStatement) encodeMovSegment(symbols map[string]int, final bool) ([]byte, error) {
+	if len(s.operands) != 2 {
+		return nil, s.errorf("mov expect two operands")
+	}
+	opcode := asmMovSegment
+	segment, other := s.operands[0], s.operands[1]
+	if _, ok := asmSegmentRegisters[strings.ToLower(strings.TrimSpace(segment))]; ok {
+		opcode |= 0b10
+	} else {
+		segment, other = other, segment
+	}
+	sr := asmSegmentRegisters[strings.ToLower(strings.TrimSpace(segment))]
+	if _, ok := asmSegmentRegisters[strings.ToLower(strings.TrimSpace(other))]; ok {
+		return nil, s.errorf("invalid combination of operands")
+	}
+
+	operand, err := parseOperand(other, symbols, s.address, final)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	switch {
+	case operand.kind == operandImmediate:
+		return nil, s.errorf("invalid combination of operands")
+	case operand.kind == operandRegister && operand.w == 0, operand.size == 1:
+		return nil, s.errorf("operand size mismatch")
+	case operand.kind == operandRegister:
+		operand.mod = 0b11
+	}
+	return append([]byte{opcode}, operand.modRM(sr)...), nil
+}
+
+// IN and OUT take the accumulator and a port, an immediate byte or DX
+func (s *asmStatement) encodePort() ([]byte, error) {
+	if len(s.operands) != 2 {
+		return nil, s.errorf("%s expect two operands", s.operator)
+	}
+	accumulator, port := s.operands[0], s.operands[1]
+	if s.operator == "out" {
+		accumulator, port = port, accumulator
+	}
+	accumulator = strings.ToLower(strings.TrimSpace(accumulator))
+	port = strings.ToLower(strings.TrimSpace(port))
+
+	w := byte(0)
+	switch accumulator {
+	case "al":
+	case "ax":
+		w = 1
+	default:
+		return nil, s.errorf("%s only work with al or ax", s.operator)
+	}
+	opcode := asmPorts[s.operator] | w
+	if port == "dx" {
+		return []byte{opcode | 0b1000}, nil
+	}
+	value, _, err := evaluate(port, map[string]int{}, s.address, true)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	if value < 0 || value > 0xFF {
+		return nil, s.errorf("port %d out of range, use dx", value)
+	}
+	return []byte{opcode, byte(value)}, nil
+}
+
+// INT take the vector, NASM always use the two bytes form even for INT 3
+func (s *asmStatement) encodeInterrupt(symbols map[string]int, final bool) ([]byte, error) {
+	if len(s.operands) != 1 {
+		return nil, s.errorf("int expect one operand")
+	}
+	vector, _, err := evaluate(s.operands[0], symbols, s.address, final)
+	if err != nil {
+		return nil, s.errorf("%s", err)
+	}
+	if vector < 0 || vector > 0xFF {
+		return nil, s.errorf("interrupt vector %d out of range", vector)
+	}
+	return []byte{asmInterrupt, byte(vector)}, nil
+}
+
+// 8087 instructions take a memory operand, whose size select the opcode, or
+// registers of the 8087 stack.
+func (s *asmStatement) encodeEscape(escapes []asmEscape, symbols map[string]int, final bool) ([]byte, error) {
+	form, text := "", ""
+	switch len(s.operands) {
+	case 1:
+		text = strings.TrimSpace(s.operands[0])
+		lower := strings.ToLower(text)
+		if _, ok := asmStackRegister(lower); ok {
+			form = "st"
+			break
+		}
+		for _, size := range []string{"word", "dword", "qword", "tword"} {
+			if strings.HasPrefix(lower, size+" ") || strings.HasPrefix(lower, size+"[") {
+				form, text = size, strings.TrimSpace(text[len(size):])
+			}
+		}
+	case 2:
+		left := strings.ToLower(strings.TrimSpace(s.operands[0]))
+		right := strings.ToLower(strings.TrimSpace(s.operands[1]))
+		_, okLeft := asmStackRegister(left)
+		_, okRight := asmStackRegister(right)
+		if !okLeft || !okRight || (left != "st0" && right != "st0") {
+			return nil, s.errorf("%s expect st0 and another 8087 register", s.operator)
+		}
+		// With st0 on both side NASM pick the form with st0 on the left
+		form, text = "st, st0", left
+		if left == "st0" && s.hasEscapeForm(escapes, "st0, st") {
+			form, text = "st0, st", right
+		}
+	default:
+		return nil, s.errorf("%s expect one or two operands", s.operator)
+	}
+
+	for _, escape := range escapes {
+		if escape.form != form || escape.memory != (form == "" || strings.HasSuffix(form, "word")) {
+			continue
+		}
+		opcode, reg := 0xD8|escape.key>>3, escape.key&0b111
+		if !escape.memory {
+			register, _ := asmStackRegister(strings.ToLower(text))
+			return []byte{opcode, 0b11<<6 | reg<<3 | register}, nil
+		}
+		operand, err := parseOperand(text, symbols, s.address, final)
+		if err != nil {
+			return nil, s.errorf("%s", err)
+		}
+		if operand.kind != operandMemory {
+			return nil, s.errorf("%s expect a memory operand", s.operator)
+		}
+		return append([]byte{opcode}, operand.modRM(reg)...), nil
+	}
+	return nil, s.errorf("invalid operands for %s", s.operator)
+}
+
+func (s *asmStatement) hasEscapeForm(escapes []asmEscape, form string) bool {
+	for _, escape := range escapes {
+		if escape.form == form {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the index of st0 to st7
+func asmStackRegister(name string) (byte, bool) {
+	if len(name) != 3 || !strings.HasPrefix(name, "st") || name[2] < '0' || name[2] > '7' {
+		return 0, false
+	}
+	return name[2] - '0', true
+}
+
+func (s *asmStatement) encodeData(symbols map[string]int, final bool) ([]byte, error) {
+	size := 1
+	if s.operator == "dw" {
+		size = 2
+	}
+
+	code := []byte{}
+	for _, operand := range s.operands {
+		if text, ok := stringLiteral(operand); ok {
+			code = append(code, text...)
+			if len(text)%size != 0 {
+				code = append(code, 0)
+			}
+			continue
+		}
+
+		value, _, err := evaluate(operand, symbols, s.address, final)
+		if err != nil {
+			return nil, s.errorf("%s", err)
+		}
+		if !fitSize(value, byte(size)) {
+			return nil, s.errorf("%d does not fit in %s", value, s.operator)
+		}
+		code = append(code, byte(value))
+		if size == 2 {
+			code = append(code, byte(value>>8))
+		}
+	}
+	return code, nil
+}
+
+// ====================
+// ===== OPERANDS =====
+// ====================
+
+const (
+	operandRegister = iota
+	operandMemory
+	operandImmediate
+)
+
+type asmOperand struct {
+	kind     int
+	size     byte // 0 when unknown, 1 for byte, 2 for word
+	w        byte // Only for register
+	reg      byte // Register encoding or R/M field
+	mod      byte
+	value    int  // Immediate or displacement
+	symbolic bool // Value depend on a label
+}
+
+func parseOperand(text string, symbols map[string]int, address int, final bool) (asmOperand, error) {
+	operand := asmOperand{}
+	text = strings.TrimSpace(text)
+
+	lower := strings.ToLower(text)
+	for prefix, size := range map[string]byte{"byte": 1, "word": 2} {
+		if strings.HasPrefix(lower, prefix+" ") || strings.HasPrefix(lower, prefix+"[") {
+			operand.size = size
+			text = strings.TrimSpace(text[len(prefix):])
+			lower = strings.ToLower(text)
+		}
+	}
+
+	if regKey, ok := asmRegisters[lower]; ok {
+		operand.kind = operandRegister
+		operand.reg = regKey >> 1
+		operand.w = regKey & 1
+		return operand, nil
+	}
+
+	if strings.HasPrefix(text, "[") {
+		if !strings.HasSuffix(text, "]") {
+			return operand, fmt.Errorf("missing ] in %s", text)
+		}
+		return parseMemoryOperand(operand, text[1:len(text)-1], symbols, address, final)
+	}
+
+	value, symbolic, err := evaluate(text, symbols, address, final)
+	if err != nil {
+		return operand, err
+	}
+	operand.kind = operandImmediate
+	operand.value = value
+	operand.symbolic = symbolic
+	return operand, nil
+}
+
+// Parse the inside of an effective address calculation like `bp + si - 4`
+func parseMemoryOperand(operand asmOperand, text string, symbols map[string]int, address int, final bool) (asmOperand, error) {
+	operand.kind = operandMemory
+
+	regs := []string{}
+	displacement := ""
+	for _, term := range splitTerms(text) {
+		name := strings.ToLower(strings.TrimSpace(term[1:]))
+		if _, ok := asmAddressRegisters[name]; ok && term[0] == '+' {
+			regs = append(regs, name)
+			continue
+		}
+		displacement += term
+	}
+
+	if displacement != "" {
+		value, symbolic, err := evaluate(displacement, symbols, address, final)
+		if err != nil {
+			return operand, err
+		}
+		operand.value = int(int16(value))
+		operand.symbolic = symbolic
+	}
+
+	// Direct address
+	if len(regs) == 0 {
+		operand.mod = 0b00
+		operand.reg = 0b110
+		return operand, nil
+	}
+
+	sort.Strings(regs)
+	rm, ok := asmAddressCalculations[strings.Join(regs, " + ")]
+	if !ok {
+		return operand, fmt.Errorf("invalid effective address [%s]", text)
+	}
+	operand.reg = rm
+
+	switch {
+	case operand.symbolic || !fitSigned8(operand.value):
+		operand.mod = 0b10
+	case operand.value != 0 || rm == 0b110: // [bp] only exist with a displacement
+		operand.mod = 0b01
+	default:
+		operand.mod = 0b00
+	}
+	return operand, nil
+}
+
+// Return the ModR/M byte followed by the displacement
+func (operand asmOperand) modRM(reg byte) []byte {
+	code := []byte{operand.mod<<6 | reg<<3 | operand.reg}
+	if operand.kind != operandMemory {
+		return code
+	}
+
+	switch {
+	case operand.mod == 0b01:
+		code = append(code, byte(operand.value))
+	case operand.mod == 0b10, operand.mod == 0b00 && operand.reg == 0b110:
+		code = append(code, byte(operand.value), byte(operand.value>>8))
+	}
+	return code
+}
+
+// ====================
+// ===== ENCODING =====
+// ====================
+
+// The different encoding of an operator, each one is the opcode as used as a
+// key in the decoders table or -1 when the operator has no such form.
+type asmForms struct {
+	regMemToFromReg  int
+	imediateToReg    int
+	imediateToRegMem int
+	imediateToAcc    int
+	arithmetic       int // REG field of the 100000 immediate group
+}
+
+func (forms asmForms) encode(dst asmOperand, src asmOperand, w byte) ([]byte, error) {
+	switch {
+	case dst.kind == operandImmediate:
+		return nil, fmt.Errorf("destination cannot be an immediate")
+
+	case src.kind != operandImmediate:
+		if dst.kind == operandMemory && src.kind == operandMemory {
+			return nil, fmt.Errorf("invalid combination of memory operands")
+		}
+		if forms.regMemToFromReg < 0 {
+			break
+		}
+		// Register to register is encoded with D=0 like NASM does
+		d, reg, rm := byte(0), src, dst
+		if src.kind == operandMemory {
+			d, reg, rm = 1, dst, src
+		}
+		first := byte(forms.regMemToFromReg)<<2 | d<<1 | w
+		if rm.kind == operandRegister {
+			rm.mod = 0b11
+		}
+		return append([]byte{first}, rm.modRM(reg.reg)...), nil
+
+	case !fitSize(src.value, w+1):
+		return nil, fmt.Errorf("immediate %d does not fit", src.value)
+
+	case forms.imediateToReg >= 0 && dst.kind == operandRegister:
+		first := byte(forms.imediateToReg<<2)&0xF0 | w<<3 | dst.reg
+		return append([]byte{first}, immediate(src.value, w)...), nil
+
+	case forms.imediateToRegMem >= 0:
+		// The opcode is 7 bits long, 1100011w
+		first := byte(forms.imediateToRegMem)<<2 | 0b10 | w
+		if dst.kind == operandRegister {
+			dst.mod = 0b11
+		}
+		code := append([]byte{first}, dst.modRM(0b000)...)
+		return append(code, immediate(src.value, w)...), nil
+
+	case forms.arithmetic >= 0:
+		// Same choice as NASM: prefer the sign extended byte, then the
+		// shorter accumulator form.
+		signExtend := w == 1 && !src.symbolic && fitSigned8(src.value)
+		isAcc := dst.kind == operandRegister && dst.reg == 0
+		if isAcc && forms.imediateToAcc >= 0 && !signExtend {
+			first := byte(forms.imediateToAcc)<<2 | w
+			return append([]byte{first}, immediate(src.value, w)...), nil
+		}
+
+		s := byte(0)
+		if signExtend {
+			s = 1
+		}
+		first := byte(0b100000)<<2 | s<<1 | w
+		if dst.kind == operandRegister {
+			dst.mod = 0b11
+		}
+		code := append([]byte{first}, dst.modRM(byte(forms.arithmetic))...)
+		if signExtend {
+			return append(code, byte(src.value)), nil
+		}
+		return append(code, immediate(src.value, w)...), nil
+	}
+
+	return nil, fmt.Errorf("invalid combination of operands")
+}
+
+func immediate(value int, w byte) []byte {
+	if w == 0 {
+		return []byte{byte(value)}
+	}
+	return []byte{byte(value), byte(value >> 8)}
+}
+
+func fitSigned8(value int) bool {
+	value = int(int16(value))
+	return value >= -128 && value <= 127
+}
+
+func fitSize(value int, size byte) bool {
+	if size == 1 {
+		return value >= -128 && value <= 255
+	}
+	return value >= -32768 && value <= 65535
+}
+
+// ======================
+// ===== EXPRESSION =====
+// ======================
+
+// Evaluate a NASM expression made of numbers, labels, `$`, `$$`, + - * / and
+// parenthesis. The second return value report whether a label was used.
+func evaluate(text string, symbols map[string]int, address int, final bool) (int, bool, error) {
+	e := expression{text: text, symbols: symbols, address: address, final: final}
+	value, err := e.sum()
+	if err != nil {
+		return 0, false, err
+	}
+	e.skipSpaces()
+	if e.pos != len(e.text) {
+		return 0, false, fmt.Errorf("unexpected %q in expression %q", e.text[e.pos:], text)
+	}
+	return value, e.symbolic, nil
+}
+
+type expression struct {
+	text     string
+	pos      int
+	symbols  map[string]int
+	address  int
+	final    bool
+	symbolic bool
+}
+
+func (e *expression) skipSpaces() {
+	for e.pos < len(e.text) && (e.text[e.pos] == ' ' || e.text[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+func (e *expression) peek() byte {
+	e.skipSpaces()
+	if e.pos < len(e.text) {
+		return e.text[e.pos]
+	}
+	return 0
+}
+
+func (e *expression) sum() (int, error) {
+	value, err := e.product()
+	for err == nil {
+		switch e.peek() {
+		case '+':
+			e.pos++
+			var rhs int
+			rhs, err = e.product()
+			value += rhs
+		case '-':
+			e.pos++
+			var rhs int
+			rhs, err = e.product()
+			value -= rhs
+		default:
+			return value, nil
+		}
+	}
+	return 0, err
+}
+
+func (e *expression) product() (int, error) {
+	value, err := e.unary()
+	for err == nil {
+		switch e.peek() {
+		case '*':
+			e.pos++
+			var rhs int
+			rhs, err = e.unary()
+			value *= rhs
+		case '/':
+			e.pos++
+			var rhs int
+			rhs, err = e.unary()
+			if err == nil && rhs == 0 {
+				if !e.final {
+					rhs = 1
+				} else {
+					err = fmt.Errorf("division by zero")
+				}
+			}
+			if err == nil {
+				value /= rhs
+			}
+		default:
+			return value, nil
+		}
+	}
+	return 0, err
+}
+
+func (e *expression) unary() (int, error) {
+	switch e.peek() {
+	case '-':
+		e.pos++
+		value, err := e.unary()
+		return -value, err
+	case '+':
+		e.pos++
+		return e.unary()
+	case '(':
+		e.pos++
+		value, err := e.sum()
+		if err != nil {
+			return 0, err
+		}
+		if e.peek() != ')' {
+			return 0, fmt.Errorf("missing ) in %q", e.text)
+		}
+		e.pos++
+		return value, nil
+	case 0:
+		return 0, fmt.Errorf("missing value in %q", e.text)
+	}
+
+	start := e.pos
+	if e.text[e.pos] == '\'' || e.text[e.pos] == '"' {
+		end := strings.IndexByte(e.text[start+1:], e.text[start])
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated string in %q", e.text)
+		}
+		e.pos = start + end + 2
+		value := 0
+		for i, c := range []byte(e.text[start+1 : e.pos-1]) {
+			value |= int(c) << (8 * i)
+		}
+		return value, nil
+	}
+
+	for e.pos < len(e.text) && isIdentifierByte(e.text[e.pos]) {
+		e.pos++
+	}
+	token := e.text[start:e.pos]
+	switch {
+	case token == "":
+		return 0, fmt.Errorf("unexpected %q in %q", e.text[start:], e.text)
+	case token == "$":
+		return e.address, nil
+	case token == "$$":
+		return 0, nil
+	case token[0] >= '0' && token[0] <= '9':
+		return parseNumber(token)
+	}
+
+	e.symbolic = true
+	value, ok := e.symbols[token]
+	if !ok && e.final {
+		return 0, fmt.Errorf("undefined label %s", token)
+	}
+	return value, nil
+}
+
+// Parse a number in one of the NASM notations: 42, 0x2a, 2ah, 0b101010 or
+// 101010b
+func parseNumber(token string) (int, error) {
+	lower := strings.ToLower(strings.ReplaceAll(token, "_", ""))
+	base := 10
+	switch {
+	case strings.HasPrefix(lower, "0x"), strings.HasPrefix(lower, "0h"):
+		base, lower = 16, lower[2:]
+	case strings.HasPrefix(lower, "0b"), strings.HasPrefix(lower, "0y"):
+		base, lower = 2, lower[2:]
+	case strings.HasSuffix(lower, "h"):
+		base, lower = 16, lower[:len(lower)-1]
+	case strings.HasSuffix(lower, "b"), strings.HasSuffix(lower, "y"):
+		base, lower = 2, lower[:len(lower)-1]
+	}
+	value, err := strconv.ParseInt(lower, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %s", token)
+	}
+	return int(value), nil
+}
+
+// =================
+// ===== UTILS =====
+// =================
+
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Split operands on commas that are not in a string literal
+func splitOperands(text string) []string {
+	operands := []string{}
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			operands = append(operands, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(text[start:]); rest != "" {
+		operands = append(operands, rest)
+	}
+	return operands
+}
+
+// Split a sum into its terms, each term start with its sign
+func splitTerms(text string) []string {
+	terms := []string{}
+	depth := 0
+	current := "+"
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == '+' || c == '-') && strings.TrimSpace(current[1:]) != "":
+			terms = append(terms, current)
+			current = string(c)
+			continue
+		case depth == 0 && c == '-' && strings.TrimSpace(current[1:]) == "":
+			// `+ -5` as printed by Decode for negative displacements
+			if current[0] == '-' {
+				current = "+"
+			} else {
+				current = "-"
+			}
+			continue
+		case depth == 0 && c == '+' && strings.TrimSpace(current[1:]) == "":
+			continue
+		}
+		current += string(c)
+	}
+	return append(terms, current)
+}
+
+func stringLiteral(text string) ([]byte, bool) {
+	if len(text) >= 2 && (text[0] == '\'' || text[0] == '"') && text[len(text)-1] == text[0] {
+		return []byte(text[1 : len(text)-1]), true
+	}
+	return nil, false
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c == '.' || c == '$' || c == '@' || c == '?' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func isIdentifier(text string) bool {
+	if text == "" || (text[0] >= '0' && text[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(text); i++ {
+		if !isIdentifierByte(text[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ====================
+// ====== TABLES ======
+// ====================
+
+// All the assembler tables are derived from the decoder tables so that the
+// two can never disagree.
+
+// Register name to the REG<<1|W key of the registers table
+var asmRegisters = map[string]byte{}
+
+// Registers that can be used in an effective address calculation
+var asmAddressRegisters = map[string]bool{}
+
+// Registers used in the calculation (sorted and joined with " + ") to the R/M
+// field of the addressCalculations table
+var asmAddressCalculations = map[string]byte{}
+
+// Operator to its encodings
+var asmEncodings = map[string]asmForms{}
+
+// Jump operator to the first byte of the instruction
+var jumpEncodings = map[string]byte{}
+
+// Operator to the byte of the instructions without operands
+var asmSingleByte = map[string]byte{}
+
+// IN and OUT to the byte of their form with an immediate port
+var asmPorts = map[string]byte{}
+
+// First byte of INT with its vector
+var asmInterrupt byte
+
+// First byte of the JMP group, CALL, and of the MOV from a segment register
+var asmJump byte
+var asmMovSegment byte
+
+// Segment register name to the SR field
+var asmSegmentRegisters = map[string]byte{}
+
+// 8087 operator to its encodings
+var asmEscapes = map[string][]asmEscape{}
+
+type asmEscape struct {
+	key    byte   // Key of the operatorsEscapeMemory or operatorsEscapeRegister table
+	memory bool   // Otherwise the operands are registers
+	form   string // Size of the memory or form of the registers
+}
+
+// 8087 operator without operands to its two bytes
+var asmEscapeNoOperand = map[string]uint16{}
+
+// NASM accept multiple names for most conditional jumps
+var jumpAliases = map[string]string{
+	"jz":     "je",
+	"jnz":    "jne",
+	"jnae":   "jb",
+	"jc":     "jb",
+	"jae":    "jnb",
+	"jnc":    "jnb",
+	"jna":    "jbe",
+	"jnbe":   "ja",
+	"jpe":    "jp",
+	"jnp":    "jpo",
+	"jnge":   "jl",
+	"jnl":    "jge",
+	"jng":    "jle",
+	"jnle":   "jg",
+	"loope":  "loopz",
+	"loopne": "loopnz",
+}
+
+func init() {
+	for key, name := range registers {
+		asmRegisters[name] = key
+	}
+	for key, name := range segmentRegisters {
+		asmSegmentRegisters[name] = key
+	}
+
+	// Every R/M combination exist in the 8 bit displacement mode
+	for key, calculation := range addressCalculations {
+		if key>>3 != 0b01 {
+			continue
+		}
+		regs := []string{}
+		for _, term := range strings.Split(strings.Trim(calculation, "[]"), " + ") {
+			if term != "D8" {
+				regs = append(regs, term)
+				asmAddressRegisters[term] = true
+			}
+		}
+		sort.Strings(regs)
+		asmAddressCalculations[strings.Join(regs, " + ")] = key & 0b111
+	}
+
+	for opcode, operator := range operators {
+		decoder, ok := decoders[opcode]
+		if !ok {
+			continue
+		}
+		forms, ok := asmEncodings[operator]
+		if !ok {
+			forms = asmForms{-1, -1, -1, -1, -1}
+		}
+		switch {
+		case sameFunction(decoder, decodeRegMemToFromReg):
+			forms.regMemToFromReg = int(opcode)
+		case sameFunction(decoder, decodeImediateToRegister):
+			forms.imediateToReg = int(opcode)
+		case sameFunction(decoder, decodeMovImediateToRegMem):
+			forms.imediateToRegMem = int(opcode)
+		case sameFunction(decoder, decodeImediateToAccumulator):
+			forms.imediateToAcc = int(opcode)
+		default:
+			continue
+		}
+		asmEncodings[operator] = forms
+	}
+	for hint, operator := range operatorsArithmetic {
+		forms := asmEncodings[operator]
+		forms.arithmetic = int(hint)
+		asmEncodings[operator] = forms
+	}
+
+	for opcode, operator := range operatorsSingleByte {
+		asmSingleByte[operator] = opcode
+	}
+
+	for opcode, decoder := range decoders {
+		if sameFunction(decoder, decodePorts) && opcode&0b10 == 0 {
+			asmPorts["in"] = opcode << 2
+			asmPorts["out"] = opcode<<2 | 0b10
+		}
+		if sameFunction(decoder, decodeInterrupt) {
+			asmInterrupt = opcode<<2 | 0b01
+		}
+		if sameFunction(decoder, decodeJump) {
+			asmJump = opcode << 2
+		}
+		if sameFunction(decoder, decodeMovSegment) {
+			asmMovSegment = opcode << 2
+		}
+	}
+
+	for key, operation := range operatorsEscapeMemory {
+		asmEscapes[operation.operator] = append(asmEscapes[operation.operator], asmEscape{key, true, operation.size})
+	}
+	for key, operation := range operatorsEscapeRegister {
+		asmEscapes[operation.operator] = append(asmEscapes[operation.operator], asmEscape{key, false, operation.size})
+	}
+	for code, operator := range operatorsEscapeNoOperand {
+		asmEscapeNoOperand[operator] = code
+	}
+
+	for hint, operator := range operatorsJumps {
+		for opcode, decoder := range decoders {
+			if sameFunction(decoder, decodeCondJumpAndLoop) && opcode&0b111 == hint>>2 {
+				jumpEncodings[operator] = opcode<<2 | hint&0b11
+			}
+		}
+	}
+}
+
+// Functions cannot be compared in Go so we compare there address.
+func sameFunction(a any, b any) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
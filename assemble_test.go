@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Listings whose binary was not assembled from the source next to it. The
+// source of listing 54 say `mov bp, 0` but the binary has `mov bp, 256`.
+var mismatchedListings = map[string]bool{
+	"listing_0054_draw_rectangle": true,
+}
+
+// Assemble the sources of part1/ and compare with the binaries of the course,
+// assembled by NASM.
+func TestAssembleListings(t *testing.T) {
+	sources, err := filepath.Glob("part1/listing_*.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) == 0 {
+		t.Fatal("no listing in part1/")
+	}
+	for _, source := range sources {
+		name := strings.TrimSuffix(filepath.Base(source), ".asm")
+		t.Run(name, func(t *testing.T) {
+			file, err := os.Open(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			expected, err := os.ReadFile(strings.TrimSuffix(source, ".asm"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assembled, err := Assemble(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(assembled, expected) == mismatchedListings[name] {
+				t.Errorf("assembled % x\nexpected  % x", assembled, expected)
+			}
+		})
+	}
+}
+
+// A number is an address like in NASM whatever its syntax, $ is the address
+// of the jump.
+func TestAssembleJumpTarget(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []byte
+	}{
+		{"jne 0x10", []byte{0x75, 0x0e}},
+		{"jne 10h", []byte{0x75, 0x0e}},
+		{"jne 16", []byte{0x75, 0x0e}},
+		{"jne 0", []byte{0x75, 0xfe}},
+		{"jne $", []byte{0x75, 0xfe}},
+		{"jne $+2", []byte{0x75, 0x00}},
+		{"jne $-6", []byte{0x75, 0xf8}},
+		{"clc\njne 0x10", []byte{0xf8, 0x75, 0x0d}},
+		{"clc\njne $+0x10", []byte{0xf8, 0x75, 0x0e}},
+		{"loop start\nstart:", []byte{0xe2, 0x00}},
+	}
+	for _, test := range tests {
+		assembled, err := Assemble(strings.NewReader(test.source))
+		if err != nil {
+			t.Errorf("%q: %s", test.source, err)
+			continue
+		}
+		if !bytes.Equal(assembled, test.expected) {
+			t.Errorf("%q assembled to % x, expected % x", test.source, assembled, test.expected)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BatchOptions struct {
+	Workers int           // Programs executed at the same time
+	Timeout time.Duration // Optional, maximum duration of each program
+	Limits  Limits
+	Watches Watches // Optional, stop each program at the first hit
+}
+
+// Outcome of the execution of a program of a batch
+type BatchResult struct {
+	Program      string            `json:"program"`
+	Status       string            `json:"status"` // ok, loop, limit, timeout, watch or error
+	Reason       string            `json:"reason,omitempty"`
+	Instructions int               `json:"instructions"`
+	Cycles       int               `json:"cycles"`
+	Registers    map[string]uint16 `json:"registers"`
+	TraceHash    string            `json:"trace_sha256"`  // Hash of the trace of the execution
+	MemoryHash   string            `json:"memory_sha256"` // Hash of the whole memory at the end
+	Duration     time.Duration     `json:"duration_ns"`
+}
+
+// Execute every program on a pool of workers, each in its own machine, and
+// return the results in the order of programs.
+func RunBatch(ctx context.Context, programs []string, options BatchOptions) []BatchResult {
+	results := make([]BatchResult, len(programs))
+	jobs := make(chan int)
+	workers := sync.WaitGroup{}
+	for w := 0; w < max(options.Workers, 1); w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for n := range jobs {
+				results[n] = runBatchProgram(ctx, programs[n], options)
+			}
+		}()
+	}
+	for n := range programs {
+		jobs <- n
+	}
+	close(jobs)
+	workers.Wait()
+	return results
+}
+
+func runBatchProgram(ctx context.Context, program string, options BatchOptions) (result BatchResult) {
+	result = BatchResult{Program: program, Status: "ok", Registers: map[string]uint16{}}
+	start := time.Now()
+	trace := sha256.New()
+	store := NewStorage(trace)
+
+	// One broken program must not take the whole batch down
+	defer func() {
+		if r := recover(); r != nil {
+			result.Status, result.Reason = "error", fmt.Sprint(r)
+		}
+		result.Duration = time.Since(start)
+		result.Instructions = store.executed
+		result.Cycles = store.cycles
+		for _, reg := range registerNames {
+			result.Registers[reg] = store.getRegister(reg)
+		}
+		result.TraceHash = hex.EncodeToString(trace.Sum(nil))
+		memory := sha256.Sum256(store.memory[:])
+		result.MemoryHash = hex.EncodeToString(memory[:])
+	}()
+
+	file, err := os.Open(program)
+	if err != nil {
+		result.Status, result.Reason = "error", err.Error()
+		return result
+	}
+	defer file.Close()
+	_, err = store.loadProgram(file, codeSegment)
+	if err != nil {
+		result.Status, result.Reason = "error", err.Error()
+		return result
+	}
+
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	watchHit := ""
+	stop, err := options.Watches.stop(store, &watchHit)
+	if err != nil {
+		result.Status, result.Reason = "error", err.Error()
+		return result
+	}
+	err = store.run(ctx, options.Limits, stop)
+
+	loop := &LoopError{}
+	switch {
+	case err == nil && watchHit != "":
+		result.Status, result.Reason = "watch", watchHit
+	case err == nil:
+	case errors.As(err, &loop):
+		result.Status = "loop"
+	case errors.Is(err, ErrInstructionLimit), errors.Is(err, ErrCycleLimit):
+		result.Status = "limit"
+	case errors.Is(err, context.DeadlineExceeded):
+		result.Status = "timeout"
+	default:
+		result.Status = "error"
+	}
+	if err != nil {
+		result.Reason = err.Error()
+	}
+	return result
+}
+
+// Find the programs to run: every file without extension or with the `.bin`
+// or `.com` extension in a directory, the other paths are programs.
+func findBatchPrograms(paths []string) ([]string, error) {
+	programs := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			programs = append(programs, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if entry.Type().IsRegular() && (ext == "" || ext == ".bin" || ext == ".com") {
+				programs = append(programs, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return programs, nil
+}
+
+// Read a manifest: one program per line, relative to the manifest. Empty
+// lines and lines starting with # are ignored.
+func readBatchManifest(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	programs := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		programs = append(programs, line)
+	}
+	return programs, scanner.Err()
+}
+
+func WriteBatchCSV(out io.Writer, results []BatchResult) error {
+	w := csv.NewWriter(out)
+	header := []string{"program", "status", "reason", "instructions", "cycles"}
+	header = append(header, registerNames...)
+	header = append(header, "trace_sha256", "memory_sha256", "duration_ms")
+	w.Write(header)
+
+	for _, r := range results {
+		row := []string{r.Program, r.Status, r.Reason, strconv.Itoa(r.Instructions), strconv.Itoa(r.Cycles)}
+		for _, reg := range registerNames {
+			row = append(row, fmt.Sprintf("0x%04x", r.Registers[reg]))
+		}
+		row = append(row, r.TraceHash, r.MemoryHash, fmt.Sprintf("%.3f", r.Duration.Seconds()*1000))
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func WriteBatchJSON(out io.Writer, results []BatchResult) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write the programs assembled from their sources in a temporary directory
+func writeBatchPrograms(t *testing.T, sources map[string]string) string {
+	dir := t.TempDir()
+	for name, source := range sources {
+		code, err := Assemble(strings.NewReader(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), code, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRunBatch(t *testing.T) {
+	dir := writeBatchPrograms(t, map[string]string{
+		"ok":    "mov ax, 1\nmov bx, 2\n",
+		"loop":  "mov ax, 1\njmp $\n",
+		"long":  "mov cx, 1000\nsub cx, 1\njne 3\n",
+		"watch": "mov bx, 0x100\nmov [bx], ax\nmov cx, 1\n",
+	})
+	tests := []struct {
+		program      string
+		status       string
+		reason       string
+		instructions int
+		ax, cx       uint16
+	}{
+		{"ok", "ok", "", 2, 1, 0},
+		{"loop", "loop", "infinite loop at 0x10003: jump to itself", 2, 1, 0},
+		{"long", "limit", "instruction limit reached", 100, 0, 950},
+		{"watch", "watch", "write to 0x00100", 2, 0, 0},
+		{"missing", "error", "open " + filepath.Join(dir, "missing") + ": no such file or directory", 0, 0, 0},
+		{"ok", "ok", "", 2, 1, 0},
+	}
+	programs := []string{}
+	for _, test := range tests {
+		programs = append(programs, filepath.Join(dir, test.program))
+	}
+
+	results := RunBatch(context.Background(), programs, BatchOptions{
+		Workers: 3,
+		Limits:  Limits{MaxInstructions: 100, DetectLoops: true},
+		Watches: Watches{Write: "100"},
+	})
+	if len(results) != len(tests) {
+		t.Fatalf("%d results, expected %d", len(results), len(tests))
+	}
+	for n, test := range tests {
+		r := results[n]
+		if r.Program != programs[n] || r.Status != test.status || r.Reason != test.reason {
+			t.Errorf("result %d: %s %s %q, expected %s %s %q", n, r.Program, r.Status, r.Reason, programs[n], test.status, test.reason)
+		}
+		if r.Instructions != test.instructions || r.Registers["ax"] != test.ax || r.Registers["cx"] != test.cx {
+			t.Errorf("%s: %d instructions ax 0x%04x cx 0x%04x, expected %d, 0x%04x and 0x%04x", test.program, r.Instructions, r.Registers["ax"], r.Registers["cx"], test.instructions, test.ax, test.cx)
+		}
+	}
+
+	// Each program has its own machine, the same program give the same hashes
+	first, again := results[0], results[len(results)-1]
+	if first.TraceHash != again.TraceHash || first.MemoryHash != again.MemoryHash {
+		t.Errorf("the same program run twice has hashes %s %s and %s %s", first.TraceHash, first.MemoryHash, again.TraceHash, again.MemoryHash)
+	}
+	if first.TraceHash == results[1].TraceHash || first.MemoryHash == results[1].MemoryHash {
+		t.Errorf("two programs have the same hashes %s %s", first.TraceHash, first.MemoryHash)
+	}
+}
+
+func TestBatchPrograms(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b.bin", "c.COM", "d.asm", "e.lst"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "manifest")
+	if err := os.WriteFile(manifest, []byte("# Programs\na\n\n  sub/f  \n/abs/g\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := findBatchPrograms([]string{dir, filepath.Join(dir, "d.asm")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a", "b.bin", "c.COM", "manifest", "d.asm"}
+	if len(found) != len(expected) {
+		t.Fatalf("found %v, expected %v in %s", found, expected, dir)
+	}
+	for n, name := range expected {
+		if found[n] != filepath.Join(dir, name) {
+			t.Errorf("found %s, expected %s", found[n], filepath.Join(dir, name))
+		}
+	}
+	if _, err := findBatchPrograms([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("a missing path is found")
+	}
+
+	listed, err := readBatchManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{filepath.Join(dir, "a"), filepath.Join(dir, "sub/f"), "/abs/g"}
+	if strings.Join(listed, " ") != strings.Join(expected, " ") {
+		t.Errorf("manifest list %v, expected %v", listed, expected)
+	}
+}
+
+func TestWriteBatchCSV(t *testing.T) {
+	results := []BatchResult{{
+		Program:      "p",
+		Status:       "loop",
+		Reason:       "jump to itself, again",
+		Instructions: 3,
+		Cycles:       12,
+		Registers:    map[string]uint16{"ax": 0x1234},
+	}}
+	out := &strings.Builder{}
+	if err := WriteBatchCSV(out, results); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || len(rows[0]) != len(rows[1]) {
+		t.Fatalf("rows %q, expected a header and a row of the same size", rows)
+	}
+	expected := map[string]string{"program": "p", "status": "loop", "reason": "jump to itself, again", "instructions": "3", "cycles": "12", "ax": "0x1234", "bx": "0x0000"}
+	for n, column := range rows[0] {
+		if value, ok := expected[column]; ok && rows[1][n] != value {
+			t.Errorf("%s is %q, expected %q", column, rows[1][n], value)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Model of the bus interface unit (BIU) of the 8086 and 8088, to get closer
+// to the real timing than the instruction table.
+//
+// The execution unit (EU) take the bytes of instructions from the prefetch
+// queue, the BIU fill the queue whenever the bus is free. A bus cycle last 4
+// clocks, T1 to T4, plus the wait states inserted by slow memory. The 8086
+// fetch a word per bus cycle in a queue of 6 bytes, the 8088 a byte in a
+// queue of 4 bytes, and need two bus cycles to transfer a word of data. A jump
+// flush the queue so the EU wait for the first bytes at the new address.
+//
+// The clocks of the EU come from the instruction table of the processor, which
+// include its data transfers without wait states. The model add the clocks spent
+// waiting for the queue, for the bus and for the wait states.
+type BIU struct {
+	cpu        *CPU
+	queueSize  int // Bytes of the prefetch queue
+	busWidth   int // Bytes transferred by a bus cycle
+	waitStates int // Clocks added to every bus cycle
+
+	queue     int  // Bytes in the queue
+	fetch     int  // Physical address of the next byte to prefetch
+	busClock  int  // Clock of the current bus cycle, 1 is T1, 0 when the bus is idle
+	busData   bool // The current bus cycle transfer data, otherwise it prefetch
+	discard   bool // The current prefetch was made useless by a flush
+	requested int  // Data bus cycles made by the instruction being executed
+	extra     int  // Bus cycles not accounted by the instruction table
+	pending   int  // Data bus cycles waiting for the bus
+
+	cycles      int // Clocks since the start of the program
+	execution   int // Clocks of the EU from the instruction table
+	waited      int // Clocks the EU waited for the queue or the bus
+	fetchCycles int // Bus cycles used to prefetch
+	dataCycles  int // Bus cycles used to transfer data
+	flushes     int // Number of times the queue was flushed
+	thrown      int // Prefetched bytes thrown away by flushes
+}
+
+func NewBIU(cpu *CPU, waitStates int) (*BIU, error) {
+	if waitStates < 0 {
+		return nil, fmt.Errorf("invalid number of wait states %d", waitStates)
+	}
+	return &BIU{cpu: cpu, queueSize: cpu.queueSize, busWidth: cpu.busWidth, waitStates: waitStates}, nil
+}
+
+func (b *BIU) observeRead(address int, size int) {
+	b.transfer(address, size)
+}
+
+func (b *BIU) observeWrite(address int, size int) {
+	b.transfer(address, size)
+}
+
+// A word take two bus cycles on the 8088, and on the 8086 when it is not
+// aligned. The table of the 8088 already count the second one, the table of
+// the 8086 does not know the address.
+func (b *BIU) transfer(address int, size int) {
+	cycles := 1
+	if size == 2 && (b.busWidth == 1 || address%2 == 1) {
+		cycles = 2
+	}
+	b.requested += cycles
+	if b.busWidth == 2 {
+		b.extra += cycles - 1
+	}
+}
+
+// Account for an instruction of size bytes at address, executed after the
+// previous one. euCycles is the estimate of the instruction table of the
+// processor.
+func (b *BIU) instruction(address int, size int, euCycles int) {
+	// The queue hold the bytes just before fetch, anything else is a jump
+	if address != b.fetch-b.queue {
+		if b.queue > 0 || b.busClock > 0 {
+			b.flushes++
+		}
+		b.thrown += b.queue
+		b.queue = 0
+		b.fetch = address
+		b.discard = b.busClock > 0 && !b.busData
+	}
+
+	// Decoding take the bytes from the queue as they arrive
+	for needed := size; needed > 0; {
+		if b.queue == 0 {
+			b.tick()
+			b.waited++
+			continue
+		}
+		taken := min(needed, b.queue)
+		b.queue -= taken
+		needed -= taken
+	}
+
+	// Data transfers are slower than in the table with wait states and with
+	// the extra bus cycles.
+	clocks := euCycles + b.requested*b.waitStates + b.extra*(4+b.waitStates)
+	b.execution += euCycles
+	b.waited += clocks - euCycles
+	b.pending += b.requested
+	b.requested, b.extra = 0, 0
+	for c := 0; c < clocks; c++ {
+		b.tick()
+	}
+	// The transfers started late because the bus was busy prefetching
+	for b.pending > 0 {
+		b.tick()
+		b.waited++
+	}
+}
+
+// A halted CPU does nothing but the BIU still fill the queue
+func (b *BIU) halt() {
+	b.tick()
+	b.execution++
+}
+
+// Advance by one clock
+func (b *BIU) tick() {
+	b.cycles++
+	if b.busClock == 0 {
+		switch {
+		case b.pending > 0:
+			b.busData = true
+		case b.queueSize-b.queue >= b.busWidth:
+			b.busData = false
+		default:
+			return // The queue is full, the bus stay idle
+		}
+	}
+
+	b.busClock++
+	if b.busClock < 4+b.waitStates {
+		return
+	}
+
+	// End of T4
+	b.busClock = 0
+	if b.busData {
+		b.pending--
+		b.dataCycles++
+		return
+	}
+	b.fetchCycles++
+	if b.discard {
+		b.discard = false
+		return
+	}
+	// A word fetch from an odd address only bring one useful byte
+	bytes := b.busWidth - b.fetch%b.busWidth
+	b.queue += bytes
+	b.fetch += bytes
+}
+
+// Print the cycles of the model next to the estimate of the instruction table
+func (b *BIU) Print(out io.Writer, estimate int) {
+	difference := 0.0
+	if estimate > 0 {
+		difference = float64(b.cycles-estimate) * 100 / float64(estimate)
+	}
+	fmt.Fprintf(out, "  model                  %s, %d bytes queue, %d bits bus, %d wait states\n", b.cpu, b.queueSize, b.busWidth*8, b.waitStates)
+	fmt.Fprintf(out, "  table estimate         %10d cycles\n", estimate)
+	fmt.Fprintf(out, "  bus interface model    %10d cycles (%+.1f%%)\n", b.cycles, difference)
+	fmt.Fprintf(out, "    execution unit       %10d cycles\n", b.execution)
+	fmt.Fprintf(out, "    waiting              %10d cycles\n", b.waited)
+	fmt.Fprintf(out, "  bus cycles             %10d prefetch, %d data\n", b.fetchCycles, b.dataCycles)
+	fmt.Fprintf(out, "  queue flushes          %10d, %d prefetched bytes thrown away\n", b.flushes, b.thrown)
+}
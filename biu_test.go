@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Execute a program with the model of the bus of a processor
+func runBIU(t *testing.T, source string, cpu string, waitStates int) *Storage {
+	code, err := Assemble(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	store.load(strings.NewReader(string(code)), codeSegment, 0)
+	if _, err := store.configure(ExecuteOptions{CPU: cpu, BIU: true, WaitStates: waitStates}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.run(context.Background(), Limits{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBIU(t *testing.T) {
+	words := "mov bx, 0x100\nmov ax, [bx]\nmov [bx + 2], ax\nmov cx, [bx + 2]\n"
+	odd := "mov bx, 0x101\nmov ax, [bx]\nmov [bx + 2], ax\nmov cx, [bx + 2]\n"
+	jumps := "mov cx, 3\nsub cx, 1\njne 3\nmov ax, 1\n"
+	tests := []struct {
+		source      string
+		cpu         string
+		waitStates  int
+		cycles      int
+		fetchCycles int
+		dataCycles  int
+		flushes     int
+	}{
+		{words, "8086", 0, 60, 8, 3, 0},
+		{words, "8088", 0, 83, 14, 6, 0},
+		{words, "8086", 1, 66, 8, 3, 0},
+		{odd, "8086", 0, 72, 8, 6, 0},
+		{jumps, "8086", 0, 84, 19, 0, 2},
+	}
+	for _, test := range tests {
+		store := runBIU(t, test.source, test.cpu, test.waitStates)
+		b := store.biu
+		// The execution unit take the clocks of the table of the processor
+		if b.execution != store.cycles {
+			t.Errorf("%q on %s: %d clocks of the execution unit, expected the %d of the table", test.source, test.cpu, b.execution, store.cycles)
+		}
+		if b.cycles != b.execution+b.waited {
+			t.Errorf("%q on %s: %d cycles, expected %d executing and %d waiting", test.source, test.cpu, b.cycles, b.execution, b.waited)
+		}
+		if b.cycles != test.cycles || b.fetchCycles != test.fetchCycles || b.dataCycles != test.dataCycles || b.flushes != test.flushes {
+			t.Errorf("%q on %s with %d wait states: %d cycles, %d prefetch, %d data and %d flushes, expected %d, %d, %d and %d", test.source, test.cpu, test.waitStates, b.cycles, b.fetchCycles, b.dataCycles, b.flushes, test.cycles, test.fetchCycles, test.dataCycles, test.flushes)
+		}
+	}
+
+	if _, err := NewBIU(cpus["8086"], -1); err == nil {
+		t.Error("negative wait states are accepted")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Run the per-instruction test vectors of the SingleStepTests project
+// (https://github.com/SingleStepTests/8088) and report how many pass for each
+// opcode. Each vector give the full state of the CPU before and after a
+// single instruction.
+//
+// Vectors are stored in one file per opcode (`00.json`, `80.4.json.gz`, ...),
+// an optional `metadata.json` in the same directory give the flags that are
+// undefined for each opcode so that they are not compared.
+//
+// The cycles of a vector are its bus cycles. Our cycles are estimated from the
+// timing tables so they are only counted when they differ, unless cycles is
+// set and the vector fail. An error is returned when a vector fail.
+func RunConformance(paths []string, verbose bool, cycles bool, out io.Writer) error {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if name != "metadata.json" && (strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")) {
+				files = append(files, filepath.Join(path, name))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	total := conformanceResult{}
+	for _, file := range files {
+		opcode := strings.SplitN(filepath.Base(file), ".json", 2)[0]
+		metadata, err := loadTestMetadata(filepath.Join(filepath.Dir(file), "metadata.json"))
+		if err != nil {
+			return err
+		}
+		vectors, err := loadTestVectors(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		result := conformanceResult{}
+		for _, vector := range vectors {
+			failures, cyclesOff, err := vector.run(metadata.flagsMask(opcode))
+			if cyclesOff != "" {
+				result.cycles++
+				if cycles {
+					failures = append(failures, cyclesOff)
+				}
+			}
+			switch {
+			case errors.Is(err, ErrNotImplemented):
+				result.skipped++
+			case err != nil:
+				result.failed++
+				failures = append(failures, err.Error())
+			case len(failures) > 0:
+				result.failed++
+			default:
+				result.passed++
+			}
+			if verbose && len(failures) > 0 {
+				fmt.Fprintf(out, "FAIL %s %s\n", opcode, vector.Name)
+				for _, failure := range failures {
+					fmt.Fprintf(out, "     %s\n", failure)
+				}
+			}
+		}
+
+		fmt.Fprintf(out, "%-6s %s\n", opcode, result)
+		total.passed += result.passed
+		total.failed += result.failed
+		total.skipped += result.skipped
+		total.cycles += result.cycles
+	}
+
+	fmt.Fprintf(out, "%-6s %s\n", "TOTAL", total)
+	if total.failed > 0 {
+		return fmt.Errorf("%d test vectors failed", total.failed)
+	}
+	return nil
+}
+
+type conformanceResult struct {
+	passed  int
+	failed  int
+	skipped int
+	cycles  int // Vectors whose cycles differ from the estimate
+}
+
+func (r conformanceResult) String() string {
+	status := "PASS"
+	switch {
+	case r.skipped > 0 && r.passed+r.failed == 0:
+		status = "NOT IMPLEMENTED"
+	case r.failed > 0:
+		status = "FAIL"
+	}
+	return fmt.Sprintf(
+		"%6d passed %6d failed %6d skipped %6d cycles off  %s",
+		r.passed, r.failed, r.skipped, r.cycles, status,
+	)
+}
+
+type testVector struct {
+	Name    string            `json:"name"`
+	Bytes   []int             `json:"bytes"`
+	Initial testState         `json:"initial"`
+	Final   testState         `json:"final"`
+	Cycles  []json.RawMessage `json:"cycles"`
+}
+
+type testState struct {
+	Regs map[string]uint16 `json:"regs"`
+	Ram  [][2]int          `json:"ram"`
+}
+
+func loadTestVectors(path string) ([]testVector, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	vectors := []testVector{}
+	err = json.NewDecoder(reader).Decode(&vectors)
+	return vectors, err
+}
+
+// Execute the vector and return the differences with the expected state and
+// with its cycles, apart because our cycles are estimated. ErrNotImplemented
+// is returned when we cannot decode or execute the instruction.
+func (v *testVector) run(flagsMask uint16) (failures []string, cyclesOff string, err error) {
+	store := NewStorage(io.Discard)
+	store.cpu = cpus["8088"]
+	for reg, value := range v.Initial.Regs {
+		store.setRegister(testRegisterName(reg), value)
+	}
+	for _, ram := range v.Initial.Ram {
+		store.memory[ram[0]%len(store.memory)] = byte(ram[1])
+	}
+	// The beginning of the instruction can be in the prefetch queue instead
+	// of in the ram.
+	start := physicalAddress(store.getRegister("cs"), store.getRegister("ip"))
+	for i, b := range v.Bytes {
+		store.memory[(start+i)%len(store.memory)] = byte(b)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	_, err = store.step()
+	if err != nil {
+		return nil, "", err
+	}
+
+	for reg, initial := range v.Initial.Regs {
+		expected, ok := v.Final.Regs[reg]
+		if !ok {
+			expected = initial
+		}
+		got := store.getRegister(testRegisterName(reg))
+		if reg == "flags" {
+			expected &= flagsMask
+			got &= flagsMask
+		}
+		if got != expected {
+			failures = append(failures, fmt.Sprintf(
+				"%-5s expected 0x%04x got 0x%04x", reg, expected, got,
+			))
+		}
+	}
+	for _, ram := range v.Final.Ram {
+		got := store.memory[ram[0]%len(store.memory)]
+		if got != byte(ram[1]) {
+			failures = append(failures, fmt.Sprintf(
+				"[%05x] expected 0x%02x got 0x%02x", ram[0], ram[1], got,
+			))
+		}
+	}
+	sort.Strings(failures)
+
+	if len(v.Cycles) > 0 && store.cycles != len(v.Cycles) {
+		cyclesOff = fmt.Sprintf("cycles expected %d got %d", len(v.Cycles), store.cycles)
+	}
+	return failures, cyclesOff, nil
+}
+
+func testRegisterName(reg string) string {
+	if reg == "flags" {
+		return "fl"
+	}
+	return reg
+}
+
+// Metadata of a test suite, only the part we use.
+type testMetadata struct {
+	Opcodes map[string]testOpcodeMetadata `json:"opcodes"`
+}
+
+type testOpcodeMetadata struct {
+	FlagsMask *uint16                       `json:"flags-mask"`
+	Reg       map[string]testOpcodeMetadata `json:"reg"`
+}
+
+func loadTestMetadata(path string) (testMetadata, error) {
+	metadata := testMetadata{}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return metadata, nil
+	}
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(content, &metadata)
+	return metadata, err
+}
+
+// Return the mask of the flags that are defined after the execution of the
+// opcode, opcode is either `XX` or `XX.REG` for group opcodes.
+func (m testMetadata) flagsMask(opcode string) uint16 {
+	mask := uint16(0xFFFF)
+	code, reg, _ := strings.Cut(strings.ToUpper(opcode), ".")
+	info, ok := m.Opcodes[code]
+	if !ok {
+		return mask
+	}
+	if info.FlagsMask != nil {
+		mask = *info.FlagsMask
+	}
+	if regInfo, ok := info.Reg[reg]; ok && regInfo.FlagsMask != nil {
+		mask = *regInfo.FlagsMask
+	}
+	return mask
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The vectors of testdata/8088 are a few written by hand in the format of
+// SingleStepTests for the instructions we implement, they must all pass.
+func TestConformance(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := RunConformance([]string{filepath.Join("testdata", "8088")}, true, false, out)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if !strings.Contains(out.String(), "TOTAL") || strings.Contains(out.String(), "FAIL") {
+		t.Errorf("unexpected report\n%s", out)
+	}
+}
+
+// mov ax, bx with 3 bus cycles while its estimate is 2, and stc with a wrong
+// carry flag.
+const conformanceVectors = `[
+{"name": "mov ax, bx", "bytes": [137, 216],
+ "initial": {"regs": {"ax": 1, "bx": 2, "cs": 4096, "ip": 0, "flags": 61442}, "ram": [[65536, 137], [65537, 216]]},
+ "final": {"regs": {"ax": 2, "ip": 2}, "ram": []},
+ "cycles": [[], [], []]},
+{"name": "stc", "bytes": [249],
+ "initial": {"regs": {"cs": 4096, "ip": 0, "flags": 61442}, "ram": [[65536, 249]]},
+ "final": {"regs": {"ip": 1, "flags": 61442}, "ram": []},
+ "cycles": [[], []]}
+]`
+
+func TestConformanceFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "89.json")
+	err := os.WriteFile(path, []byte(conformanceVectors), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cycles   bool
+		expected string
+	}{
+		{false, "     1 passed      1 failed      0 skipped      1 cycles off  FAIL"},
+		{true, "     0 passed      2 failed      0 skipped      1 cycles off  FAIL"},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := RunConformance([]string{path}, true, test.cycles, out)
+		if err == nil {
+			t.Errorf("cycles %t: no error for failing vectors", test.cycles)
+		}
+		if !strings.Contains(out.String(), test.expected) {
+			t.Errorf("cycles %t: expected %q in\n%s", test.cycles, test.expected, out)
+		}
+		if !strings.Contains(out.String(), "flags expected 0xf002 got 0xf003") {
+			t.Errorf("cycles %t: flags difference not printed\n%s", test.cycles, out)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Processor model, they differ by the instructions they decode and by their
+// bus. The 8088 and the 80188 are the 8086 and the 80186 with an 8 bits bus,
+// the NEC V20 is a 8088 replacement with the instructions of the 80186.
+type CPU struct {
+	name      string
+	decoders  map[byte]func([]byte, *ReaderCounter) Instruction
+	queueSize int // Bytes of the prefetch queue
+	busWidth  int // Bytes transferred by a bus cycle
+}
+
+var cpus = map[string]*CPU{
+	"8086":  {"8086", decoders8086, 6, 2},
+	"8088":  {"8088", decoders8086, 4, 1},
+	"80186": {"80186", decoders80186, 6, 2},
+	"80188": {"80188", decoders80186, 4, 1},
+	"v20":   {"v20", decodersV20, 4, 1},
+}
+
+func LookupCPU(name string) (*CPU, error) {
+	cpu, ok := cpus[strings.ToLower(name)]
+	if !ok {
+		names := []string{}
+		for name := range cpus {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown cpu %s, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return cpu, nil
+}
+
+func (cpu *CPU) String() string {
+	return cpu.name
+}
+
+// Decode the next instruction like this CPU would
+func (cpu *CPU) Decode(bus io.Reader) (Instruction, error) {
+	return decode(cpu.decoders, bus)
+}
+
+// Same as estimateCycles, with an 8 bits bus every word transfer, to memory
+// or to a port, take 4 more cycles. The 80186 use the table of the 8086.
+func (cpu *CPU) estimateCycles(i Instruction, jumped bool) int {
+	cycles := estimateCycles(i, jumped)
+	if cpu.busWidth == 1 && i.w == 1 {
+		if operandKind(i.operandLeft) == 'm' {
+			cycles += 4 * leftTransfers[i.operator]
+		}
+		if operandKind(i.operandRight) == 'm' {
+			cycles += 4
+		}
+		if _, ok := portCycles[i.operator]; ok {
+			cycles += 4
+		}
+	}
+	return cycles
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Estimate the number of clock cycles of an instruction on a 8086.
+//
+// This is the simple estimate from the instruction timing table, it ignore
+// the prefetch queue, wait states and the penalty of word transfers on odd
+// addresses, see BIU for those. jumped tell if a conditional jump was taken.
+//
+// Reference table 2-20 Effective Address Calculation Time and table 2-21
+// Instruction Set Summary
+func estimateCycles(i Instruction, jumped bool) int {
+	if timing, ok := jumpCycles[i.operator]; ok {
+		if jumped {
+			return timing[0]
+		}
+		return timing[1]
+	}
+
+	if cycles, ok := singleByteCycles[i.operator]; ok {
+		return cycles
+	}
+	if cycles, ok := portCycles[i.operator]; ok {
+		if i.operandLeft == "dx" || i.operandRight == "dx" {
+			return cycles[0]
+		}
+		return cycles[1]
+	}
+	if _, ok := fpuCycles[i.operator]; ok {
+		// The CPU side of ESC, the 8087 run on its own
+		if operandKind(i.operandLeft) == 'm' {
+			return 8 + eaCycles(i.operandLeft)
+		}
+		return 2
+	}
+	if cycles, ok := extendedCycles[i.operator]; ok {
+		if operandKind(i.operandLeft) == 'm' || operandKind(i.operandRight) == 'm' {
+			return cycles[1]
+		}
+		return cycles[0]
+	}
+
+	timing, ok := operandCycles[i.operator]
+	if !ok {
+		return 0
+	}
+
+	left, right := operandKind(i.operandLeft), operandKind(i.operandRight)
+	switch {
+	case left == 'r' && right == 'r':
+		return timing.regReg
+	case left == 'r' && right == 'm':
+		return timing.regMem + eaCycles(i.operandRight)
+	case left == 'm' && right == 'r':
+		return timing.memReg + eaCycles(i.operandLeft)
+	case left == 'r' && right == 'i':
+		return timing.regImm
+	case left == 'm' && right == 'i':
+		return timing.memImm + eaCycles(i.operandLeft)
+	}
+	return 0
+}
+
+// Return 'r' for a register, 'm' for memory and 'i' for an immediate
+func operandKind(operand string) byte {
+	if strings.Contains(operand, "[") {
+		return 'm'
+	}
+	if _, err := strconv.ParseInt(operand, 10, 32); err == nil {
+		return 'i'
+	}
+	return 'r'
+}
+
+// Cycles needed to compute the effective address
+func eaCycles(operand string) int {
+	regs := []string{}
+	displacement := false
+	for _, term := range addressTerms(operand) {
+		if _, isReg := registersOffsets[term]; isReg {
+			regs = append(regs, term)
+		} else {
+			displacement = true
+		}
+	}
+
+	switch len(regs) {
+	case 0:
+		return 6
+	case 1:
+		if displacement {
+			return 9
+		}
+		return 5
+	}
+
+	// bp + di and bx + si are faster than bp + si and bx + di
+	timing := 8
+	if regs[0] == "bp" && regs[1] == "di" || regs[0] == "bx" && regs[1] == "si" {
+		timing = 7
+	}
+	if displacement {
+		timing += 4
+	}
+	return timing
+}
+
+// ==================
+// ===== TABLES =====
+// ==================
+
+type cycleTiming struct {
+	regReg int
+	regMem int
+	memReg int
+	regImm int
+	memImm int
+}
+
+// Base cycles of each operand combination, EA calculation not included.
+// Immediates to the accumulator take as long as to any register.
+var operandCycles = map[string]cycleTiming{
+	"mov": {2, 8, 9, 4, 10},
+	"add": {3, 9, 16, 4, 17},
+	"sub": {3, 9, 16, 4, 17},
+	"cmp": {3, 9, 9, 4, 10},
+}
+
+// Cycles of jumps and interrupts when taken and when not taken
+var jumpCycles = map[string][2]int{
+	"je":     {16, 4},
+	"jl":     {16, 4},
+	"jle":    {16, 4},
+	"jb":     {16, 4},
+	"jbe":    {16, 4},
+	"jp":     {16, 4},
+	"jo":     {16, 4},
+	"js":     {16, 4},
+	"jne":    {16, 4},
+	"jge":    {16, 4},
+	"jg":     {16, 4},
+	"jnb":    {16, 4},
+	"ja":     {16, 4},
+	"jpo":    {16, 4},
+	"jno":    {16, 4},
+	"jns":    {16, 4},
+	"loop":   {17, 5},
+	"loopz":  {18, 6},
+	"loopnz": {19, 5},
+	"jcxz":   {18, 6},
+	"jmp":    {15, 15},
+	"int":    {51, 51},
+	"int3":   {52, 52},
+	"into":   {53, 4},
+	"iret":   {24, 24},
+}
+
+// Memory transfers made by an operand on the left, arithmetic read then write
+var leftTransfers = map[string]int{
+	"mov": 1,
+	"add": 2,
+	"sub": 2,
+	"cmp": 1,
+}
+
+// Cycles of the instructions added by the 80186, with registers and with
+// memory. Reference 80186 Instruction Set Summary, shifts count one bit and
+// ENTER one level.
+var extendedCycles = map[string][2]int{
+	"push":  {10, 10},
+	"pop":   {8, 8},
+	"pusha": {36, 36},
+	"popa":  {51, 51},
+	"enter": {15, 15},
+	"leave": {8, 8},
+	"bound": {33, 33},
+	"imul":  {22, 25},
+	"insb":  {14, 14},
+	"insw":  {14, 14},
+	"outsb": {14, 14},
+	"outsw": {14, 14},
+	"rol":   {6, 18},
+	"ror":   {6, 18},
+	"rcl":   {6, 18},
+	"rcr":   {6, 18},
+	"shl":   {6, 18},
+	"shr":   {6, 18},
+	"sar":   {6, 18},
+}
+
+// Cycles of IN and OUT with the port in DX and with an immediate port
+var portCycles = map[string][2]int{
+	"in":  {8, 10},
+	"out": {8, 10},
+}
+
+// Instructions without operands
+var singleByteCycles = map[string]int{
+	"hlt":   2,
+	"cmc":   2,
+	"clc":   2,
+	"stc":   2,
+	"cli":   2,
+	"sti":   2,
+	"fwait": 3,
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Serve the Debug Adapter Protocol (https://microsoft.github.io/debug-adapter-protocol)
+// so that editors can debug programs. When address is empty the protocol is
+// spoken on stdin/stdout like editors expect from a debug adapter, otherwise
+// we wait for the editor to connect on address.
+//
+// The launch request take the path of the binary in `program`, the source in
+// `source` (default to the program path with `.asm` appended) and
+// `stopOnEntry`. The source is assembled with the built-in assembler to map
+// lines to addresses, a NASM listing (`.lst`) can be given instead. Without
+// source the program path with `.lst` appended is tried, then the program is
+// disassembled and the editor is given the disassembly as source. `cpu`
+// choose the processor model like the -cpu flag.
+//
+// Conditions of breakpoints, the `breakWhen` conditions of the launch request
+// and evaluated expressions use the expression language of CompileExpression.
+// `last-write <address>` can also be evaluated to find the last instruction
+// that wrote to a physical address.
+func ServeDAP(address string) error {
+	if address == "" {
+		return newDapSession(os.Stdin, os.Stdout).serve()
+	}
+
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Fprintf(os.Stderr, "Waiting for the editor on %s\n", listener.Addr())
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return newDapSession(conn, conn).serve()
+}
+
+type dapSession struct {
+	reader   *bufio.Reader
+	writer   io.Writer
+	seq      int
+	requests chan dapMessage
+	paused   atomic.Bool
+
+	store    *Storage
+	debugger *Debugger
+	source   *SourceMap
+	// Breakpoints of the source, to remove them when they are replaced
+	sourceBreakpoints []int
+	dataBreakpoints   []dapDataBreakpoint
+	stopOnEntry       bool
+	exited            bool
+}
+
+type dapMessage struct {
+	Seq        int             `json:"seq"`
+	Type       string          `json:"type"`
+	Command    string          `json:"command,omitempty"`
+	Arguments  json.RawMessage `json:"arguments,omitempty"`
+	Event      string          `json:"event,omitempty"`
+	RequestSeq int             `json:"request_seq,omitempty"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message,omitempty"`
+	Body       any             `json:"body,omitempty"`
+}
+
+func newDapSession(in io.Reader, out io.Writer) *dapSession {
+	return &dapSession{
+		reader:   bufio.NewReader(in),
+		writer:   out,
+		requests: make(chan dapMessage, 16),
+	}
+}
+
+// Requests are read in the background so that a pause can interrupt a
+// running program.
+func (s *dapSession) receive() {
+	defer close(s.requests)
+	for {
+		length := 0
+		for {
+			header, err := s.reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			header = strings.TrimSpace(header)
+			if header == "" {
+				break
+			}
+			name, value, _ := strings.Cut(header, ":")
+			if strings.EqualFold(name, "Content-Length") {
+				length, _ = strconv.Atoi(strings.TrimSpace(value))
+			}
+		}
+
+		content := make([]byte, length)
+		if _, err := io.ReadFull(s.reader, content); err != nil {
+			return
+		}
+		request := dapMessage{}
+		if err := json.Unmarshal(content, &request); err != nil {
+			continue
+		}
+		if request.Command == "pause" {
+			s.paused.Store(true)
+		}
+		s.requests <- request
+	}
+}
+
+func (s *dapSession) serve() error {
+	go s.receive()
+	for request := range s.requests {
+		body, err := s.handle(request)
+		response := dapMessage{
+			Type:       "response",
+			RequestSeq: request.Seq,
+			Command:    request.Command,
+			Success:    err == nil,
+			Body:       body,
+		}
+		if err != nil {
+			response.Message = err.Error()
+		}
+		if err := s.send(response); err != nil {
+			return err
+		}
+
+		// Some requests trigger events that must come after their response.
+		// The editor send the breakpoints once initialized, we need the
+		// program for them.
+		switch request.Command {
+		case "launch":
+			if err == nil {
+				s.event("initialized", nil)
+			}
+		case "configurationDone":
+			if s.stopOnEntry {
+				s.stopped("entry", "")
+			} else {
+				s.run(s.debugger.Continue)
+			}
+		case "continue":
+			s.run(s.debugger.Continue)
+		case "next", "stepIn", "stepOut":
+			s.run(func(func() bool) stopReason { return s.debugger.Step() })
+		case "stepBack":
+			s.exited = false
+			s.run(func(func() bool) stopReason { return s.debugger.StepBack() })
+		case "reverseContinue":
+			s.exited = false
+			s.run(s.debugger.ReverseContinue)
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *dapSession) send(message dapMessage) error {
+	s.seq++
+	message.Seq = s.seq
+	content, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.writer, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	return err
+}
+
+func (s *dapSession) event(name string, body any) {
+	s.send(dapMessage{Type: "event", Event: name, Body: body})
+}
+
+func (s *dapSession) stopped(reason string, text string) {
+	s.event("stopped", map[string]any{
+		"reason":            reason,
+		"text":              text,
+		"threadId":          1,
+		"allThreadsStopped": true,
+	})
+}
+
+// Run the program until it stop and tell the editor why
+func (s *dapSession) run(execute func(interrupted func() bool) stopReason) {
+	if s.exited {
+		return
+	}
+	s.paused.Store(false)
+	reason := execute(func() bool { return s.paused.Load() })
+	switch reason.kind {
+	case stopStep:
+		s.stopped("step", "")
+	case stopBreakpoint:
+		s.stopped("breakpoint", "")
+	case stopWatchpoint:
+		s.stopped("data breakpoint", fmt.Sprintf("access to 0x%05x", reason.watch.hit))
+	case stopInterrupted:
+		s.stopped("pause", "")
+	case stopError:
+		s.stopped("exception", reason.err.Error())
+	case stopHistoryStart:
+		s.stopped("entry", "start of the history")
+	case stopCondition:
+		s.stopped("data breakpoint", reason.detail)
+	case stopExited:
+		s.exited = true
+		s.event("exited", map[string]any{"exitCode": s.debugger.store.exitCode})
+		s.event("terminated", nil)
+	}
+}
+
+func (s *dapSession) handle(request dapMessage) (any, error) {
+	if s.store == nil && request.Command != "initialize" && request.Command != "launch" &&
+		request.Command != "disconnect" {
+		return nil, fmt.Errorf("no program launched")
+	}
+
+	switch request.Command {
+	case "initialize":
+		return map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+			"supportsDisassembleRequest":       true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+			"supportsStepBack":                 true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsDataBreakpoints":          true,
+		}, nil
+
+	case "launch":
+		args := struct {
+			Program     string   `json:"program"`
+			Source      string   `json:"source"`
+			CPU         string   `json:"cpu"`
+			StopOnEntry bool     `json:"stopOnEntry"`
+			BreakWhen   []string `json:"breakWhen"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		err := s.launch(args.Program, args.Source, args.CPU, args.StopOnEntry)
+		if err != nil {
+			return nil, err
+		}
+		for _, text := range args.BreakWhen {
+			expression, err := CompileExpression(text)
+			if err != nil {
+				return nil, err
+			}
+			s.debugger.addCondition(expression)
+		}
+		return nil, nil
+
+	case "setBreakpoints":
+		args := struct {
+			Source      dapSource `json:"source"`
+			Breakpoints []struct {
+				Line      int    `json:"line"`
+				Condition string `json:"condition"`
+			} `json:"breakpoints"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		for _, address := range s.sourceBreakpoints {
+			s.debugger.removeBreakpoint(address)
+		}
+		s.sourceBreakpoints = nil
+
+		breakpoints := []map[string]any{}
+		for _, requested := range args.Breakpoints {
+			address, line, ok := s.source.address(requested.Line)
+			if !ok || !s.isSource(args.Source) {
+				breakpoints = append(breakpoints, map[string]any{
+					"verified": false,
+					"line":     requested.Line,
+					"message":  "no instruction at or after this line",
+				})
+				continue
+			}
+			var condition *Expression
+			if requested.Condition != "" {
+				var err error
+				condition, err = CompileExpression(requested.Condition)
+				if err != nil {
+					breakpoints = append(breakpoints, map[string]any{
+						"verified": false,
+						"line":     requested.Line,
+						"message":  err.Error(),
+					})
+					continue
+				}
+			}
+			s.debugger.addBreakpoint(address, condition)
+			s.sourceBreakpoints = append(s.sourceBreakpoints, address)
+			breakpoints = append(breakpoints, map[string]any{
+				"id":                   len(s.sourceBreakpoints),
+				"verified":             true,
+				"source":               s.sourceReference(),
+				"line":                 line,
+				"instructionReference": fmt.Sprintf("0x%05x", address),
+			})
+		}
+		return map[string]any{"breakpoints": breakpoints}, nil
+
+	case "dataBreakpointInfo":
+		args := struct {
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(strings.TrimSpace(args.Name))
+		if _, ok := registersOffsets[name]; ok {
+			return map[string]any{
+				"dataId":      "register:" + name,
+				"description": "When " + name + " change",
+				"accessTypes": []string{"write"},
+			}, nil
+		}
+		address, err := strconv.ParseUint(name, 0, 32)
+		if err != nil {
+			return map[string]any{
+				"dataId":      nil,
+				"description": "Only registers and physical addresses can be watched",
+			}, nil
+		}
+		return map[string]any{
+			"dataId":      fmt.Sprintf("memory:0x%05x", address&0xFFFFF),
+			"description": fmt.Sprintf("Access to the word at 0x%05x", address&0xFFFFF),
+			"accessTypes": []string{"read", "write", "readWrite"},
+		}, nil
+
+	case "setDataBreakpoints":
+		args := struct {
+			Breakpoints []dapDataBreakpoint `json:"breakpoints"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		for _, b := range s.dataBreakpoints {
+			s.removeDataBreakpoint(b)
+		}
+		s.dataBreakpoints = nil
+
+		breakpoints := []map[string]any{}
+		for _, b := range args.Breakpoints {
+			err := s.addDataBreakpoint(b)
+			if err != nil {
+				breakpoints = append(breakpoints, map[string]any{"verified": false, "message": err.Error()})
+				continue
+			}
+			s.dataBreakpoints = append(s.dataBreakpoints, b)
+			breakpoints = append(breakpoints, map[string]any{"verified": true})
+		}
+		return map[string]any{"breakpoints": breakpoints}, nil
+
+	case "configurationDone", "continue", "next", "stepIn", "stepOut", "pause",
+		"stepBack", "reverseContinue":
+		// The execution happen after the response
+		if request.Command == "continue" {
+			return map[string]any{"allThreadsContinued": true}, nil
+		}
+		return nil, nil
+
+	case "threads":
+		return map[string]any{
+			"threads": []map[string]any{{"id": 1, "name": "8086"}},
+		}, nil
+
+	case "stackTrace":
+		pc := s.debugger.pc()
+		name := "??"
+		if i, err := s.store.cpu.Decode(&memoryReader{s.store, pc, false}); err == nil {
+			name = i.String()
+		}
+		if symbol := s.source.symbol(pc); symbol != "" {
+			name = symbol + ": " + name
+		}
+		frame := map[string]any{
+			"id":                          1,
+			"name":                        name,
+			"line":                        0,
+			"column":                      0,
+			"instructionPointerReference": fmt.Sprintf("0x%05x", pc),
+		}
+		if line, ok := s.source.line(pc); ok {
+			frame["source"] = s.sourceReference()
+			frame["line"] = line
+			frame["column"] = 1
+		}
+		return map[string]any{"stackFrames": []any{frame}, "totalFrames": 1}, nil
+
+	case "scopes":
+		return map[string]any{"scopes": []map[string]any{
+			{"name": "Registers", "variablesReference": 1, "expensive": false},
+			{"name": "Flags", "variablesReference": 2, "expensive": false},
+		}}, nil
+
+	case "variables":
+		args := struct {
+			VariablesReference int `json:"variablesReference"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		variables := []map[string]any{}
+		switch args.VariablesReference {
+		case 1:
+			for _, reg := range registerNames {
+				variables = append(variables, map[string]any{
+					"name":               reg,
+					"value":              fmt.Sprintf("0x%04x", s.store.getRegister(reg)),
+					"variablesReference": 0,
+				})
+			}
+		case 2:
+			for _, flag := range flagNames {
+				value := 0
+				if s.store.getFlag(flag.mask) {
+					value = 1
+				}
+				variables = append(variables, map[string]any{
+					"name":               flag.name,
+					"value":              strconv.Itoa(value),
+					"variablesReference": 0,
+				})
+			}
+		}
+		return map[string]any{"variables": variables}, nil
+
+	case "evaluate":
+		args := struct {
+			Expression string `json:"expression"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		expression := strings.ToLower(strings.TrimSpace(args.Expression))
+		if address, ok := strings.CutPrefix(expression, "last-write "); ok {
+			value, err := strconv.ParseUint(strings.TrimSpace(address), 0, 32)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{
+				"result":             s.debugger.lastWrite(int(value) & 0xFFFFF),
+				"variablesReference": 0,
+			}, nil
+		}
+		compiled, err := CompileExpression(expression)
+		if err != nil {
+			return nil, err
+		}
+		value := compiled.Value(s.store)
+		return map[string]any{
+			"result":             fmt.Sprintf("0x%04x (%d)", value, value),
+			"variablesReference": 0,
+		}, nil
+
+	case "readMemory":
+		args := struct {
+			MemoryReference string `json:"memoryReference"`
+			Offset          int    `json:"offset"`
+			Count           int    `json:"count"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		address, err := strconv.ParseUint(args.MemoryReference, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		start := (int(address) + args.Offset) & 0xFFFFF
+		count := max(0, min(args.Count, len(s.store.memory)))
+		return map[string]any{
+			"address": fmt.Sprintf("0x%05x", start),
+			"data":    base64.StdEncoding.EncodeToString(s.store.readMemory(start, count)),
+		}, nil
+
+	case "disassemble":
+		args := struct {
+			MemoryReference   string `json:"memoryReference"`
+			Offset            int    `json:"offset"`
+			InstructionOffset int    `json:"instructionOffset"`
+			InstructionCount  int    `json:"instructionCount"`
+		}{}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		address, err := strconv.ParseUint(args.MemoryReference, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{
+			"instructions": s.disassemble(int(address)+args.Offset, args.InstructionOffset, args.InstructionCount),
+		}, nil
+
+	case "source":
+		return map[string]any{"content": strings.Join(s.source.lines, "\n")}, nil
+
+	case "disconnect", "terminate":
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported request %s", request.Command)
+}
+
+func (s *dapSession) launch(program string, source string, cpu string, stopOnEntry bool) error {
+	file, err := os.Open(program)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.store = NewStorage(&dapOutput{session: s})
+	if cpu != "" {
+		s.store.cpu, err = LookupCPU(cpu)
+		if err != nil {
+			return err
+		}
+	}
+	base, err := s.store.loadProgram(file, codeSegment)
+	if err != nil {
+		return err
+	}
+	s.debugger = NewDebugger(s.store)
+	s.stopOnEntry = stopOnEntry
+
+	// Without an explicit source we look for one next to the program
+	switch {
+	case strings.HasSuffix(source, ".lst"):
+		s.source, err = sourceMapFromListing(source, base)
+	case source != "":
+		s.source, err = sourceMapFromAssembly(source, s.store, base)
+	default:
+		s.source, err = sourceMapFromAssembly(program+".asm", s.store, base)
+		if err != nil {
+			s.source, err = sourceMapFromListing(program+".lst", base)
+		}
+		if err != nil {
+			s.source, err = sourceMapFromDisassembly(s.store, base), nil
+		}
+	}
+	s.store.source = s.source
+	return err
+}
+
+// The dataId is `register:<name>` or `memory:<physical address>`
+type dapDataBreakpoint struct {
+	DataID     string `json:"dataId"`
+	AccessType string `json:"accessType"`
+}
+
+func (s *dapSession) addDataBreakpoint(b dapDataBreakpoint) error {
+	kind, target, _ := strings.Cut(b.DataID, ":")
+	switch kind {
+	case "register":
+		if _, ok := registersOffsets[target]; !ok {
+			return fmt.Errorf("unknown register %s", target)
+		}
+		s.debugger.watchRegister(target)
+		return nil
+	case "memory":
+		address, err := strconv.ParseUint(target, 0, 32)
+		if err != nil {
+			return err
+		}
+		s.debugger.addWatchpoint(dapAccessTypes[b.AccessType], int(address), 2)
+		return nil
+	}
+	return fmt.Errorf("invalid data breakpoint %s", b.DataID)
+}
+
+func (s *dapSession) removeDataBreakpoint(b dapDataBreakpoint) {
+	kind, target, _ := strings.Cut(b.DataID, ":")
+	switch kind {
+	case "register":
+		s.debugger.unwatchRegister(target)
+	case "memory":
+		address, _ := strconv.ParseUint(target, 0, 32)
+		s.debugger.removeWatchpoint(dapAccessTypes[b.AccessType], int(address), 2)
+	}
+}
+
+var dapAccessTypes = map[string]int{
+	"":          watchWrite,
+	"write":     watchWrite,
+	"read":      watchRead,
+	"readWrite": watchAccess,
+}
+
+type dapSource struct {
+	Name            string `json:"name,omitempty"`
+	Path            string `json:"path,omitempty"`
+	SourceReference int    `json:"sourceReference,omitempty"`
+}
+
+// The source as described to the editor, a disassembly or the source from a
+// listing is sent by reference.
+func (s *dapSession) sourceReference() dapSource {
+	if s.source.path == "" {
+		return dapSource{Name: s.source.name, SourceReference: 1}
+	}
+	path, err := filepath.Abs(s.source.path)
+	if err != nil {
+		path = s.source.path
+	}
+	return dapSource{Name: filepath.Base(path), Path: path}
+}
+
+func (s *dapSession) isSource(source dapSource) bool {
+	if s.source.path == "" {
+		return source.SourceReference == 1
+	}
+	path, err := filepath.Abs(source.Path)
+	if err != nil {
+		path = source.Path
+	}
+	return filepath.Clean(path) == filepath.Clean(s.sourceReference().Path)
+}
+
+// Decode count instructions starting at offset instructions from address.
+// Instructions before address cannot be found reliably as their length vary,
+// they are reported as invalid.
+func (s *dapSession) disassemble(address int, offset int, count int) []map[string]any {
+	instructions := []map[string]any{}
+	bus := &memoryReader{s.store, address, false}
+	for n := offset; n < offset+count; n++ {
+		if n < 0 {
+			instructions = append(instructions, map[string]any{
+				"address":     fmt.Sprintf("0x%05x", address+n),
+				"instruction": "??",
+			})
+			continue
+		}
+
+		start := bus.address
+		if start < 0 || start >= len(s.store.memory) {
+			instructions = append(instructions, map[string]any{
+				"address":     fmt.Sprintf("0x%05x", start),
+				"instruction": "??",
+			})
+			bus.address++
+			continue
+		}
+		i, err := s.store.cpu.Decode(bus)
+		text := "??"
+		if err == nil {
+			text = i.String()
+		} else {
+			bus.address = start + 1
+		}
+		instruction := map[string]any{
+			"address":          fmt.Sprintf("0x%05x", start),
+			"instruction":      text,
+			"instructionBytes": fmt.Sprintf("% x", s.store.memory[start:bus.address]),
+		}
+		if line, ok := s.source.line(start); ok {
+			instruction["location"] = s.sourceReference()
+			instruction["line"] = line
+		}
+		instructions = append(instructions, instruction)
+	}
+	return instructions
+}
+
+// Send the trace of the execution to the editor, one line at a time.
+type dapOutput struct {
+	session *dapSession
+	line    bytes.Buffer
+}
+
+func (o *dapOutput) Write(p []byte) (int, error) {
+	o.line.Write(p)
+	if bytes.Contains(p, []byte("\n")) {
+		o.session.event("output", map[string]any{
+			"category": "stdout",
+			"output":   o.line.String(),
+		})
+		o.line.Reset()
+	}
+	return len(p), nil
+}
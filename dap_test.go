@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Run the requests in a session and return the messages sent back
+func runDAP(t *testing.T, requests ...string) []dapMessage {
+	t.Helper()
+	in := &bytes.Buffer{}
+	for n, request := range requests {
+		command, arguments, _ := strings.Cut(request, " ")
+		if arguments == "" {
+			arguments = "{}"
+		}
+		content := fmt.Sprintf(`{"seq": %d, "type": "request", "command": %q, "arguments": %s}`, n+1, command, arguments)
+		fmt.Fprintf(in, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	}
+	out := &bytes.Buffer{}
+	if err := newDapSession(in, out).serve(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []dapMessage{}
+	reader := bufio.NewReader(out)
+	for {
+		header, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return messages
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "Content-Length:")))
+		if err != nil {
+			t.Fatalf("invalid header %q", header)
+		}
+		reader.ReadString('\n')
+		content := make([]byte, length)
+		io.ReadFull(reader, content)
+		message := dapMessage{}
+		if err := json.Unmarshal(content, &message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestDAPSession(t *testing.T) {
+	messages := runDAP(t,
+		`initialize`,
+		`launch {"program": "part1/listing_0041_add_sub_cmp_jnz", "stopOnEntry": true}`,
+		`setBreakpoints {"source": {"path": "part1/listing_0041_add_sub_cmp_jnz.asm"}, "breakpoints": [{"line": 19}]}`,
+		`configurationDone`,
+		`readMemory {"memoryReference": "0x10000", "count": -5}`,
+		`disassemble {"memoryReference": "0xffffe", "instructionCount": 4}`,
+		`disconnect`,
+	)
+
+	// Events are shown as "event name", responses as "command success"
+	got := []string{}
+	bodies := map[string]string{}
+	for _, m := range messages {
+		if m.Type == "event" {
+			if m.Event != "output" {
+				got = append(got, "event "+m.Event)
+			}
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s %t", m.Command, m.Success))
+		body, _ := json.Marshal(m.Body)
+		bodies[m.Command] = string(body) + m.Message
+	}
+	expected := []string{
+		"initialize true",
+		"launch true",
+		"event initialized",
+		"setBreakpoints true",
+		"configurationDone true",
+		"event stopped",
+		"readMemory true",
+		"disassemble true",
+		"disconnect true",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("messages\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+
+	if !strings.Contains(bodies["setBreakpoints"], `"verified":true`) {
+		t.Errorf("breakpoint not verified: %s", bodies["setBreakpoints"])
+	}
+	if bodies["readMemory"] != `{"address":"0x10000","data":""}` {
+		t.Errorf("readMemory of a negative count: %s", bodies["readMemory"])
+	}
+	if strings.Count(bodies["disassemble"], `"address"`) != 4 || !strings.Contains(bodies["disassemble"], `"0x100001"`) {
+		t.Errorf("disassemble at the end of the memory: %s", bodies["disassemble"])
+	}
+}
+
+// A failed request must say so, clients do not read a missing success as
+// false.
+func TestDAPFailure(t *testing.T) {
+	content := `{"seq": 1, "type": "request", "command": "launch", "arguments": {"program": "part1/missing"}}`
+	in := strings.NewReader(fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(content), content))
+	out := &bytes.Buffer{}
+	if err := newDapSession(in, out).serve(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"command":"launch","request_seq":1,"success":false`) {
+		t.Errorf("launch of a missing program did not fail\n%s", out)
+	}
+}
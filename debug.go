@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Breakpoints and watchpoints on top of a Storage, used by the debugger
+// front ends. All addresses are physical addresses.
+type Debugger struct {
+	store       *Storage
+	breakpoints map[int]*Expression // Condition of each breakpoint, nil when there is none
+	watchpoints []watchpoint
+	hit         *watchpoint // Watchpoint triggered by the current instruction
+	conditions  []condition
+	registers   map[string]uint16 // Watched registers and their last value
+}
+
+// Stop when the expression become true
+type condition struct {
+	expression *Expression
+	last       bool
+}
+
+const (
+	watchWrite = iota
+	watchRead
+	watchAccess
+)
+
+type watchpoint struct {
+	kind    int
+	address int
+	size    int
+	hit     int // Address that triggered the watchpoint
+}
+
+const (
+	stopStep = iota
+	stopBreakpoint
+	stopWatchpoint
+	stopInterrupted
+	stopExited
+	stopError
+	stopHistoryStart // Nothing left to undo when executing backward
+	stopCondition    // A condition became true or a watched register changed
+)
+
+// Why the execution stopped
+type stopReason struct {
+	kind   int
+	watch  watchpoint // For stopWatchpoint
+	err    error      // For stopError
+	detail string     // For stopCondition
+}
+
+func NewDebugger(store *Storage) *Debugger {
+	d := newWatcher(store)
+	store.history = NewHistory()
+	return d
+}
+
+// A debugger without history, only its watchpoints and watched registers
+// are used by Storage.run through Watches.
+func newWatcher(store *Storage) *Debugger {
+	d := &Debugger{
+		store:       store,
+		breakpoints: map[int]*Expression{},
+		registers:   map[string]uint16{},
+	}
+	store.observers = append(store.observers, d)
+	return d
+}
+
+// Physical address of the next instruction
+func (d *Debugger) pc() int {
+	return physicalAddress(d.store.getRegister("cs"), d.store.getRegister("ip"))
+}
+
+// Add a breakpoint that stop only when condition is true, unless it is nil
+func (d *Debugger) addBreakpoint(address int, condition *Expression) {
+	d.breakpoints[address] = condition
+}
+
+func (d *Debugger) removeBreakpoint(address int) {
+	delete(d.breakpoints, address)
+}
+
+// Stop when the expression become true, it is checked after every instruction
+func (d *Debugger) addCondition(expression *Expression) {
+	d.conditions = append(d.conditions, condition{expression, expression.True(d.store)})
+}
+
+func (d *Debugger) removeCondition(text string) bool {
+	for i, c := range d.conditions {
+		if c.expression.text == text {
+			d.conditions = append(d.conditions[:i], d.conditions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Stop when the value of the register change
+func (d *Debugger) watchRegister(reg string) {
+	d.registers[reg] = d.readRegister(reg)
+}
+
+func (d *Debugger) unwatchRegister(reg string) {
+	delete(d.registers, reg)
+}
+
+func (d *Debugger) readRegister(reg string) uint16 {
+	if isByteRegister(reg) {
+		return uint16(d.store.internal[registersOffsets[reg]])
+	}
+	return d.store.getRegister(reg)
+}
+
+func (d *Debugger) addWatchpoint(kind int, address int, size int) {
+	d.removeWatchpoint(kind, address, size)
+	d.watchpoints = append(d.watchpoints, watchpoint{kind: kind, address: address, size: size})
+}
+
+func (d *Debugger) removeWatchpoint(kind int, address int, size int) {
+	kept := d.watchpoints[:0]
+	for _, w := range d.watchpoints {
+		if w.kind != kind || w.address != address || w.size != size {
+			kept = append(kept, w)
+		}
+	}
+	d.watchpoints = kept
+}
+
+// Execute a single instruction
+func (d *Debugger) Step() stopReason {
+	d.hit = nil
+	_, err := d.store.step()
+	switch {
+	case err == io.EOF:
+		return stopReason{kind: stopExited}
+	case err != nil:
+		return stopReason{kind: stopError, err: err}
+	}
+	reason := d.checkConditions()
+	if d.hit != nil {
+		return stopReason{kind: stopWatchpoint, watch: *d.hit}
+	}
+	return reason
+}
+
+// Check the watched registers and conditions, their last values are updated
+// even when another one already stop the execution.
+func (d *Debugger) checkConditions() stopReason {
+	reason := stopReason{kind: stopStep}
+	for reg, last := range d.registers {
+		value := d.readRegister(reg)
+		if value != last && reason.kind == stopStep {
+			reason = stopReason{kind: stopCondition, detail: fmt.Sprintf("%s changed from 0x%x to 0x%x", reg, last, value)}
+		}
+		d.registers[reg] = value
+	}
+	for i := range d.conditions {
+		c := &d.conditions[i]
+		value := c.expression.True(d.store)
+		if value && !c.last && reason.kind == stopStep {
+			reason = stopReason{kind: stopCondition, detail: c.expression.text}
+		}
+		c.last = value
+	}
+	return reason
+}
+
+// Return true if there is a breakpoint on the next instruction and its
+// condition is true
+func (d *Debugger) atBreakpoint() bool {
+	condition, ok := d.breakpoints[d.pc()]
+	return ok && (condition == nil || condition.True(d.store))
+}
+
+// Execute until a breakpoint or a watchpoint is hit, the end of the program
+// is reached or interrupted return true. The instruction at the current
+// address is always executed, even if there is a breakpoint on it.
+func (d *Debugger) Continue(interrupted func() bool) stopReason {
+	for {
+		reason := d.Step()
+		if reason.kind != stopStep {
+			return reason
+		}
+		if d.atBreakpoint() {
+			return stopReason{kind: stopBreakpoint}
+		}
+		if interrupted() {
+			return stopReason{kind: stopInterrupted}
+		}
+	}
+}
+
+// Undo the last instruction executed. Stop on write and access watchpoints
+// touched by the instruction, reads are not recorded so read watchpoints
+// never trigger backward.
+func (d *Debugger) StepBack() stopReason {
+	undone, ok := d.store.stepBack()
+	if !ok {
+		return stopReason{kind: stopHistoryStart}
+	}
+	reason := d.checkConditions()
+	for _, w := range d.watchpoints {
+		if w.kind == watchRead {
+			continue
+		}
+		for _, c := range undone {
+			if c.memory && c.address < w.address+w.size && w.address < c.address+len(c.old) {
+				w.hit = max(c.address, w.address)
+				return stopReason{kind: stopWatchpoint, watch: w}
+			}
+		}
+	}
+	return reason
+}
+
+// Same as Continue but backward, until the start of the history. Stop on
+// the instruction with a breakpoint, before it is executed.
+func (d *Debugger) ReverseContinue(interrupted func() bool) stopReason {
+	for {
+		reason := d.StepBack()
+		if reason.kind != stopStep {
+			return reason
+		}
+		if d.atBreakpoint() {
+			return stopReason{kind: stopBreakpoint}
+		}
+		if interrupted() {
+			return stopReason{kind: stopInterrupted}
+		}
+	}
+}
+
+// Describe the last instruction that wrote to address
+func (d *Debugger) lastWrite(address int) string {
+	step, pc, ok := d.store.history.lastWrite(address)
+	if !ok {
+		return fmt.Sprintf("0x%05x was not written since the start of the history", address)
+	}
+	return fmt.Sprintf("0x%05x was last written by instruction %d at 0x%05x", address, step, pc)
+}
+
+func (d *Debugger) observeRead(address int, size int) {
+	d.observe(address, size, watchRead)
+}
+
+func (d *Debugger) observeWrite(address int, size int) {
+	d.observe(address, size, watchWrite)
+}
+
+func (d *Debugger) observe(address int, size int, kind int) {
+	if d.hit != nil {
+		return
+	}
+	for _, w := range d.watchpoints {
+		if w.kind != kind && w.kind != watchAccess {
+			continue
+		}
+		if address < w.address+w.size && w.address < address+size {
+			w.hit = max(address, w.address)
+			d.hit = &w
+			return
+		}
+	}
+}
+
+// ===================
+// ===== WATCHES =====
+// ===================
+
+// Watchpoints and watched registers of the command line, they stop the
+// execution of Execute and RunBatch at the first hit. Memory ranges are
+// physical addresses in hexadecimal like "20000-2000f,b8000", registers are
+// like "ax,cl".
+type Watches struct {
+	Read      string // Stop when one of these ranges is read
+	Write     string // Stop when one of these ranges is written
+	Registers string // Stop when one of these registers change
+}
+
+// Return the function stopping Storage.run at the first hit, nil when
+// nothing is watched. The reason of the stop is written in reason.
+func (w Watches) stop(store *Storage, reason *string) (func() bool, error) {
+	if w == (Watches{}) {
+		return nil, nil
+	}
+	d := newWatcher(store)
+	for _, watch := range []struct {
+		kind   int
+		ranges string
+	}{{watchRead, w.Read}, {watchWrite, w.Write}} {
+		for _, field := range strings.Split(watch.ranges, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			first, last, err := parseMemoryRange(field)
+			if err != nil {
+				return nil, err
+			}
+			d.addWatchpoint(watch.kind, first, last-first+1)
+		}
+	}
+	for _, reg := range strings.Split(w.Registers, ",") {
+		reg = strings.ToLower(strings.TrimSpace(reg))
+		if reg == "" {
+			continue
+		}
+		if _, ok := registersOffsets[reg]; !ok {
+			return nil, fmt.Errorf("unknown register %s", reg)
+		}
+		d.watchRegister(reg)
+	}
+
+	return func() bool {
+		stop := d.checkConditions()
+		hit := d.hit
+		d.hit = nil
+		switch {
+		case hit != nil:
+			access := map[int]string{watchRead: "read of", watchWrite: "write to"}[hit.kind]
+			*reason = fmt.Sprintf("%s 0x%05x", access, hit.hit)
+		case stop.kind == stopCondition:
+			*reason = stop.detail
+		default:
+			return false
+		}
+		return true
+	}, nil
+}
+
+// Parse a range like "20000-2000f" or a single address
+func parseMemoryRange(text string) (int, int, error) {
+	firstText, lastText, isRange := strings.Cut(text, "-")
+	if !isRange {
+		lastText = firstText
+	}
+	first, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(firstText), "0x"), 16, 20)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid memory range %q, expected first-last in hexadecimal", text)
+	}
+	last, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(lastText), "0x"), 16, 20)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid memory range %q, expected first-last in hexadecimal", text)
+	}
+	return int(first), int(last), nil
+}
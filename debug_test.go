@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWatches(t *testing.T) {
+	source := "mov bx, 0x100\nmov [bx], cx\nmov ax, [bx+2]\nmov cl, 1\nmov dx, 5\n"
+	tests := []struct {
+		watches  Watches
+		reason   string
+		executed int
+	}{
+		{Watches{}, "", 5},
+		{Watches{Write: "100-101"}, "write to 0x00100", 2},
+		{Watches{Write: "101"}, "write to 0x00101", 2},
+		{Watches{Write: "102-1ff"}, "", 5},
+		{Watches{Read: "103"}, "read of 0x00103", 3},
+		{Watches{Read: "100-101"}, "", 5},
+		{Watches{Registers: "ch"}, "", 5},
+		{Watches{Registers: "cx"}, "cx changed from 0x0 to 0x1", 4},
+		{Watches{Read: "0-fffff", Registers: "bx"}, "bx changed from 0x0 to 0x100", 1},
+	}
+	for _, test := range tests {
+		code, err := Assemble(strings.NewReader(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := NewStorage(io.Discard)
+		store.load(strings.NewReader(string(code)), codeSegment, 0)
+
+		reason := ""
+		stop, err := test.watches.stop(store, &reason)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.run(context.Background(), Limits{}, stop)
+		if err != nil || reason != test.reason || store.executed != test.executed {
+			t.Errorf("%+v: stopped after %d instructions because %q (%v), expected %d and %q",
+				test.watches, store.executed, reason, err, test.executed, test.reason)
+		}
+	}
+
+	for _, invalid := range []Watches{{Read: "100-"}, {Write: "200-100"}, {Registers: "ex"}} {
+		if _, err := invalid.stop(NewStorage(io.Discard), new(string)); err == nil {
+			t.Errorf("%+v: no error", invalid)
+		}
+	}
+}
+
+// Going backward bring the PIC, the PIT and the keyboard back, going forward
+// again give the same states.
+func TestStepBackDevices(t *testing.T) {
+	source := `mov al, 0x13
+out 0x20, al
+mov al, 8
+out 0x21, al
+mov al, 1
+out 0x21, al
+mov al, 0xfc
+out 0x21, al
+mov al, 0x34
+out 0x43, al
+mov al, 10
+out 0x40, al
+mov al, 0
+out 0x40, al
+in al, 0x60
+mov al, 0x80
+out 0x61, al
+mov al, 0
+out 0x61, al
+in al, 0x60
+mov cx, 20
+loop $
+`
+	code, err := Assemble(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	store.load(strings.NewReader(string(code)), codeSegment, 0)
+	store.ports.ppi.press(0x1e, 0x9e)
+	d := NewDebugger(store)
+
+	type snapshot struct {
+		devices devicesState
+		cycles  int
+		pit     [3]pitCounter
+		phase   [2]int // Cycles and phase of the PIT
+	}
+	take := func() snapshot {
+		pit := store.ports.pit
+		return snapshot{store.ports.state(), store.cycles, pit.counters, [2]int{pit.cycles, pit.phase}}
+	}
+	forward := []snapshot{take()}
+	for d.Step().kind == stopStep {
+		forward = append(forward, take())
+	}
+	last := forward[len(forward)-1]
+	if last.devices.pic.irr != 0b11 || last.devices.keyboard != 1 {
+		t.Fatalf("irr %08b keyboard %d at the end, expected the timer and the keyboard requests and 1 key read", last.devices.pic.irr, last.devices.keyboard)
+	}
+
+	for n := len(forward) - 2; n >= 0; n-- {
+		if reason := d.StepBack(); reason.kind != stopStep {
+			t.Fatalf("step back %d: stopped with %d", n, reason.kind)
+		}
+		if state := take(); state != forward[n] {
+			t.Fatalf("step back to %d: %+v\nexpected %+v", n, state, forward[n])
+		}
+	}
+	if store.ports.ppi.portRead(0x60) != 0x1e {
+		t.Errorf("port A 0x%02x at the start, expected the first key", store.ports.ppi.portRead(0x60))
+	}
+
+	for n := 1; d.Step().kind == stopStep; n++ {
+		if state := take(); state != forward[n] {
+			t.Fatalf("step %d again: %+v\nexpected %+v", n, state, forward[n])
+		}
+	}
+}
+
+// The state of the CPU, the memory of the program and the 8087, to compare
+// before and after stepping back
+type machineState struct {
+	internal  string
+	memory    string
+	registers [8]extended
+	control   uint16
+	status    uint16
+	tag       uint16
+}
+
+func takeMachineState(store *Storage) machineState {
+	f := store.fpu
+	return machineState{string(store.internal[:]), string(store.memory[0x10000:0x10400]), f.registers, f.control, f.status, f.tag}
+}
+
+// Every instruction undone bring back the registers, the flags, the memory
+// and the 8087 as they were before it.
+func TestStepBack(t *testing.T) {
+	source := `mov bx, 0x200
+mov word [bx], 0x1234
+mov byte [bx + 1], 0x56
+add ax, 7
+sub cx, 1
+mov ss, bx
+fld1
+fldpi
+faddp st1, st0
+fstp qword [bx + 8]
+mov ds, ax
+`
+	code, err := Assemble(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	store.load(strings.NewReader(string(code)), codeSegment, 0)
+	store.setRegister("ds", codeSegment)
+	store.fpu = NewFPU()
+	d := NewDebugger(store)
+
+	forward := []machineState{takeMachineState(store)}
+	for d.Step().kind == stopStep {
+		forward = append(forward, takeMachineState(store))
+	}
+	if len(forward) != 12 {
+		t.Fatalf("%d instructions executed, expected 11", len(forward)-1)
+	}
+
+	for n := len(forward) - 2; n >= 0; n-- {
+		if reason := d.StepBack(); reason.kind != stopStep {
+			t.Fatalf("step back to %d: stopped with %d", n, reason.kind)
+		}
+		if state := takeMachineState(store); state != forward[n] {
+			t.Errorf("after stepping back to instruction %d\n%+v\nexpected\n%+v", n, state, forward[n])
+		}
+	}
+	if reason := d.StepBack(); reason.kind != stopHistoryStart {
+		t.Errorf("stepped back before the start: %d", reason.kind)
+	}
+}
+
+// Reverse continue stop at a breakpoint and at a write watchpoint, last-write
+// blame the instruction that wrote the byte.
+func TestReverseContinue(t *testing.T) {
+	// 1000:0000 mov bx, 0x200
+	// 1000:0003 mov byte [bx], 1
+	// 1000:0006 mov byte [bx + 1], 2
+	// 1000:000a mov cx, 3
+	// 1000:000d mov byte [bx], 4
+	// 1000:0010 mov dx, 5
+	code, err := Assemble(strings.NewReader("mov bx, 0x200\nmov byte [bx], 1\nmov byte [bx + 1], 2\nmov cx, 3\nmov byte [bx], 4\nmov dx, 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	store.load(strings.NewReader(string(code)), codeSegment, 0)
+	store.setRegister("ds", codeSegment)
+	d := NewDebugger(store)
+	for d.Step().kind == stopStep {
+	}
+
+	tests := []struct {
+		address  int
+		expected string
+	}{
+		{0x10200, "0x10200 was last written by instruction 5 at 0x1000d"},
+		{0x10201, "0x10201 was last written by instruction 3 at 0x10006"},
+		{0x10202, "0x10202 was not written since the start of the history"},
+	}
+	for _, test := range tests {
+		if description := d.lastWrite(test.address); description != test.expected {
+			t.Errorf("%q, expected %q", description, test.expected)
+		}
+	}
+
+	never := func() bool { return false }
+	d.addBreakpoint(0x1000a, nil)
+	d.addWatchpoint(watchWrite, 0x10201, 1)
+	steps := []struct {
+		kind int
+		pc   int
+	}{
+		{stopBreakpoint, 0x1000a},
+		{stopWatchpoint, 0x10006},
+		{stopHistoryStart, 0x10000},
+	}
+	for _, step := range steps {
+		reason := d.ReverseContinue(never)
+		if reason.kind != step.kind || d.pc() != step.pc {
+			t.Errorf("reverse continue stopped with %d at 0x%05x, expected %d at 0x%05x", reason.kind, d.pc(), step.kind, step.pc)
+		}
+	}
+	if store.getRegister("bx") != 0 || store.memory[0x10200] != 0 {
+		t.Errorf("bx 0x%04x [0x10200] %d at the start, expected 0", store.getRegister("bx"), store.memory[0x10200])
+	}
+}
+
+// The oldest half of the history is forgotten at the limit, the instructions
+// are still counted from the start of the program.
+func TestHistoryLimit(t *testing.T) {
+	h := NewHistory()
+	for n := 0; n < historyLimit+1; n++ {
+		h.begin(n, n, false, devicesState{})
+		h.record(true, n, []byte{0})
+	}
+	if len(h.steps) != historyLimit/2+1 || h.dropped != historyLimit/2 || h.count() != historyLimit+1 {
+		t.Fatalf("%d steps and %d dropped, expected %d and %d", len(h.steps), h.dropped, historyLimit/2+1, historyLimit/2)
+	}
+	if h.steps[0].change != 0 || h.steps[0].pc != historyLimit/2 || len(h.changes) != len(h.steps) {
+		t.Errorf("first step change %d pc %d with %d changes, expected 0, %d and %d", h.steps[0].change, h.steps[0].pc, len(h.changes), historyLimit/2, len(h.steps))
+	}
+
+	tests := []struct {
+		address int
+		step    int
+		ok      bool
+	}{
+		{historyLimit, historyLimit + 1, true},
+		{historyLimit / 2, historyLimit/2 + 1, true},
+		{historyLimit/2 - 1, 0, false}, // Forgotten
+	}
+	for _, test := range tests {
+		step, pc, ok := h.lastWrite(test.address)
+		if step != test.step || ok != test.ok || ok && pc != test.address {
+			t.Errorf("last write of %d: instruction %d at %d (%t), expected %d (%t)", test.address, step, pc, ok, test.step, test.ok)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -12,12 +13,14 @@ import (
 type ReaderCounter struct {
 	reader io.Reader
 	count  int
+	bytes  []byte // Everything read, the encoding of the instruction
 }
 
 func (r *ReaderCounter) Read(p []byte) (int, error) {
 	n, err := r.reader.Read(p)
 	// fmt.Printf("%08b ", p) // Great for debugging
 	r.count += n
+	r.bytes = append(r.bytes, p[:n]...)
 	return n, err
 }
 
@@ -25,15 +28,24 @@ func (r ReaderCounter) GetCount() int {
 	return r.count
 }
 
+func (r ReaderCounter) Bytes() []byte {
+	return r.bytes
+}
+
 type Instruction struct {
 	operator     string
 	operandLeft  string
 	operandRight string
 	w            byte
 	size         int
+	bytes        []byte // Encoding of the instruction, size bytes
+	operandThird string // Only for the immediate of `imul ax, [bx], 10`
 }
 
 func (i *Instruction) String() string {
+	if i.operandLeft == "" {
+		return i.operator
+	}
 	if i.operandRight == "" {
 		return fmt.Sprintf("%s %s",
 			i.operator,
@@ -41,20 +53,57 @@ func (i *Instruction) String() string {
 		)
 	}
 
-	return fmt.Sprintf("%s %s, %s",
+	if i.operandThird == "" {
+		return fmt.Sprintf("%s %s, %s",
+			i.operator,
+			i.operandLeft,
+			i.operandRight,
+		)
+	}
+
+	return fmt.Sprintf("%s %s, %s, %s",
 		i.operator,
 		i.operandLeft,
 		i.operandRight,
+		i.operandThird,
 	)
 }
 
-// Decode the next instruction in the instruction bus
-func Decode(_bus io.Reader) (Instruction, error) {
-	bus := ReaderCounter{_bus, 0}
+// Returned by Decode for instructions that the decoder does not support.
+var ErrNotImplemented = errors.New("not implemented")
+
+// Decoders panic with a decodeError when the instruction bus does not contain
+// something we can decode, Decode turn it back into an error.
+type decodeError struct {
+	err error
+}
+
+func notImplemented(format string, args ...any) decodeError {
+	return decodeError{fmt.Errorf("%w: %s", ErrNotImplemented, fmt.Sprintf(format, args...))}
+}
+
+// Decode the next instruction in the instruction bus, only the documented
+// instructions of the 8086 are supported. See CPU.Decode for the other models.
+func Decode(bus io.Reader) (Instruction, error) {
+	return decode(decoders, bus)
+}
+
+func decode(table map[byte]func([]byte, *ReaderCounter) Instruction, _bus io.Reader) (instruction Instruction, err error) {
+	bus := ReaderCounter{_bus, 0, nil}
+
+	defer func() {
+		if r := recover(); r != nil {
+			decodeErr, ok := r.(decodeError)
+			if !ok {
+				panic(r)
+			}
+			err = decodeErr.err
+		}
+	}()
 
 	buffer := make([]byte, 1)
 
-	_, err := bus.Read(buffer)
+	_, err = bus.Read(buffer)
 	if err != nil {
 		if err == io.EOF {
 			return Instruction{}, err
@@ -68,13 +117,9 @@ func Decode(_bus io.Reader) (Instruction, error) {
 	// Each operator can have multiple operation code.
 	// Some operation code can represent multiple operator.
 	opcode := buffer[0] >> 2 // Operation code
-	decoder := decoders[opcode]
+	decoder := table[opcode]
 	if decoder == nil {
-		panic(
-			fmt.Sprintf(
-				"Decoder for opcode %06b not implemented.", opcode,
-			),
-		)
+		panic(notImplemented("decoder for opcode %06b", opcode))
 	}
 
 	return decoder(buffer, &bus), nil
@@ -131,6 +176,8 @@ func decodeRegMemToFromReg(buffer []byte, bus *ReaderCounter) Instruction {
 			operand1,
 			w,
 			bus.GetCount(),
+			bus.Bytes(),
+			"",
 		}
 	}
 
@@ -140,6 +187,8 @@ func decodeRegMemToFromReg(buffer []byte, bus *ReaderCounter) Instruction {
 		operand2,
 		w,
 		bus.GetCount(),
+		bus.Bytes(),
+		"",
 	}
 }
 
@@ -176,6 +225,8 @@ func decodeImediateToRegister(buffer []byte, bus *ReaderCounter) Instruction {
 		operand2,
 		w,
 		bus.GetCount(),
+		bus.Bytes(),
+		"",
 	}
 }
 
@@ -192,7 +243,10 @@ func decodeImediateToRegMem(buffer []byte, bus *ReaderCounter) Instruction {
 
 	// Result
 	opcodeHint := buffer[0] >> 3 & 0b111
-	operator := operatorsArithmetic[opcodeHint]
+	operator, ok := operatorsArithmetic[opcodeHint]
+	if !ok {
+		panic(notImplemented("arithmetic extension %03b", opcodeHint))
+	}
 
 	operand1 := ""
 	if mod == 0b11 {
@@ -232,10 +286,17 @@ func decodeImediateToRegMem(buffer []byte, bus *ReaderCounter) Instruction {
 		operand2,
 		w,
 		bus.GetCount(),
+		bus.Bytes(),
+		"",
 	}
 }
 
 func decodeMovImediateToRegMem(buffer []byte, bus *ReaderCounter) Instruction {
+	// The opcode is 7 bits long, the other half of the table is LES and LDS
+	if buffer[0]&0b10 == 0 {
+		panic(notImplemented("opcode %08b", buffer[0]))
+	}
+
 	// Parse first byte
 	opcode := buffer[0] >> 2
 	operator, ok := operators[opcode]
@@ -249,6 +310,9 @@ func decodeMovImediateToRegMem(buffer []byte, bus *ReaderCounter) Instruction {
 
 	mod := buffer[0] >> 6 // Register / memory mode
 	rm := buffer[0] & 7   // Register operand/extension to use in EA calculation
+	if buffer[0]>>3&7 != 0 {
+		panic(notImplemented("mov extension %03b", buffer[0]>>3&7))
+	}
 
 	// Result
 	operand1 := ""
@@ -283,10 +347,18 @@ func decodeMovImediateToRegMem(buffer []byte, bus *ReaderCounter) Instruction {
 		operand2,
 		w,
 		bus.GetCount(),
+		bus.Bytes(),
+		"",
 	}
 }
 
 func decodeImediateToAccumulator(buffer []byte, bus *ReaderCounter) Instruction {
+	// The opcode is 7 bits long, the other half of the table is used by
+	// segment prefixes and unrelated instructions like DAA or PUSH ES.
+	if buffer[0]&0b10 != 0 {
+		panic(notImplemented("opcode %08b", buffer[0]))
+	}
+
 	opcode := buffer[0] >> 2 // Operation code
 	operator, ok := operators[opcode]
 	if !ok {
@@ -319,6 +391,8 @@ func decodeImediateToAccumulator(buffer []byte, bus *ReaderCounter) Instruction
 		operand2,
 		w,
 		bus.GetCount(),
+		bus.Bytes(),
+		"",
 	}
 }
 
@@ -329,39 +403,319 @@ func decodeCondJumpAndLoop(buffer []byte, bus *ReaderCounter) Instruction {
 		panic("jump operator for %05b not found")
 	}
 
+	// The displacement is relative to the next instruction, it is printed
+	// like NASM relative to the start of the jump.
 	location := getData8(bus)
 
 	return Instruction{
 		operator,
-		fmt.Sprintf("%d", location),
+		fmt.Sprintf("$%+d", int(location)+bus.GetCount()),
+		"",
+		0,
+		bus.GetCount(),
+		bus.Bytes(),
+		"",
+	}
+}
+
+// Instructions without operands that fit in their opcode
+func decodeSingleByte(buffer []byte, bus *ReaderCounter) Instruction {
+	operator, ok := operatorsSingleByte[buffer[0]]
+	if !ok {
+		panic(notImplemented("instruction %08b", buffer[0]))
+	}
+
+	return Instruction{
+		operator,
+		"",
 		"",
 		0,
 		bus.GetCount(),
+		bus.Bytes(),
+		"",
+	}
+}
+
+// INT with its vector after the opcode, INT3, INTO and IRET fit in a byte
+func decodeInterrupt(buffer []byte, bus *ReaderCounter) Instruction {
+	if buffer[0] != 0xCD {
+		return decodeSingleByte(buffer, bus)
+	}
+	vector := uint8(getData8(bus))
+	return Instruction{"int", fmt.Sprintf("%d", vector), "", 0, bus.GetCount(), bus.Bytes(), ""}
+}
+
+// IN and OUT, the port is a byte after the opcode or DX
+func decodePorts(buffer []byte, bus *ReaderCounter) Instruction {
+	opcode := buffer[0]
+	w := opcode & 1
+	accumulator := registers[w]
+	port := "dx"
+	if opcode&0b1000 == 0 {
+		port = fmt.Sprintf("%d", uint8(getData8(bus)))
+	}
+
+	if opcode&0b10 == 0 {
+		return Instruction{"in", accumulator, port, w, bus.GetCount(), bus.Bytes(), ""}
+	}
+	return Instruction{"out", port, accumulator, w, bus.GetCount(), bus.Bytes(), ""}
+}
+
+// JMP short, near and far. CALL share the opcodes but is not implemented. The
+// far jump is printed like NASM `jmp 0xf000:0xe05b` with decimal numbers.
+func decodeJump(buffer []byte, bus *ReaderCounter) Instruction {
+	switch buffer[0] {
+	case 0xEB:
+		location := getData8(bus)
+		return Instruction{"jmp", fmt.Sprintf("$%+d", int(location)+bus.GetCount()), "", 0, bus.GetCount(), bus.Bytes(), ""}
+	case 0xE9:
+		location := getData16(bus)
+		return Instruction{"jmp", fmt.Sprintf("$%+d", int(location)+bus.GetCount()), "", 1, bus.GetCount(), bus.Bytes(), ""}
+	case 0xEA:
+		offset := uint16(getData16(bus))
+		segment := uint16(getData16(bus))
+		return Instruction{"jmp", fmt.Sprintf("%d:%d", segment, offset), "", 1, bus.GetCount(), bus.Bytes(), ""}
+	}
+	panic(notImplemented("opcode %08b", buffer[0]))
+}
+
+// MOV between a segment register and a register or memory, the D bit give
+// the direction like decodeRegMemToFromReg but the operand is always a word.
+func decodeMovSegment(buffer []byte, bus *ReaderCounter) Instruction {
+	opcode := buffer[0]
+	if opcode != 0x8C && opcode != 0x8E {
+		panic(notImplemented("opcode %08b", opcode))
+	}
+
+	checkRead(bus.Read(buffer))
+	mod := buffer[0] >> 6
+	sr := buffer[0] >> 3 & 7
+	rm := buffer[0] & 7
+	if sr&0b100 != 0 {
+		panic(notImplemented("segment register %03b", sr))
+	}
+
+	segment := segmentRegisters[sr]
+	operand := ""
+	if mod == 0b11 {
+		operand = registers[rm<<1|1]
+	} else {
+		operand = strings.ReplaceAll(getMemoryCalculation(mod, rm, bus), " + 0", "")
+	}
+
+	if opcode&0b10 == 0 {
+		return Instruction{"mov", operand, segment, 1, bus.GetCount(), bus.Bytes(), ""}
+	}
+	return Instruction{"mov", segment, operand, 1, bus.GetCount(), bus.Bytes(), ""}
+}
+
+// ESC instructions, executed by the 8087. The low 3 bits of the opcode and
+// the REG field select the operation, with MOD=11 the operand is a register
+// of the 8087 stack or a part of the opcode.
+func decodeEscape(buffer []byte, bus *ReaderCounter) Instruction {
+	escape := buffer[0] & 0b111
+	checkRead(bus.Read(buffer))
+	mod := buffer[0] >> 6
+	reg := buffer[0] >> 3 & 7
+	rm := buffer[0] & 7
+
+	if mod != 0b11 {
+		operation, ok := operatorsEscapeMemory[escape<<3|reg]
+		if !ok {
+			panic(notImplemented("8087 instruction %02x /%d", 0xD8|escape, reg))
+		}
+		operand := strings.ReplaceAll(getMemoryCalculation(mod, rm, bus), " + 0", "")
+		if operation.size != "" {
+			operand = operation.size + " " + operand
+		}
+		return Instruction{operation.operator, operand, "", 1, bus.GetCount(), bus.Bytes(), ""}
+	}
+
+	opcode := uint16(0xD8|escape)<<8 | uint16(buffer[0])
+	if operator, ok := operatorsEscapeNoOperand[opcode]; ok {
+		return Instruction{operator, "", "", 1, bus.GetCount(), bus.Bytes(), ""}
+	}
+	operation, ok := operatorsEscapeRegister[escape<<3|reg]
+	if !ok {
+		panic(notImplemented("8087 instruction %04x", opcode))
+	}
+	register := fmt.Sprintf("st%d", rm)
+	switch operation.size {
+	case "st0, st":
+		return Instruction{operation.operator, "st0", register, 1, bus.GetCount(), bus.Bytes(), ""}
+	case "st, st0":
+		return Instruction{operation.operator, register, "st0", 1, bus.GetCount(), bus.Bytes(), ""}
+	}
+	return Instruction{operation.operator, register, "", 1, bus.GetCount(), bus.Bytes(), ""}
+}
+
+// The 8086 does not check the second bit of the conditional jumps opcode,
+// 0x60 to 0x6F are the same jumps as 0x70 to 0x7F.
+func decodeJumpAlias(buffer []byte, bus *ReaderCounter) Instruction {
+	buffer[0] |= 0x10
+	return decodeCondJumpAndLoop(buffer, bus)
+}
+
+// The 8086 pop into CS with 0x0F, later CPUs use this opcode for something
+// else.
+func decodePopCS(buffer []byte, bus *ReaderCounter) Instruction {
+	if buffer[0] != 0x0F {
+		panic(notImplemented("opcode %08b", buffer[0]))
+	}
+	return Instruction{
+		"pop",
+		"cs",
+		"",
+		1,
+		bus.GetCount(),
+		bus.Bytes(),
+		"",
+	}
+}
+
+func decodeInvalidPopCS(buffer []byte, bus *ReaderCounter) Instruction {
+	if buffer[0] == 0x0F {
+		panic(decodeError{fmt.Errorf("invalid opcode %02x", buffer[0])})
+	}
+	panic(notImplemented("opcode %08b", buffer[0]))
+}
+
+// The V20 use 0x0F as the prefix of its own instructions, like TEST1 or ROL4
+func decodeNECExtension(buffer []byte, bus *ReaderCounter) Instruction {
+	if buffer[0] == 0x0F {
+		checkRead(bus.Read(buffer))
+		panic(notImplemented("NEC instruction 0f %02x", buffer[0]))
+	}
+	panic(notImplemented("opcode %08b", buffer[0]))
+}
+
+// PUSHA POPA and BOUND of the 80186
+func decodePushaPopaBound(buffer []byte, bus *ReaderCounter) Instruction {
+	switch buffer[0] {
+	case 0x60:
+		return Instruction{"pusha", "", "", 1, bus.GetCount(), bus.Bytes(), ""}
+	case 0x61:
+		return Instruction{"popa", "", "", 1, bus.GetCount(), bus.Bytes(), ""}
+	case 0x62:
+		// Like a word register to memory, the memory hold the two bounds
+		buffer[0] = 0b10001011
+		i := decodeRegMemToFromReg(buffer, bus)
+		if !strings.HasPrefix(i.operandRight, "[") {
+			panic(decodeError{fmt.Errorf("invalid bound with a register %s", i.operandRight)})
+		}
+		i.operator = "bound"
+		return i
+	}
+	panic(notImplemented("opcode %08b", buffer[0]))
+}
+
+// PUSH and IMUL with an immediate of the 80186. IMUL has 3 operands, the
+// immediate is the third one: `imul ax, [bx], 10`.
+func decodePushImmediateAndImul(buffer []byte, bus *ReaderCounter) Instruction {
+	s := buffer[0] >> 1 & 1
+	if buffer[0]&1 == 0 {
+		// PUSH
+		data := int(getData16Or8(s, bus))
+		return Instruction{"push", fmt.Sprintf("%d", data), "", 1, bus.GetCount(), bus.Bytes(), ""}
+	}
+
+	buffer[0] = 0b10001011
+	i := decodeRegMemToFromReg(buffer, bus)
+	i.operator = "imul"
+	i.operandThird = fmt.Sprintf("%d", getData16Or8(s, bus))
+	i.size, i.bytes = bus.GetCount(), bus.Bytes()
+	return i
+}
+
+// INS and OUTS of the 80186, the string is in ES:DI or DS:SI and the port in DX
+func decodeStringPorts(buffer []byte, bus *ReaderCounter) Instruction {
+	operators := []string{"insb", "insw", "outsb", "outsw"}
+	return Instruction{operators[buffer[0]&0b11], "", "", buffer[0] & 1, bus.GetCount(), bus.Bytes(), ""}
+}
+
+// Shifts and rotations by an immediate of the 80186
+func decodeShiftImmediate(buffer []byte, bus *ReaderCounter) Instruction {
+	if buffer[0]&0b10 != 0 {
+		panic(notImplemented("opcode %08b", buffer[0]))
+	}
+	w := buffer[0] & 1
+
+	checkRead(bus.Read(buffer))
+	mod := buffer[0] >> 6
+	rm := buffer[0] & 7
+	operator := operatorsShift[buffer[0]>>3&0b111]
+
+	operand1 := ""
+	if mod == 0b11 {
+		operand1 = registers[rm<<1|w]
+	} else {
+		operand1 = getMemoryCalculation(mod, rm, bus)
+		if w == 0 {
+			operand1 = "byte " + operand1
+		} else {
+			operand1 = "word " + operand1
+		}
+	}
+
+	return Instruction{
+		operator,
+		operand1,
+		fmt.Sprintf("%d", uint8(getData8(bus))),
+		w,
+		bus.GetCount(),
+		bus.Bytes(),
+		"",
+	}
+}
+
+// ENTER and LEAVE of the 80186
+func decodeEnterLeave(buffer []byte, bus *ReaderCounter) Instruction {
+	switch buffer[0] {
+	case 0xC8:
+		size := uint16(getData16(bus))
+		level := uint8(getData8(bus))
+		return Instruction{"enter", fmt.Sprintf("%d", size), fmt.Sprintf("%d", level), 1, bus.GetCount(), bus.Bytes(), ""}
+	case 0xC9:
+		return Instruction{"leave", "", "", 1, bus.GetCount(), bus.Bytes(), ""}
 	}
+	panic(notImplemented("opcode %08b", buffer[0]))
 }
 
 // =================
 // ===== UTILS =====
 // =================
 
+// Reaching the end of the bus in the middle of an instruction mean the
+// instruction is truncated.
 func checkRead(_ int, err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		panic(err)
+		panic(decodeError{err})
 	}
 }
 
 func getData8(bus *ReaderCounter) int8 {
 	buffer := make([]byte, 1)
-	checkRead(bus.Read(buffer))
+	checkRead(io.ReadFull(bus, buffer))
 	return int8(buffer[0])
 }
 
 func getData16(bus *ReaderCounter) int16 {
 	buffer := make([]byte, 2)
-	checkRead(bus.Read(buffer))
+	checkRead(io.ReadFull(bus, buffer))
 	return int16(buffer[1])<<8 | int16(buffer[0])
 }
 
+// A sign extended byte when s is set, otherwise a word
+func getData16Or8(s byte, bus *ReaderCounter) int16 {
+	if s == 1 {
+		return int16(getData8(bus))
+	}
+	return getData16(bus)
+}
+
 func getMemoryCalculation(mod byte, rm byte, bus *ReaderCounter) string {
 	switch mod {
 	case 0b00: // Memory Mode, no displacement
@@ -424,6 +778,53 @@ var decoders = map[byte]func([]byte, *ReaderCounter) Instruction{
 	0b011110: decodeCondJumpAndLoop,       // CONDITIONAL JUMPS
 	0b011111: decodeCondJumpAndLoop,       // CONDITIONAL JUMPS
 	0b111000: decodeCondJumpAndLoop,       // LOOP
+	0b111101: decodeSingleByte,            // HLT CMC
+	0b111110: decodeSingleByte,            // CLC STC CLI STI
+	0b100110: decodeSingleByte,            // FWAIT
+	0b110011: decodeInterrupt,             // INT INT3 INTO IRET
+	0b111001: decodePorts,                 // IN OUT
+	0b111011: decodePorts,                 // IN OUT
+	0b111010: decodeJump,                  // JMP
+	0b100011: decodeMovSegment,            // MOV
+	0b110110: decodeEscape,                // 8087
+	0b110111: decodeEscape,                // 8087
+}
+
+// The 8086 and the 8088 also decode some opcodes that Intel did not
+// document.
+var decoders8086 = withDecoders(decoders, map[byte]func([]byte, *ReaderCounter) Instruction{
+	0b000011: decodePopCS,     // POP CS
+	0b011000: decodeJumpAlias, // CONDITIONAL JUMPS
+	0b011001: decodeJumpAlias, // CONDITIONAL JUMPS
+	0b011010: decodeJumpAlias, // CONDITIONAL JUMPS
+	0b011011: decodeJumpAlias, // CONDITIONAL JUMPS
+})
+
+// Reference 80186 instruction set, the new instructions replace the
+// undocumented ones of the 8086.
+var decoders80186 = withDecoders(decoders, map[byte]func([]byte, *ReaderCounter) Instruction{
+	0b000011: decodeInvalidPopCS,         // POP CS is an invalid opcode
+	0b011000: decodePushaPopaBound,       // PUSHA POPA BOUND
+	0b011010: decodePushImmediateAndImul, // PUSH IMUL
+	0b011011: decodeStringPorts,          // INS OUTS
+	0b110000: decodeShiftImmediate,       // ROL ROR RCL RCR SHL SHR SAR
+	0b110010: decodeEnterLeave,           // ENTER LEAVE
+})
+
+// The V20 has the instructions of the 80186 and its own behind 0x0F
+var decodersV20 = withDecoders(decoders80186, map[byte]func([]byte, *ReaderCounter) Instruction{
+	0b000011: decodeNECExtension,
+})
+
+func withDecoders(base map[byte]func([]byte, *ReaderCounter) Instruction, extra map[byte]func([]byte, *ReaderCounter) Instruction) map[byte]func([]byte, *ReaderCounter) Instruction {
+	table := map[byte]func([]byte, *ReaderCounter) Instruction{}
+	for opcode, decoder := range base {
+		table[opcode] = decoder
+	}
+	for opcode, decoder := range extra {
+		table[opcode] = decoder
+	}
+	return table
 }
 
 var operators = map[byte]string{
@@ -439,7 +840,6 @@ var operators = map[byte]string{
 	0b001011: "sub",
 	0b001110: "cmp",
 	0b001111: "cmp",
-	0b011101: "jne",
 }
 
 // The key is the last 5 bits of the first byte
@@ -466,6 +866,164 @@ var operatorsJumps = map[byte]string{
 	0b00011: "jcxz",
 }
 
+// The key is the whole first byte
+var operatorsSingleByte = map[byte]string{
+	0b11110100: "hlt",
+	0b11110101: "cmc",
+	0b11111000: "clc",
+	0b11111001: "stc",
+	0b11111010: "cli",
+	0b11111011: "sti",
+	0b10011011: "fwait",
+	0b11001100: "int3",
+	0b11001110: "into",
+	0b11001111: "iret",
+}
+
+type escapeOperation struct {
+	operator string
+	size     string // Of the memory, or the form of the registers operands
+}
+
+// Reference 8087 instruction encoding, the key is the low 3 bits of the
+// opcode followed by the REG field. Instructions starting with fn do not wait
+// for the 8087, the assembler put a FWAIT before the fn-less version.
+var operatorsEscapeMemory = map[byte]escapeOperation{
+	0o00: {"fadd", "dword"},
+	0o01: {"fmul", "dword"},
+	0o02: {"fcom", "dword"},
+	0o03: {"fcomp", "dword"},
+	0o04: {"fsub", "dword"},
+	0o05: {"fsubr", "dword"},
+	0o06: {"fdiv", "dword"},
+	0o07: {"fdivr", "dword"},
+	0o10: {"fld", "dword"},
+	0o12: {"fst", "dword"},
+	0o13: {"fstp", "dword"},
+	0o14: {"fldenv", ""},
+	0o15: {"fldcw", "word"},
+	0o16: {"fnstenv", ""},
+	0o17: {"fnstcw", "word"},
+	0o20: {"fiadd", "dword"},
+	0o21: {"fimul", "dword"},
+	0o22: {"ficom", "dword"},
+	0o23: {"ficomp", "dword"},
+	0o24: {"fisub", "dword"},
+	0o25: {"fisubr", "dword"},
+	0o26: {"fidiv", "dword"},
+	0o27: {"fidivr", "dword"},
+	0o30: {"fild", "dword"},
+	0o32: {"fist", "dword"},
+	0o33: {"fistp", "dword"},
+	0o35: {"fld", "tword"},
+	0o37: {"fstp", "tword"},
+	0o40: {"fadd", "qword"},
+	0o41: {"fmul", "qword"},
+	0o42: {"fcom", "qword"},
+	0o43: {"fcomp", "qword"},
+	0o44: {"fsub", "qword"},
+	0o45: {"fsubr", "qword"},
+	0o46: {"fdiv", "qword"},
+	0o47: {"fdivr", "qword"},
+	0o50: {"fld", "qword"},
+	0o52: {"fst", "qword"},
+	0o53: {"fstp", "qword"},
+	0o54: {"frstor", ""},
+	0o56: {"fnsave", ""},
+	0o57: {"fnstsw", "word"},
+	0o60: {"fiadd", "word"},
+	0o61: {"fimul", "word"},
+	0o62: {"ficom", "word"},
+	0o63: {"ficomp", "word"},
+	0o64: {"fisub", "word"},
+	0o65: {"fisubr", "word"},
+	0o66: {"fidiv", "word"},
+	0o67: {"fidivr", "word"},
+	0o70: {"fild", "word"},
+	0o72: {"fist", "word"},
+	0o73: {"fistp", "word"},
+	0o74: {"fbld", "tword"},
+	0o75: {"fild", "qword"},
+	0o76: {"fbstp", "tword"},
+	0o77: {"fistp", "qword"},
+}
+
+// Same key as operatorsEscapeMemory for MOD=11, the size is the form of the
+// operands.
+var operatorsEscapeRegister = map[byte]escapeOperation{
+	0o00: {"fadd", "st0, st"},
+	0o01: {"fmul", "st0, st"},
+	0o02: {"fcom", "st"},
+	0o03: {"fcomp", "st"},
+	0o04: {"fsub", "st0, st"},
+	0o05: {"fsubr", "st0, st"},
+	0o06: {"fdiv", "st0, st"},
+	0o07: {"fdivr", "st0, st"},
+	0o10: {"fld", "st"},
+	0o11: {"fxch", "st"},
+	0o40: {"fadd", "st, st0"},
+	0o41: {"fmul", "st, st0"},
+	0o44: {"fsubr", "st, st0"},
+	0o45: {"fsub", "st, st0"},
+	0o46: {"fdivr", "st, st0"},
+	0o47: {"fdiv", "st, st0"},
+	0o50: {"ffree", "st"},
+	0o52: {"fst", "st"},
+	0o53: {"fstp", "st"},
+	0o60: {"faddp", "st, st0"},
+	0o61: {"fmulp", "st, st0"},
+	0o64: {"fsubrp", "st, st0"},
+	0o65: {"fsubp", "st, st0"},
+	0o66: {"fdivrp", "st, st0"},
+	0o67: {"fdivp", "st, st0"},
+}
+
+// The key is the opcode followed by the second byte
+var operatorsEscapeNoOperand = map[uint16]string{
+	0xD9D0: "fnop",
+	0xD9E0: "fchs",
+	0xD9E1: "fabs",
+	0xD9E4: "ftst",
+	0xD9E5: "fxam",
+	0xD9E8: "fld1",
+	0xD9E9: "fldl2t",
+	0xD9EA: "fldl2e",
+	0xD9EB: "fldpi",
+	0xD9EC: "fldlg2",
+	0xD9ED: "fldln2",
+	0xD9EE: "fldz",
+	0xD9F0: "f2xm1",
+	0xD9F1: "fyl2x",
+	0xD9F2: "fptan",
+	0xD9F3: "fpatan",
+	0xD9F4: "fxtract",
+	0xD9F6: "fdecstp",
+	0xD9F7: "fincstp",
+	0xD9F8: "fprem",
+	0xD9F9: "fyl2xp1",
+	0xD9FA: "fsqrt",
+	0xD9FC: "frndint",
+	0xD9FD: "fscale",
+	0xDBE0: "fneni",
+	0xDBE1: "fndisi",
+	0xDBE2: "fnclex",
+	0xDBE3: "fninit",
+	0xDED9: "fcompp",
+}
+
+// The key is the REG field of the second byte, 110 is an undocumented alias
+// of SHL.
+var operatorsShift = map[byte]string{
+	0b000: "rol",
+	0b001: "ror",
+	0b010: "rcl",
+	0b011: "rcr",
+	0b100: "shl",
+	0b101: "shr",
+	0b110: "shl",
+	0b111: "sar",
+}
+
 var operatorsArithmetic = map[byte]string{
 	0b000: "add",
 	0b101: "sub",
@@ -493,6 +1051,15 @@ var registers = map[byte]string{
 	0b1111: "di",
 }
 
+// Reference table 4-11 Segment Register Encoding, the SR field is 2 bits
+// long
+var segmentRegisters = map[byte]string{
+	0b00: "es",
+	0b01: "cs",
+	0b10: "ss",
+	0b11: "ds",
+}
+
 // Reference table 4-10 Register/Memory Field Encoding
 // First 2 bits are MOD, tree next are RM
 // MOD cannot be 11 as it mean a register encoding, not memory
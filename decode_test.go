@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Decode random instructions, assemble them back and check that we get the
+// same bytes. Failing inputs are minimized by `go test -fuzz` and saved under
+// testdata/fuzz where they become regression cases for `go test`.
+//
+//	go test -fuzz FuzzDecodeRoundTrip
+func FuzzDecodeRoundTrip(f *testing.F) {
+	listings, err := filepath.Glob("part1/listing_*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, listing := range listings {
+		if filepath.Ext(listing) != "" {
+			continue
+		}
+		code, err := os.ReadFile(listing)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(code)
+	}
+
+	f.Fuzz(func(t *testing.T, code []byte) {
+		bus := bytes.NewReader(code)
+		for {
+			offset := len(code) - bus.Len()
+			i, err := Decode(bus)
+			if err == io.EOF ||
+				errors.Is(err, io.ErrUnexpectedEOF) ||
+				errors.Is(err, ErrNotImplemented) {
+				return
+			}
+			if err != nil {
+				t.Fatalf("decoding % x: %s", code[offset:], err)
+			}
+
+			original := code[offset : offset+i.size]
+			if !bytes.Equal(i.bytes, original) {
+				t.Fatalf("% x decoded as %q keep the bytes % x", original, &i, i.bytes)
+			}
+			assembled, err := Assemble(strings.NewReader(i.String()))
+			if err != nil {
+				t.Fatalf("% x decoded as %q cannot be assembled: %s", original, &i, err)
+			}
+
+			expected := canonicalEncoding(original)
+			if !bytes.Equal(assembled, expected) {
+				t.Fatalf(
+					"% x decoded as %q assembled to % x, expected % x",
+					original, &i, assembled, expected,
+				)
+			}
+		}
+	})
+}
+
+// The 8086 often has more than one encoding for the same instruction and the
+// assembler always pick the one NASM pick. This rewrite an instruction into
+// that encoding, only the following alternate encodings are rewritten:
+//
+//   - Register to register operations with the D bit set, the REG and R/M
+//     fields are swapped (decodeRegMemToFromReg).
+//   - Displacements that are longer than needed: a 16 bits displacement that
+//     fit in 8 bits, or a zero displacement.
+//   - Immediates to register/memory that are longer than needed: 0x82 is the
+//     same as 0x80 and a 16 bits immediate that fit in a sign extended byte
+//     use 0x83 (decodeImediateToRegMem).
+//   - Immediates to AL/AX using the register/memory form instead of the
+//     shorter accumulator form, or AX with an immediate that fit in a sign
+//     extended byte using the accumulator form (decodeImediateToAccumulator).
+//   - Mov of an immediate to a register using the register/memory form
+//     instead of the shorter register form (decodeImediateToRegister).
+//   - 8087 operations with ST0 as both operands in the 0xDC form, NASM use
+//     the 0xD8 form where the REG field of FSUB/FSUBR and FDIV/FDIVR are
+//     swapped (decodeEscape).
+//   - Near jumps whose displacement fit in the short form, which is 1 byte
+//     shorter (decodeJump).
+func canonicalEncoding(code []byte) []byte {
+	decoder := decoders[code[0]>>2]
+	w := code[0] & 1
+
+	switch {
+	case sameFunction(decoder, decodeRegMemToFromReg):
+		mod, reg, rm := code[1]>>6, code[1]>>3&0b111, code[1]&0b111
+		if mod == 0b11 && code[0]&0b10 != 0 {
+			return []byte{code[0] &^ 0b10, mod<<6 | rm<<3 | reg}
+		}
+		modRM, _ := canonicalModRM(code[1:])
+		return append([]byte{code[0]}, modRM...)
+
+	case sameFunction(decoder, decodeImediateToRegMem):
+		s := code[0] >> 1 & 1
+		modRM, data := canonicalModRM(code[1:])
+		value := int(int8(data[0]))
+		if s == 0 && w == 1 {
+			value = int(int16(uint16(data[1])<<8 | uint16(data[0])))
+		}
+
+		operator := operatorsArithmetic[code[1]>>3&0b111]
+		acc := asmEncodings[operator].imediateToAcc
+		isAcc := code[1]>>6 == 0b11 && code[1]&0b111 == 0
+		switch {
+		case w == 1 && fitSigned8(value):
+			return append([]byte{0x83}, append(modRM, byte(value))...)
+		case isAcc && acc >= 0:
+			return append([]byte{byte(acc)<<2 | w}, immediate(value, w)...)
+		}
+		return append([]byte{0x80 | w}, append(modRM, immediate(value, w)...)...)
+
+	case sameFunction(decoder, decodeImediateToAccumulator):
+		value := int(int16(uint16(code[len(code)-1])<<8 | uint16(code[1])))
+		if w == 1 && fitSigned8(value) {
+			operator := operators[code[0]>>2]
+			modRM := 0b11<<6 | byte(asmEncodings[operator].arithmetic)<<3
+			return []byte{0x83, modRM, byte(value)}
+		}
+
+	case sameFunction(decoder, decodeMovImediateToRegMem):
+		modRM, data := canonicalModRM(code[1:])
+		if code[1]>>6 == 0b11 {
+			return append([]byte{0xB0 | w<<3 | code[1]&0b111}, data...)
+		}
+		return append([]byte{code[0]}, append(modRM, data...)...)
+
+	case sameFunction(decoder, decodeJump):
+		if code[0] == 0xE9 {
+			displacement := int(int16(uint16(code[2])<<8|uint16(code[1]))) + 1
+			if displacement >= -128 && displacement <= 127 {
+				return []byte{0xEB, byte(displacement)}
+			}
+		}
+
+	case sameFunction(decoder, decodeMovSegment):
+		modRM, _ := canonicalModRM(code[1:])
+		return append([]byte{code[0]}, modRM...)
+
+	case sameFunction(decoder, decodeEscape):
+		modRM, _ := canonicalModRM(code[1:])
+		reg := code[1] >> 3 & 0b111
+		if code[0] == 0xDC && code[1] == 0b11<<6|reg<<3 {
+			if reg >= 4 {
+				reg ^= 1
+			}
+			return []byte{0xD8, 0b11<<6 | reg<<3}
+		}
+		return append([]byte{code[0]}, modRM...)
+	}
+
+	return code
+}
+
+// Return the ModR/M byte with the shortest displacement and the rest of the
+// instruction.
+func canonicalModRM(code []byte) ([]byte, []byte) {
+	mod, rm := code[0]>>6, code[0]&0b111
+	modRM := code[0] & 0b00111111
+
+	displacement := 0
+	rest := code[1:]
+	switch {
+	case mod == 0b11, mod == 0b00 && rm != 0b110:
+		return code[:1], rest
+	case mod == 0b00: // Direct address
+		return code[:3], code[3:]
+	case mod == 0b01:
+		displacement = int(int8(code[1]))
+		rest = code[2:]
+	case mod == 0b10:
+		displacement = int(int16(uint16(code[2])<<8 | uint16(code[1])))
+		rest = code[3:]
+	}
+
+	switch {
+	case displacement == 0 && rm != 0b110:
+		return []byte{modRM}, rest
+	case fitSigned8(displacement):
+		return []byte{0b01<<6 | modRM, byte(displacement)}, rest
+	}
+	return []byte{0b10<<6 | modRM, byte(displacement), byte(displacement >> 8)}, rest
+}
+
+// The opcodes that the models decode differently
+func TestDecodeModels(t *testing.T) {
+	tests := []struct {
+		cpu      string
+		code     []byte
+		expected string // Instruction or error
+	}{
+		{"8086", []byte{0x0f}, "pop cs"},
+		{"8088", []byte{0x0f}, "pop cs"},
+		{"80186", []byte{0x0f}, "invalid opcode 0f"},
+		{"80188", []byte{0x0f}, "invalid opcode 0f"},
+		{"v20", []byte{0x0f, 0x28}, "not implemented: NEC instruction 0f 28"},
+		{"8086", []byte{0x6b, 0xc3, 0x0a}, "jpo $-59"},
+		{"80186", []byte{0x6b, 0xc3, 0x0a}, "imul ax, bx, 10"},
+		{"v20", []byte{0x69, 0x07, 0x2c, 0x01}, "imul ax, [bx], 300"},
+		{"80186", []byte{0xc1, 0xe0, 0x03}, "shl ax, 3"},
+		{"8086", []byte{0x60, 0x00}, "jo $+2"},
+		{"80186", []byte{0x60}, "pusha"},
+	}
+	for _, test := range tests {
+		i, err := cpus[test.cpu].Decode(bytes.NewReader(test.code))
+		decoded := i.String()
+		if err != nil {
+			decoded = err.Error()
+		}
+		if decoded != test.expected {
+			t.Errorf("%s: % x decoded as %q, expected %q", test.cpu, test.code, decoded, test.expected)
+		}
+	}
+}
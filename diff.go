@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Compare two executions in lockstep: after each instruction the registers,
+// the flags and the memory written by either side must be the same. The
+// instructions themselves can differ, a rewrite of a routine is expected to
+// give the same state with different code.
+type DiffOptions struct {
+	Ignore          []string // Registers and flags (like ip or CF) not compared
+	MaxInstructions int      // Zero means no limit
+}
+
+// One of the two executions of a diff
+type diffSide struct {
+	name    string
+	store   *Storage
+	trace   bytes.Buffer // Trace of the last instruction
+	written []int        // Addresses written by the last instruction
+	done    bool         // The program reached its end
+	err     error
+}
+
+// Load a program for a diff. config set the processor model and the initial
+// value of registers, like "cpu=8088,ax=1,ds=0x2000".
+func newDiffSide(name string, path string, config string) (*diffSide, error) {
+	side := &diffSide{name: name}
+	side.store = NewStorage(&side.trace)
+	side.store.observers = append(side.store.observers, side)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, err = side.store.loadProgram(file, codeSegment)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, setting := range strings.Split(config, ",") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(setting, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if ok && key == "cpu" {
+			side.store.cpu, err = LookupCPU(strings.TrimSpace(value))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !ok || !isRegisterName(key) {
+			return nil, fmt.Errorf("invalid setting %q, expected cpu=model or register=value", setting)
+		}
+		number, err := parseNumber(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting %q: %w", setting, err)
+		}
+		side.store.setRegister(key, uint16(number))
+	}
+	return side, nil
+}
+
+func isRegisterName(name string) bool {
+	for _, reg := range registerNames {
+		if reg == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (side *diffSide) observeRead(address int, size int) {}
+
+func (side *diffSide) observeWrite(address int, size int) {
+	for i := 0; i < size; i++ {
+		side.written = append(side.written, (address+i)&0xFFFFF)
+	}
+}
+
+// Execute one instruction, nothing happen once the program ended
+func (side *diffSide) step() {
+	side.trace.Reset()
+	side.written = side.written[:0]
+	if side.done || side.err != nil {
+		return
+	}
+	_, err := side.store.step()
+	if err == io.EOF {
+		side.done = true
+	} else if err != nil {
+		side.err = err
+	}
+}
+
+// Return true when the two executions diverged. The first divergence is
+// printed to out.
+func DiffExecutions(a *diffSide, b *diffSide, options DiffOptions, out io.Writer) bool {
+	ignored := map[string]bool{}
+	for _, name := range options.Ignore {
+		ignored[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	for count := 1; options.MaxInstructions == 0 || count <= options.MaxInstructions; count++ {
+		csA, ipA := a.store.getRegister("cs"), a.store.getRegister("ip")
+		csB, ipB := b.store.getRegister("cs"), b.store.getRegister("ip")
+		a.step()
+		b.step()
+		if a.done && b.done {
+			fmt.Fprintf(out, "No divergence, both programs ended after %d instructions\n", count-1)
+			return false
+		}
+
+		differences := []string{}
+		for _, side := range []*diffSide{a, b} {
+			switch {
+			case side.err != nil:
+				differences = append(differences, fmt.Sprintf("%s failed: %s", side.name, side.err))
+			case side.done:
+				differences = append(differences, fmt.Sprintf("%s ended", side.name))
+			}
+		}
+		if len(differences) == 0 {
+			differences = diffState(a, b, ignored)
+		}
+		if len(differences) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(out, "Diverged at instruction %d\n", count)
+		fmt.Fprintf(out, "%s: %04x:%04x %s\n", a.name, csA, ipA, strings.TrimSuffix(a.trace.String(), "\n"))
+		fmt.Fprintf(out, "%s: %04x:%04x %s\n", b.name, csB, ipB, strings.TrimSuffix(b.trace.String(), "\n"))
+		for _, difference := range differences {
+			fmt.Fprintf(out, "    %s\n", difference)
+		}
+		return true
+	}
+	fmt.Fprintf(out, "No divergence in the first %d instructions\n", options.MaxInstructions)
+	return false
+}
+
+// Describe the differences of registers, flags and written memory
+func diffState(a *diffSide, b *diffSide, ignored map[string]bool) []string {
+	differences := []string{}
+	for _, reg := range registerNames {
+		valueA, valueB := a.store.getRegister(reg), b.store.getRegister(reg)
+		if reg == "fl" || ignored[reg] || valueA == valueB {
+			continue
+		}
+		differences = append(differences, fmt.Sprintf("%-2s %s=0x%04x %s=0x%04x", reg, a.name, valueA, b.name, valueB))
+	}
+	for _, flag := range flagNames {
+		valueA, valueB := a.store.getFlag(flag.mask), b.store.getFlag(flag.mask)
+		if ignored["fl"] || ignored[strings.ToLower(flag.name)] || valueA == valueB {
+			continue
+		}
+		differences = append(differences, fmt.Sprintf("%s %s=%d %s=%d", flag.name, a.name, boolToInt(valueA), b.name, boolToInt(valueB)))
+	}
+
+	addresses := append(append([]int{}, a.written...), b.written...)
+	sort.Ints(addresses)
+	for i, address := range addresses {
+		if i > 0 && addresses[i-1] == address {
+			continue
+		}
+		valueA, valueB := a.store.memory[address], b.store.memory[address]
+		if valueA != valueB {
+			differences = append(differences, fmt.Sprintf("[0x%05x] %s=0x%02x %s=0x%02x", address, a.name, valueA, b.name, valueB))
+		}
+	}
+	return differences
+}
+
+// Compare an execution to a golden trace, the output of a previous run like
+// the files in result/. Only the EXECUTION section is compared, line by line.
+// Return true when the execution diverged, the first divergence is printed to
+// out.
+func DiffGolden(side *diffSide, golden io.Reader, options DiffOptions, out io.Writer) (bool, error) {
+	scanner := bufio.NewScanner(golden)
+	number := 0
+	expected := func() (string, bool) {
+		for scanner.Scan() {
+			number++
+			line := strings.TrimRight(scanner.Text(), " ")
+			if strings.Contains(line, "─ EXECUTION ─") {
+				continue
+			}
+			// The final state follow the execution
+			return line, line != ""
+		}
+		return "", false
+	}
+
+	for count := 1; options.MaxInstructions == 0 || count <= options.MaxInstructions; count++ {
+		cs, ip := side.store.getRegister("cs"), side.store.getRegister("ip")
+		side.step()
+		line, more := expected()
+		if err := scanner.Err(); err != nil {
+			return false, err
+		}
+		actual := strings.TrimRight(strings.TrimSuffix(side.trace.String(), "\n"), " ")
+		if side.done && !more {
+			fmt.Fprintf(out, "No divergence, the program ended after %d instructions like the golden trace\n", count-1)
+			return false, nil
+		}
+		if side.err == nil && !side.done && more && actual == line {
+			continue
+		}
+
+		fmt.Fprintf(out, "Diverged at instruction %d\n", count)
+		switch {
+		case side.err != nil:
+			fmt.Fprintf(out, "%s: %04x:%04x failed: %s\n", side.name, cs, ip, side.err)
+		case side.done:
+			fmt.Fprintf(out, "%s: ended\n", side.name)
+		default:
+			fmt.Fprintf(out, "%s: %04x:%04x %s\n", side.name, cs, ip, actual)
+		}
+		if more {
+			fmt.Fprintf(out, "golden line %d: %s\n", number, line)
+		} else {
+			fmt.Fprintf(out, "golden: ended\n")
+		}
+		return true, nil
+	}
+	fmt.Fprintf(out, "No divergence in the first %d instructions\n", options.MaxInstructions)
+	return false, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffExecutions(t *testing.T) {
+	dir := writeBatchPrograms(t, map[string]string{
+		"one":       "mov ax, 1\nmov bx, 2\n",
+		"two":       "mov ax, 2\nmov bx, 2\n",
+		"short":     "mov ax, 1\n",
+		"write-one": "mov bx, 0x100\nmov byte [bx], 1\n",
+		"write-two": "mov bx, 0x100\nmov byte [bx], 2\n",
+		"carry":     "mov ax, 1\nstc\n",
+		"loop":      "jmp $\n",
+	})
+	tests := []struct {
+		a, b     string
+		config   string // Of a
+		options  DiffOptions
+		diverged bool
+		output   string
+	}{
+		{"one", "one", "", DiffOptions{}, false, "No divergence, both programs ended after 2 instructions\n"},
+		{"one", "two", "", DiffOptions{}, true, "Diverged at instruction 1\na: 1000:0000 mov ax, 1    [IP 0x0300] [ax 0x0000->0x0100] \nb: 1000:0000 mov ax, 2    [IP 0x0300] [ax 0x0000->0x0200] \n    ax a=0x0001 b=0x0002\n"},
+		{"one", "two", "", DiffOptions{Ignore: []string{"AX"}}, false, "No divergence, both programs ended after 2 instructions\n"},
+		{"one", "short", "", DiffOptions{}, true, "    b ended\n"},
+		{"write-one", "write-two", "", DiffOptions{}, true, "    [0x00100] a=0x01 b=0x02\n"},
+		{"one", "carry", "", DiffOptions{Ignore: []string{"bx", "ip"}}, true, "    CF a=0 b=1\n"},
+		{"one", "carry", "", DiffOptions{Ignore: []string{"bx", "ip", "fl"}}, false, "No divergence"},
+		{"one", "one", "cpu=8088, cx=7", DiffOptions{}, true, "    cx a=0x0007 b=0x0000\n"},
+		{"loop", "loop", "", DiffOptions{MaxInstructions: 10}, false, "No divergence in the first 10 instructions\n"},
+	}
+	for _, test := range tests {
+		a, err := newDiffSide("a", filepath.Join(dir, test.a), test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := newDiffSide("b", filepath.Join(dir, test.b), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &strings.Builder{}
+		diverged := DiffExecutions(a, b, test.options, out)
+		if diverged != test.diverged || !strings.Contains(out.String(), test.output) {
+			t.Errorf("%s %s %+v diverged %t:\n%s\nexpected %t with\n%s", test.a, test.b, test.options, diverged, out, test.diverged, test.output)
+		}
+	}
+
+	for _, config := range []string{"cpu=z80", "zz=1", "ax", "ax=one"} {
+		if _, err := newDiffSide("a", filepath.Join(dir, "one"), config); err == nil {
+			t.Errorf("the invalid setting %q is accepted", config)
+		}
+	}
+}
+
+// The traces of result/ are still what the simulator print, a change of the
+// format of the trace break them.
+func TestDiffGolden(t *testing.T) {
+	golden, err := os.ReadFile("result/0054")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(golden), "\n")
+	changed := append([]string{}, lines...)
+	changed[100] = strings.Replace(changed[100], "[IP", "[ip", 1)
+
+	tests := []struct {
+		golden   string
+		diverged bool
+		output   string
+	}{
+		{string(golden), false, "No divergence, the program ended after 28930 instructions like the golden trace\n"},
+		{strings.Join(changed, "\n"), true, "Diverged at instruction 100\n"},
+		{strings.Join(lines[:51], "\n"), true, "Diverged at instruction 51\n"},
+	}
+	for _, test := range tests {
+		side, err := newDiffSide("listing", "part1/listing_0054_draw_rectangle", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &strings.Builder{}
+		diverged, err := DiffGolden(side, strings.NewReader(test.golden), DiffOptions{}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diverged != test.diverged || !strings.HasPrefix(out.String(), test.output) {
+			t.Errorf("diverged %t:\n%s\nexpected %t with\n%s", diverged, out, test.diverged, test.output)
+		}
+	}
+}
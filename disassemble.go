@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Recursive descent disassembler. Unlike the linear decoding of -decode, it
+// start at the entry of the program and follow the jumps, so the data in the
+// middle of the code is not decoded as instructions. The bytes that are never
+// reached are data.
+//
+// The instructions are cut in basic blocks: a block start at the entry, at
+// the target of a jump or after a jump, and end with a jump. Only the direct
+// jumps are followed, where an interrupt handler is cannot be known.
+
+type Disassembly struct {
+	cpu          *CPU
+	cs           uint16
+	start        int                 // Physical address of the first byte of the program
+	end          int                 // Physical address after its last byte
+	code         []byte              // Bytes from start to end
+	instructions map[int]Instruction // Physical address to the instruction there
+	leaders      map[int]bool        // Addresses where a block start
+	blocks       []*basicBlock
+}
+
+type basicBlock struct {
+	start     int
+	addresses []int // Of the instructions of the block
+	edges     []flowEdge
+}
+
+type flowEdge struct {
+	to   int
+	kind string // "taken", "not taken" or empty when the flow just continue
+}
+
+// How an instruction change the flow, the instructions not in the table
+// continue with the next one. HLT continue after the interrupt that wake the
+// CPU up.
+var flowKinds = map[string]string{
+	"jmp":  "jump",
+	"iret": "return",
+}
+
+func isConditionalJump(operator string) bool {
+	for _, jump := range operatorsJumps {
+		if operator == jump {
+			return true
+		}
+	}
+	return false
+}
+
+// Disassemble the code of the store from start to the end of the program,
+// following the flow from the entries.
+func disassemble(store *Storage, start int, entries ...int) *Disassembly {
+	d := &Disassembly{
+		cpu:          store.cpu,
+		cs:           store.getRegister("cs"),
+		start:        start,
+		end:          store.codeEnd,
+		code:         bytes.Clone(store.memory[start:store.codeEnd]),
+		instructions: map[int]Instruction{},
+		leaders:      map[int]bool{},
+	}
+
+	todo := []int{}
+	for _, entry := range entries {
+		d.leaders[entry] = true
+		todo = append(todo, entry)
+	}
+	for len(todo) > 0 {
+		address := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if _, done := d.instructions[address]; done || address < d.start || address >= d.end {
+			continue
+		}
+
+		i, err := store.cpu.Decode(&memoryReader{store, address, false})
+		if err != nil {
+			if errors.Is(err, ErrNotImplemented) || errors.Is(err, io.ErrUnexpectedEOF) || err == io.EOF {
+				// The flow go into something that is not code, the bytes stay data
+				continue
+			}
+			panic(err)
+		}
+		d.instructions[address] = i
+
+		edges := d.successors(address, i)
+		for _, edge := range edges {
+			if edge.kind != "" {
+				d.leaders[edge.to] = true
+			}
+			todo = append(todo, edge.to)
+		}
+		if len(edges) != 1 || edges[0].kind != "" {
+			// The instruction after a jump start a block even when no jump go there
+			d.leaders[address+i.size] = true
+		}
+	}
+
+	d.buildBlocks()
+	return d
+}
+
+// Where the flow can go after the instruction at address
+func (d *Disassembly) successors(address int, i Instruction) []flowEdge {
+	next := address + i.size
+	switch {
+	case isConditionalJump(i.operator):
+		return []flowEdge{{d.jumpTarget(address, i), "taken"}, {next, "not taken"}}
+	case flowKinds[i.operator] == "jump":
+		return []flowEdge{{d.jumpTarget(address, i), "taken"}}
+	case flowKinds[i.operator] == "return":
+		return nil
+	}
+	return []flowEdge{{next, ""}}
+}
+
+// The offset of a jump is relative to the next instruction and wrap around in
+// the code segment, a far jump give its address.
+func (d *Disassembly) jumpTarget(address int, i Instruction) int {
+	if cs, ip, ok := farJumpTarget(i); ok {
+		return physicalAddress(cs, ip)
+	}
+	offset, err := jumpOffset(i)
+	if err != nil {
+		panic(fmt.Sprintf("%s only support immediate value, %s", i.operator, err))
+	}
+	ip := uint16(address+i.size-int(d.cs)<<4) + uint16(offset)
+	return physicalAddress(d.cs, ip)
+}
+
+func (d *Disassembly) buildBlocks() {
+	addresses := make([]int, 0, len(d.instructions))
+	for address := range d.instructions {
+		addresses = append(addresses, address)
+	}
+	sort.Ints(addresses)
+
+	var block *basicBlock
+	for _, address := range addresses {
+		if block == nil || d.leaders[address] {
+			block = &basicBlock{start: address}
+			d.blocks = append(d.blocks, block)
+		}
+		block.addresses = append(block.addresses, address)
+
+		i := d.instructions[address]
+		edges := d.successors(address, i)
+		_, decoded := d.instructions[address+i.size]
+		if len(edges) == 1 && edges[0].kind == "" && decoded && !d.leaders[address+i.size] {
+			continue
+		}
+		for _, edge := range edges {
+			if _, ok := d.instructions[edge.to]; ok {
+				block.edges = append(block.edges, edge)
+			}
+		}
+		block = nil
+	}
+}
+
+// Print the program in the order of the addresses, a blank line between the
+// blocks and the bytes that are not code as `db`. With listing each line
+// start with the offset and the bytes, like printListingLine.
+func (d *Disassembly) Print(out io.Writer, listing bool) {
+	for address := d.start; address < d.end; {
+		i, ok := d.instructions[address]
+		if !ok {
+			data := Instruction{"db", fmt.Sprintf("0x%02x", d.code[address-d.start]), "", 0, 1, d.code[address-d.start : address-d.start+1], ""}
+			if listing {
+				printListingLine(out, nil, d.cs, address, &data)
+			} else {
+				fmt.Fprintf(out, "%s\n", &data)
+			}
+			address++
+			continue
+		}
+		if d.leaders[address] && address != d.start {
+			fmt.Fprint(out, "\n")
+		}
+		if listing {
+			printListingLine(out, d.cpu, d.cs, address, &i)
+		} else {
+			fmt.Fprintf(out, "%s\n", &i)
+		}
+		address += i.size
+	}
+}
+
+// One line of a listing, like objdump: the offset in the code segment, the
+// bytes of the instruction, the instruction and its estimated cycles. Jumps
+// show their cycles when taken and when not taken, the cycles are not shown
+// without a cpu or when they are not known.
+//
+//	0009  89 4e 00              mov [bp], cx              ; 14
+//	001c  75 eb                 jne $-19                  ; 16/4
+func printListingLine(out io.Writer, cpu *CPU, cs uint16, address int, i *Instruction) {
+	line := fmt.Sprintf("%04x  %-21s %-25s", (address-int(cs)<<4)&0xFFFF, fmt.Sprintf("% x", i.bytes), i)
+	if cpu != nil {
+		taken, notTaken := cpu.estimateCycles(*i, true), cpu.estimateCycles(*i, false)
+		switch {
+		case taken != notTaken:
+			line += fmt.Sprintf(" ; %d/%d", taken, notTaken)
+		case taken != 0:
+			line += fmt.Sprintf(" ; %d", taken)
+		}
+	}
+	fmt.Fprintf(out, "%s\n", strings.TrimRight(line, " "))
+}
+
+// Write the control flow graph in the DOT language of Graphviz, one box per
+// basic block with its instructions.
+func (d *Disassembly) WriteDOT(out io.Writer) {
+	fmt.Fprint(out, "digraph cfg {\n")
+	fmt.Fprint(out, "\tnode [shape=box fontname=\"monospace\"];\n")
+	for _, block := range d.blocks {
+		label := ""
+		for _, address := range block.addresses {
+			i := d.instructions[address]
+			label += fmt.Sprintf("%04x: %s\\l", (address-int(d.cs)<<4)&0xFFFF, &i)
+		}
+		fmt.Fprintf(out, "\t\"%05x\" [label=\"%s\"];\n", block.start, label)
+	}
+	for _, block := range d.blocks {
+		for _, edge := range block.edges {
+			if edge.kind == "" {
+				fmt.Fprintf(out, "\t\"%05x\" -> \"%05x\";\n", block.start, edge.to)
+			} else {
+				fmt.Fprintf(out, "\t\"%05x\" -> \"%05x\" [label=\"%s\"];\n", block.start, edge.to, edge.kind)
+			}
+		}
+	}
+	fmt.Fprint(out, "}\n")
+}
+
+func (d *Disassembly) SaveDOT(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	d.WriteDOT(file)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A loop, a jump over two bytes of data and a HLT
+func disassemblyProgram(t *testing.T) []byte {
+	code, err := Assemble(strings.NewReader("mov cx, 3\nsub cx, 1\njne 3\njmp 12\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(code, 0xFF, 0xFF, 0xF4)
+}
+
+func TestDisassemble(t *testing.T) {
+	store := NewStorage(io.Discard)
+	store.load(bytes.NewReader(disassemblyProgram(t)), codeSegment, 0)
+	d := disassemble(store, 0x10000, 0x10000)
+
+	tests := []struct {
+		name     string
+		write    func(io.Writer)
+		expected string
+	}{
+		{
+			"print",
+			func(out io.Writer) { d.Print(out, false) },
+			"mov cx, 3\n\nsub cx, 1\njne $-3\n\njmp $+4\ndb 0xff\ndb 0xff\n\nhlt\n",
+		},
+		{
+			"listing",
+			func(out io.Writer) { d.Print(out, true) },
+			`0000  b9 03 00              mov cx, 3                 ; 4
+
+0003  83 e9 01              sub cx, 1                 ; 4
+0006  75 fb                 jne $-3                   ; 16/4
+
+0008  eb 02                 jmp $+4                   ; 15
+000a  ff                    db 0xff
+000b  ff                    db 0xff
+
+000c  f4                    hlt                       ; 2
+`,
+		},
+		{
+			"dot",
+			d.WriteDOT,
+			`digraph cfg {
+	node [shape=box fontname="monospace"];
+	"10000" [label="0000: mov cx, 3\l"];
+	"10003" [label="0003: sub cx, 1\l0006: jne $-3\l"];
+	"10008" [label="0008: jmp $+4\l"];
+	"1000c" [label="000c: hlt\l"];
+	"10000" -> "10003";
+	"10003" -> "10003" [label="taken"];
+	"10003" -> "10008" [label="not taken"];
+	"10008" -> "1000c" [label="taken"];
+}
+`,
+		},
+	}
+	for _, test := range tests {
+		out := &strings.Builder{}
+		test.write(out)
+		if out.String() != test.expected {
+			t.Errorf("%s:\n%s\nexpected:\n%s", test.name, out, test.expected)
+		}
+	}
+}
+
+// -recursive print the disassembly instead of the linear decoding, -cfg
+// save the graph and still execute the program
+func TestDisassembleOptions(t *testing.T) {
+	program := disassemblyProgram(t)
+	out := &bytes.Buffer{}
+	err := Execute(bytes.NewReader(program), ExecuteOptions{DecodeOnly: true, Recursive: true, Output: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "jmp $+4\ndb 0xff\ndb 0xff\n\nhlt\n") {
+		t.Errorf("data decoded as code\n%s", out)
+	}
+
+	cfg := filepath.Join(t.TempDir(), "cfg.dot")
+	out.Reset()
+	err = Execute(bytes.NewReader(program), ExecuteOptions{CFG: cfg, MaxInstructions: 100, Output: out})
+	if err != nil && err != ErrInstructionLimit {
+		t.Fatal(err)
+	}
+	dot, err := os.ReadFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(dot), "digraph cfg {\n") || !strings.Contains(string(dot), `"10003" -> "10003" [label="taken"];`) {
+		t.Errorf("control flow graph:\n%s", dot)
+	}
+	if !strings.Contains(out.String(), "EXECUTION") {
+		t.Errorf("the program is not executed with -cfg\n%s", out)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The text mode of the color display adapter (CGA) of the PC, mapped in
+// memory at B8000. Each character of the 80x25 screen take two bytes: the
+// code of the character then its attribute (colors and blinking). The
+// adapter has 16K of memory but only the first page is modeled, the
+// switches of the PPI already tell the BIOS that the display is in 80
+// columns.
+type TextDisplay struct {
+	cells [textColumns * textRows * 2]byte
+}
+
+const (
+	textColumns   = 80
+	textRows      = 25
+	textDisplayAt = 0xB8000
+)
+
+func NewTextDisplay() *TextDisplay {
+	return &TextDisplay{}
+}
+
+// Map the display on the memory of the store
+func (d *TextDisplay) mapOn(m *MemoryMap) error {
+	return m.mapIO("CGA text", textDisplayAt, textDisplayAt+len(d.cells)-1, d.read, d.write)
+}
+
+func (d *TextDisplay) read(address int) byte {
+	return d.cells[address-textDisplayAt]
+}
+
+func (d *TextDisplay) write(address int, value byte) {
+	d.cells[address-textDisplayAt] = value
+}
+
+// Print the characters of the screen without the attributes, the rows after
+// the last one written are left out. Only the printable ASCII characters
+// are shown, the others are dots.
+func (d *TextDisplay) Print(out io.Writer) {
+	rows := []string{}
+	for row := 0; row < textRows; row++ {
+		line := make([]byte, textColumns)
+		for column := range line {
+			c := d.cells[(row*textColumns+column)*2]
+			switch {
+			case c == 0:
+				line[column] = ' '
+			case c < 0x20 || c > 0x7E:
+				line[column] = '.'
+			default:
+				line[column] = c
+			}
+		}
+		rows = append(rows, strings.TrimRight(string(line), " "))
+	}
+	for len(rows) > 0 && rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	}
+	for _, row := range rows {
+		fmt.Fprintln(out, row)
+	}
+}
+
+// Whether a character was written, an empty screen is not printed
+func (d *TextDisplay) written() bool {
+	for n := 0; n < len(d.cells); n += 2 {
+		if d.cells[n] != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -1,66 +1,315 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math/bits"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func Execute(bus io.ReadSeeker, decodeOnly bool, printHex bool, dumpMemory bool) {
-	store := Storage{bus, [20]byte{}, [64 * 1024]byte{}}
-	if !decodeOnly {
-		fmt.Print("────────────────────────── EXECUTION ───────────────────────────\n")
+// Programs are loaded in their own segment so that data written by the
+// program at DS:0000 never overwrite its code. For an executable it is the
+// segment of the PSP and the image start 256 bytes after.
+const codeSegment = 0x1000
+
+type ExecuteOptions struct {
+	DecodeOnly bool   // Only decode the instructions, do not execute them
+	Recursive  bool   // Decode by following the jumps from the entry instead of byte after byte
+	CFG        string // Optional, save the control flow graph in Graphviz DOT there
+	PrintHex   bool   // Print the final state of registers in hexadecimal
+	DumpMemory bool   // Dump the data segment into `memory.data` at the end
+	Profile    bool   // Print the instructions that cost the most cycles
+	Memory     bool   // Print the memory accesses and working set
+	Heatmap    string // Optional, save a heatmap of memory accesses there
+	GDB        string // Optional, address where a GDB stub wait for a debugger
+	Listing    string // Optional, NASM listing of the program to show its source in the trace
+	BreakWhen  string // Optional, stop the execution when this expression become true
+	CPU        string // Optional, model of the processor, 8086 by default
+	BIU        bool   // Model the prefetch queue and the bus of the CPU
+	WaitStates int    // Wait states of the memory for the BIU model
+	FPU        bool   // Add an 8087 to execute the ESC instructions
+	Keys       []byte // Scan codes sent by the keyboard, one after the other
+	Origin     string // Optional, load the program as raw bytes at this segment:offset
+	Entry      string // Optional, segment:offset where the execution start instead of the entry of the program
+	BIOS       bool   // The program is a ROM at the top of the memory, started at FFFF:0000
+	MemoryMap  string // Optional, regions of the memory like "rom:f0000-fffff,unmapped:a0000-bffff"
+	Display    bool   // Map the text memory of a CGA at B8000, the screen is printed at the end
+
+	TrapCodeWrites    bool // Stop when the program write to its own code
+	TrapUninitialized bool // Stop when the program read memory never written
+	WarnUndefined     bool // Warn when the program use registers, memory or flags never written
+
+	DecodeListing bool // With DecodeOnly, show the offset, the bytes and the cycles of each instruction
+
+	Watches Watches // Stop when a watched memory range is accessed or a watched register change
+
+	Devices []PortDevice // Added to the ports of the PC, they must not overlap them
+
+	MaxInstructions int           // Optional, stop after this many instructions
+	MaxCycles       int           // Optional, stop after this many estimated cycles
+	Timeout         time.Duration // Optional, stop after this long
+	DetectLoops     bool          // Stop when the program is stuck in an infinite loop
+
+	Output io.Writer // Where the trace and the final state are printed, default to stdout
+}
+
+func Execute(program io.Reader, options ExecuteOptions) error {
+	return ExecuteContext(context.Background(), program, options)
+}
+
+// Same as Execute but the execution stop when ctx is done. When the execution
+// is stopped early, by a limit or because of an error, the final state is
+// still printed and the reason is returned.
+func ExecuteContext(ctx context.Context, program io.Reader, options ExecuteOptions) error {
+	out := options.Output
+	if out == nil {
+		out = os.Stdout
 	}
-	for {
-		i, err := Decode(store.bus)
-		if err != nil {
-			if err == io.EOF {
-				break
+	store := NewStorage(out)
+	if options.WarnUndefined {
+		// Before the loader, the registers it set are defined
+		store.undefined = NewUndefinedUses()
+	}
+	var base int
+	var err error
+	switch {
+	case options.BIOS:
+		base, err = store.loadBIOS(program)
+	case options.Origin != "":
+		base, err = store.loadAtOrigin(program, options.Origin)
+	default:
+		base, err = store.loadProgram(program, codeSegment)
+	}
+	if err == nil && options.Entry != "" {
+		err = store.setEntry(options.Entry)
+	}
+	if err != nil {
+		// A program that cannot be loaded is not a bug of the simulator
+		fmt.Fprintf(out, "Cannot load the program: %s\n", err)
+		return err
+	}
+	breakWhen, err := store.configure(options, base)
+	if err != nil {
+		// Wrong options are not a bug of the simulator either
+		fmt.Fprintf(out, "Invalid options: %s\n", err)
+		return err
+	}
+	memoryStats := NewMemoryStats()
+	if options.Memory || options.Heatmap != "" {
+		store.observers = append(store.observers, memoryStats)
+	}
+
+	if options.Recursive || options.CFG != "" {
+		cs, ip := store.getRegister("cs"), store.getRegister("ip")
+		disassembly := disassemble(store, base, physicalAddress(cs, ip))
+		if options.CFG != "" {
+			err := disassembly.SaveDOT(options.CFG)
+			if err != nil {
+				fmt.Fprintf(out, "Cannot save the control flow graph: %s\n", err)
+				return err
 			}
-			panic(err)
 		}
-
-		if decodeOnly {
-			fmt.Printf("%s\n", &i)
-			continue
+		if options.DecodeOnly && options.Recursive {
+			disassembly.Print(out, options.DecodeListing)
+			return nil
 		}
+	}
 
-		fmt.Printf("%- 12s ", &i)
-		store.incrementIP(uint16(i.size))
+	if options.DecodeOnly {
+		bus := store.codeReader()
+		for {
+			address := bus.address
+			i, err := store.cpu.Decode(bus)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				fmt.Fprintf(out, "Cannot decode at 0x%05x: %s\n", address, err)
+				return err
+			}
+			if options.DecodeListing {
+				printListingLine(out, store.cpu, store.getRegister("cs"), address, &i)
+			} else {
+				fmt.Fprintf(out, "%s\n", &i)
+			}
+		}
+		return nil
+	}
 
-		execute := executors[i.operator]
-		if execute == nil {
-			panic(
-				fmt.Sprintf("Operation %s in not implemented", i.operator),
-			)
+	fmt.Fprint(out, "────────────────────────── EXECUTION ───────────────────────────\n")
+	if options.GDB != "" {
+		err = ServeGDB(store, options.GDB)
+		if err != nil {
+			fmt.Fprintf(out, "\nGDB stub stopped: %s\n", err)
+		}
+	} else {
+		if options.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+			defer cancel()
 		}
+		limits := Limits{
+			MaxInstructions: options.MaxInstructions,
+			MaxCycles:       options.MaxCycles,
+			DetectLoops:     options.DetectLoops,
+		}
+		watchHit := ""
+		var watched func() bool
+		watched, err = options.Watches.stop(store, &watchHit)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid options: %s\n", err)
+			return err
+		}
+		stop := func() bool {
+			reason := ""
+			switch {
+			case watched != nil && watched():
+				reason = watchHit
+			case breakWhen != nil && breakWhen.True(store):
+				reason = breakWhen.String()
+			default:
+				return false
+			}
+			fmt.Fprintf(out, "\nStopped at %04x:%04x because %s\n", store.getRegister("cs"), store.getRegister("ip"), reason)
+			return true
+		}
+		err = store.run(ctx, limits, stop)
+		if err != nil {
+			fmt.Fprintf(out, "\nStopped at %04x:%04x: %s\n", store.getRegister("cs"), store.getRegister("ip"), err)
+		}
+		if store.exited {
+			fmt.Fprintf(out, "\nExited with code %d\n", store.exitCode)
+		}
+	}
 
-		execute(&store, i)
+	fmt.Fprint(out, "\n───────────────────────── FINAL STATE ──────────────────────────\n")
+	if options.PrintHex {
+		store.PrintRegistersHex(out)
+	} else {
+		store.PrintRegistersBinary(out)
+	}
 
-		fmt.Print("\n")
+	if store.fpu != nil {
+		fmt.Fprint(out, "\n───────────────────────────── 8087 ─────────────────────────────\n")
+		store.fpu.Print(out)
 	}
 
-	if decodeOnly {
-		return
+	if len(store.ports.debug.output) > 0 {
+		fmt.Fprint(out, "\n────────────────────────── DEBUG PORT ──────────────────────────\n")
+		store.ports.debug.Print(out)
 	}
 
-	fmt.Print("\n───────────────────────── FINAL STATE ──────────────────────────\n")
-	if printHex {
-		store.PrintRegistersHex()
-	} else {
-		store.PrintRegistersBinary()
+	if store.display != nil && store.display.written() {
+		fmt.Fprint(out, "\n──────────────────────────── SCREEN ────────────────────────────\n")
+		store.display.Print(out)
 	}
 
-	if dumpMemory {
-		err := os.WriteFile("memory.data", store.memory[:], 0644)
-		if err != nil {
-			panic(err)
+	if len(store.ports.post.codes) > 0 {
+		fmt.Fprint(out, "\n────────────────────────── POST CODES ──────────────────────────\n")
+		store.ports.post.Print(out)
+	}
+
+	if store.undefined != nil && len(store.undefined.warnings) > 0 {
+		fmt.Fprint(out, "\n─────────────────────── UNDEFINED VALUES ───────────────────────\n")
+		store.undefined.Print(out)
+	}
+
+	if store.profile != nil {
+		fmt.Fprint(out, "\n─────────────────────────── PROFILE ────────────────────────────\n")
+		store.profile.Print(out, 20)
+	}
+
+	if store.biu != nil {
+		fmt.Fprint(out, "\n──────────────────────────── TIMING ────────────────────────────\n")
+		store.biu.Print(out, store.cycles)
+	}
+
+	if options.Memory {
+		fmt.Fprint(out, "\n──────────────────────────── MEMORY ────────────────────────────\n")
+		memoryStats.Print(out, 10)
+	}
+
+	if options.Heatmap != "" {
+		if err := memoryStats.SaveHeatmap(options.Heatmap); err != nil {
+			fmt.Fprintf(out, "\nCannot save the heatmap: %s\n", err)
+			return err
+		}
+	}
+
+	if options.DumpMemory {
+		// Dump the data segment
+		start := physicalAddress(store.getRegister("ds"), 0)
+		if err := os.WriteFile("memory.data", store.readMemory(start, 64*1024), 0644); err != nil {
+			fmt.Fprintf(out, "\nCannot dump the memory: %s\n", err)
+			return err
 		}
 	}
 
+	return err
+}
+
+// Set up the store for the options, the devices and the models. Return the
+// expression of -break-when, nil when there is none.
+func (store *Storage) configure(options ExecuteOptions, base int) (breakWhen *Expression, err error) {
+	err = parseMemoryMap(store.memoryMap, options.MemoryMap)
+	if err != nil {
+		return nil, err
+	}
+	if options.Display {
+		store.display = NewTextDisplay()
+		err = store.display.mapOn(store.memoryMap)
+		if err != nil {
+			return nil, err
+		}
+	}
+	store.memoryMap.TrapCodeWrites = options.TrapCodeWrites
+	store.memoryMap.TrapUninitialized = options.TrapUninitialized
+	if options.Profile {
+		store.profile = NewProfile()
+	}
+	if options.Listing != "" {
+		store.source, err = sourceMapFromListing(options.Listing, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.BreakWhen != "" {
+		breakWhen, err = CompileExpression(options.BreakWhen)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.CPU != "" {
+		store.cpu, err = LookupCPU(options.CPU)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.BIU {
+		store.biu, err = NewBIU(store.cpu, options.WaitStates)
+		if err != nil {
+			return nil, err
+		}
+		store.observers = append(store.observers, store.biu)
+	}
+	if options.FPU {
+		store.fpu = NewFPU()
+		store.ports.ppi.switches |= 0b10
+	}
+	store.ports.ppi.press(options.Keys...)
+	for _, d := range options.Devices {
+		err = store.ports.register(d.First, d.Last, d.Device)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return breakWhen, nil
 }
 
 // ========================
@@ -134,22 +383,66 @@ func cmp(store *Storage, i Instruction) {
 	store.setSignFlag(valueBytes[size-1]>>7 == 1)
 }
 
+// Return the displacement of a relative jump from the next instruction, the
+// operand is like $-4 which is relative to the start of the jump.
+func jumpOffset(i Instruction) (int64, error) {
+	if !strings.HasPrefix(i.operandLeft, "$") {
+		return 0, fmt.Errorf("%s is not relative to $", i.operandLeft)
+	}
+	offset, err := strconv.ParseInt(i.operandLeft[1:], 10, 32)
+	return offset - int64(i.size), err
+}
+
+// Return the segment and the offset of a far jump like 61440:57435
+func farJumpTarget(i Instruction) (uint16, uint16, bool) {
+	segment, offset, found := strings.Cut(i.operandLeft, ":")
+	if !found {
+		return 0, 0, false
+	}
+	cs, err := strconv.ParseUint(segment, 10, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	ip, err := strconv.ParseUint(offset, 10, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint16(cs), uint16(ip), true
+}
+
 func jmp(store *Storage, i Instruction) {
-	offset, err := strconv.ParseInt(i.operandLeft, 10, 16)
+	if cs, ip, ok := farJumpTarget(i); ok {
+		jump := fmt.Sprintf("%04x:%04x", cs, ip)
+		if store.source != nil {
+			if label, ok := store.source.label(physicalAddress(cs, ip)); ok {
+				jump = label
+			}
+		}
+		fmt.Fprintf(store.trace, "[jump %s] ", jump)
+		store.write("ip", binary.LittleEndian.AppendUint16(nil, ip))
+		store.write("cs", binary.LittleEndian.AppendUint16(nil, cs))
+		store.jumped = true
+		return
+	}
+
+	offset, err := jumpOffset(i)
 	if err != nil {
 		panic(
 			fmt.Sprintf("JMP only support immediate value, %s", err),
 		)
 	}
 
-	fmt.Printf("[jump %d] ", offset)
-
-	store.incrementIP(uint16(offset))
-	_, err = store.bus.Seek(offset, 1)
-	if err != nil {
-		panic(err)
+	jump := fmt.Sprint(offset)
+	if store.source != nil {
+		target := physicalAddress(store.getRegister("cs"), store.getRegister("ip")+uint16(offset))
+		if label, ok := store.source.label(target); ok {
+			jump = label
+		}
 	}
+	fmt.Fprintf(store.trace, "[jump %s] ", jump)
 
+	store.incrementIP(uint16(offset))
+	store.jumped = true
 }
 
 // Jump if equal
@@ -180,14 +473,338 @@ func jns(store *Storage, i Instruction) {
 	}
 }
 
+// Stop the CPU until the next interrupt
+func hlt(store *Storage, i Instruction) {
+	fmt.Fprint(store.trace, "[halted] ")
+	store.halted = true
+}
+
+// Clear interrupt flag
+func cli(store *Storage, i Instruction) {
+	store.printFlag("IF", interruptFlag, false)
+}
+
+// Clear carry flag
+func clc(store *Storage, i Instruction) {
+	store.printFlag("CF", carryFlag, false)
+}
+
+// Set carry flag
+func stc(store *Storage, i Instruction) {
+	store.printFlag("CF", carryFlag, true)
+}
+
+// Complement carry flag
+func cmc(store *Storage, i Instruction) {
+	store.printFlag("CF", carryFlag, !store.getFlag(carryFlag))
+}
+
+// Push a word on the stack
+func push(store *Storage, i Instruction) {
+	store.push(store.readAsInt(i.operandLeft, 2))
+}
+
+// Pop a word from the stack
+func pop(store *Storage, i Instruction) {
+	store.write(i.operandLeft, binary.LittleEndian.AppendUint16(nil, store.pop()))
+}
+
+// Push the general registers, SP is pushed as it was before
+func pusha(store *Storage, i Instruction) {
+	sp := store.getRegister("sp")
+	for _, reg := range []string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"} {
+		if reg == "sp" {
+			store.push(sp)
+		} else {
+			store.push(store.getRegister(reg))
+		}
+	}
+}
+
+// Pop the general registers pushed by PUSHA, the saved SP is skipped
+func popa(store *Storage, i Instruction) {
+	for _, reg := range []string{"di", "si", "bp", "sp", "bx", "dx", "cx", "ax"} {
+		value := store.pop()
+		if reg != "sp" {
+			store.write(reg, binary.LittleEndian.AppendUint16(nil, value))
+		}
+	}
+}
+
+// Create the stack frame of a procedure, with the frame pointers of the
+// enclosing procedures when the nesting level is not 0.
+func enter(store *Storage, i Instruction) {
+	size, err1 := strconv.ParseUint(i.operandLeft, 10, 16)
+	level, err2 := strconv.ParseUint(i.operandRight, 10, 8)
+	if err1 != nil || err2 != nil {
+		panic(fmt.Sprintf("ENTER only support immediate values, %s", &i))
+	}
+	level &= 31
+
+	store.push(store.getRegister("bp"))
+	frame := store.getRegister("sp")
+	if level > 0 {
+		bp := store.getRegister("bp")
+		for l := uint64(1); l < level; l++ {
+			bp -= 2
+			pointer := store.readMemoryAt(physicalAddress(store.getRegister("ss"), bp), 2)
+			store.push(binary.LittleEndian.Uint16(pointer))
+		}
+		store.push(frame)
+	}
+	store.write("bp", binary.LittleEndian.AppendUint16(nil, frame))
+	store.write("sp", binary.LittleEndian.AppendUint16(nil, frame-uint16(size)))
+}
+
+// Destroy the stack frame created by ENTER
+func leave(store *Storage, i Instruction) {
+	store.write("sp", store.read("bp", 2))
+	store.write("bp", binary.LittleEndian.AppendUint16(nil, store.pop()))
+}
+
+// Signed multiplication, only the 80186 form with an immediate is supported:
+// the right operand is the source and the third one the immediate.
+func imul(store *Storage, i Instruction) {
+	factor, err := strconv.Atoi(i.operandThird)
+	if err != nil {
+		panic(fmt.Sprintf("IMUL only support an immediate factor, %s", &i))
+	}
+
+	result := int32(int16(store.readAsInt(i.operandRight, 2))) * int32(factor)
+	store.write(i.operandLeft, binary.LittleEndian.AppendUint16(nil, uint16(result)))
+
+	overflow := result != int32(int16(result))
+	store.printFlag("CF", carryFlag, overflow)
+	store.printFlag("OF", overflowFlag, overflow)
+}
+
+// Shifts and rotations, the count is masked to 5 bits like on the 80186.
+// Rotations only change the carry and overflow flags. Intel define OF only
+// for a count of 1, like the 8086 we compute it from the last bit shifted
+// whatever the count. AF is undefined, we clear it.
+func shift(store *Storage, i Instruction) {
+	size := int8(1 + i.w)
+	count, err := strconv.Atoi(i.operandRight)
+	if err != nil {
+		panic(fmt.Sprintf("%s only support an immediate count, %s", i.operator, err))
+	}
+	count &= 31
+	if count == 0 {
+		return
+	}
+
+	sign := uint16(1) << (8*size - 1)
+	value := store.readAsInt(i.operandLeft, size)
+	carry := store.getFlag(carryFlag)
+	for n := 0; n < count; n++ {
+		out := value&sign != 0
+		if i.operator == "ror" || i.operator == "rcr" || i.operator == "shr" || i.operator == "sar" {
+			out = value&1 != 0
+		}
+		switch i.operator {
+		case "rol":
+			value = value<<1 | uint16(boolToInt(out))
+		case "rcl":
+			value = value<<1 | uint16(boolToInt(carry))
+		case "shl":
+			value = value << 1
+		case "ror":
+			value = value>>1 | sign*uint16(boolToInt(out))
+		case "rcr":
+			value = value>>1 | sign*uint16(boolToInt(carry))
+		case "shr":
+			value = value >> 1
+		case "sar":
+			value = value>>1 | value&sign
+		}
+		carry = out
+	}
+
+	if size == 1 {
+		store.write(i.operandLeft, []byte{byte(value)})
+		value &= 0xFF
+	} else {
+		store.write(i.operandLeft, binary.LittleEndian.AppendUint16(nil, value))
+	}
+	store.printFlag("CF", carryFlag, carry)
+	if strings.HasSuffix(i.operator, "l") {
+		store.printFlag("OF", overflowFlag, (value&sign != 0) != carry)
+	} else {
+		store.printFlag("OF", overflowFlag, (value&sign != 0) != (value&(sign>>1) != 0))
+	}
+	if !strings.HasPrefix(i.operator, "r") {
+		store.setZeroFlag(value == 0)
+		store.setSignFlag(value&sign != 0)
+		store.printFlag("PF", parityFlag, bits.OnesCount8(byte(value))%2 == 0)
+		store.printFlag("AF", auxCarryFlag, false)
+	}
+}
+
 // =================
 // ===== UTILS =====
 // =================
 
 type Storage struct {
-	bus      io.ReadSeeker   // Instruction bus
-	internal [20]byte        // 8 * 16bits register + IP register + Flags register
-	memory   [64 * 1024]byte // We only have 64Kb of memory because we don't implement segment registers
+	internal [28]byte          // 8 * 16bits register + IP + Flags + 4 segment registers
+	memory   [1024 * 1024]byte // 1Mb of memory addressed with segment:offset
+	codeEnd  int               // Execution stop when CS:IP reach this address
+	trace    io.Writer         // Side effects of each instruction are printed here
+	cycles   int               // Estimated cycles since the start of the program
+	executed int               // Instructions executed since the start of the program
+	profile  *Profile          // Optional, record the cost of each instruction
+	source   *SourceMap        // Optional, show the source of each instruction in the trace
+	history  *History          // Optional, undo log to execute backward
+	halted   bool              // Set by HLT, nothing is executed until an interrupt
+	inhibit  bool              // Set by STI and writes to SS, no interrupt before the next instruction
+	jumped   bool              // Set by the instructions that transfer the control, for their timing
+	dos      bool              // An MZ was loaded, INT 20h and INT 21h/4Ch end it like DOS would
+	exited   bool              // The program ended with INT 20h or INT 21h/4Ch
+	exitCode byte              // AL of INT 21h/4Ch
+	cpu      *CPU              // Model of the processor, decide the instructions decoded
+	biu      *BIU              // Optional, model of the prefetch queue for a better timing
+	fpu      *FPU              // Optional, 8087 coprocessor executing the ESC instructions
+	ports    *PortBus          // Devices answering IN and OUT
+
+	memoryMap *MemoryMap     // Kind of the regions of the memory, RAM by default
+	display   *TextDisplay   // Optional, text memory of a CGA mapped in the memory
+	trap      error          // Set by an access that hit a trap of the memory map
+	undefined *UndefinedUses // Optional, warn about the use of values never written
+
+	observers []memoryObserver // Notified of every memory access
+}
+
+// Observers are notified of every memory access made by instructions, before
+// the access happen.
+type memoryObserver interface {
+	observeRead(address int, size int)
+	observeWrite(address int, size int)
+}
+
+func NewStorage(trace io.Writer) *Storage {
+	ports, err := NewPCPortBus()
+	if err != nil {
+		panic(err)
+	}
+	return &Storage{codeEnd: len(Storage{}.memory), trace: trace, cpu: cpus["8086"], ports: ports, memoryMap: NewMemoryMap()}
+}
+
+// Load a flat binary at segment:offset and point CS:IP to its first byte.
+func (store *Storage) load(program io.Reader, segment uint16, offset uint16) error {
+	code, err := io.ReadAll(program)
+	if err != nil {
+		return err
+	}
+	start := physicalAddress(segment, offset)
+	if start+len(code) > len(store.memory) {
+		return fmt.Errorf("program of %d bytes does not fit in memory", len(code))
+	}
+	copy(store.memory[start:], code)
+	store.codeEnd = start + len(code)
+	store.memoryMap.loaded(start, len(code))
+	store.setRegister("cs", segment)
+	store.setRegister("ip", offset)
+	return nil
+}
+
+// Decode and execute the instruction at CS:IP
+func (store *Storage) step() (Instruction, error) {
+	if store.exited {
+		return Instruction{}, io.EOF
+	}
+	if i, ok := store.hardwareInterrupt(); ok {
+		return i, store.takeTrap()
+	}
+	if store.halted {
+		// Time pass until an interrupt wake the CPU up
+		store.cycles++
+		if store.biu != nil {
+			store.biu.halt()
+		}
+		store.ports.advance(store.cycles)
+		return Instruction{operator: "hlt"}, nil
+	}
+
+	cs, ip := store.getRegister("cs"), store.getRegister("ip")
+	i, err := store.cpu.Decode(store.codeReader())
+	if err != nil {
+		return i, err
+	}
+
+	execute := executors[i.operator]
+	if execute == nil {
+		return i, fmt.Errorf("%w: operation %s", ErrNotImplemented, i.operator)
+	}
+
+	if store.history != nil {
+		store.history.begin(physicalAddress(cs, ip), store.cycles, false, store.ports.state())
+		if store.fpu != nil && fpuOperations[i.operator] != nil {
+			store.history.rememberFPU(store.fpu)
+		}
+	}
+	if store.source != nil {
+		if label, ok := store.source.label(physicalAddress(cs, ip)); ok {
+			fmt.Fprintf(store.trace, "%s:\n", label)
+		}
+	}
+	fmt.Fprintf(store.trace, "%- 12s ", &i)
+	store.incrementIP(uint16(i.size))
+
+	store.inhibit, store.jumped = false, false
+	store.undefined.begin(cs, ip, &i)
+	execute(store, i)
+	store.undefined.end()
+
+	jumped := store.jumped
+	cycles := store.cpu.estimateCycles(i, jumped)
+	store.cycles += cycles
+	store.executed++
+	if store.profile != nil {
+		store.profile.record(cs, ip, i, cycles)
+	}
+	store.ports.advance(store.cycles)
+	if store.biu != nil {
+		store.biu.instruction(physicalAddress(cs, ip), int(i.size), cycles)
+	}
+
+	if store.source != nil {
+		if text := store.source.text(physicalAddress(cs, ip)); text != "" {
+			line, _ := store.source.line(physicalAddress(cs, ip))
+			fmt.Fprintf(store.trace, "; %d: %s", line, text)
+		}
+	}
+	fmt.Fprint(store.trace, "\n")
+	return i, store.takeTrap()
+}
+
+// Return the instruction bus, starting at CS:IP. The CPU fetch through the
+// memory map, a ROM or a device can be executed.
+func (store *Storage) codeReader() *memoryReader {
+	cs, ip := store.getRegister("cs"), store.getRegister("ip")
+	return &memoryReader{store, physicalAddress(cs, ip), true}
+}
+
+// Read the memory sequentially until the end of the loaded code
+type memoryReader struct {
+	store   *Storage
+	address int
+	fetch   bool // Through the memory map, otherwise directly like a debugger
+}
+
+func (r *memoryReader) Read(p []byte) (int, error) {
+	if r.address >= r.store.codeEnd {
+		return 0, io.EOF
+	}
+	if !r.fetch {
+		n := copy(p, r.store.memory[r.address:r.store.codeEnd])
+		r.address += n
+		return n, nil
+	}
+	n := 0
+	for ; n < len(p) && r.address < r.store.codeEnd; n++ {
+		p[n] = r.store.readMapped(r.address)
+		r.address++
+	}
+	return n, nil
 }
 
 // Return the imediate value or lookup the register.
@@ -207,12 +824,15 @@ func (store *Storage) read(location string, size int8) []byte {
 	offset, isReg := registersOffsets[location]
 	if isReg {
 		// it's a register
-		return store.internal[offset : offset+size]
+		store.undefined.checkRegister(store.trace, location, offset, size)
+		return bytes.Clone(store.internal[offset : offset+size])
 	}
 
 	// it's memory
 	address := store.effectiveAdressCalculation(location, size)
-	return store.memory[address : address+uint16(size)]
+	physical := store.physicalAddressOf(location, address)
+	store.undefined.checkMemory(store.trace, store.memoryMap, location, physical, int(size))
+	return store.readMemoryAt(physical, int(size))
 }
 
 // Same as read but converted to int with littleEndian format.
@@ -234,120 +854,233 @@ func (store *Storage) write(location string, value []byte) {
 }
 
 func (store *Storage) writeToRegister(offset int8, reg string, value []byte) {
-	fmt.Printf("[%s 0x%02x->", reg, store.internal[offset:offset+2])
+	fmt.Fprintf(store.trace, "[%s 0x%02x->", reg, store.internal[offset:offset+2])
+	store.rememberRegister(offset, len(value))
 	copy(store.internal[offset:], value)
-	fmt.Printf("0x%02x] ", store.internal[offset:offset+2])
+	fmt.Fprintf(store.trace, "0x%02x] ", store.internal[offset:offset+2])
+	if reg == "fl" {
+		store.undefined.defineFlags(0xFFFF)
+	} else {
+		store.undefined.define(offset, len(value))
+	}
+	if reg == "ss" {
+		// SP is expected to be written by the next instruction
+		store.inhibit = true
+	}
 }
 
 func (store *Storage) writeToMemory(location string, value []byte) {
-	// Get Adress
 	address := store.effectiveAdressCalculation(location, int8(len(value)))
+	store.writeMemoryAt(store.physicalAddressOf(location, address), address, value)
+}
 
-	// Write
-	fmt.Printf("[%d 0x%02x->", address, store.memory[address:address+2])
-	copy(store.memory[address:], value)
-	fmt.Printf("0x%02x] ", store.memory[address:address+2])
+// Read memory for an instruction, unlike readMemory the observers are
+// notified.
+func (store *Storage) readMemoryAt(physical int, size int) []byte {
+	for _, observer := range store.observers {
+		observer.observeRead(physical, size)
+	}
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = store.readMapped((physical + i) % len(store.memory))
+	}
+	return value
+}
+
+// Write memory for an instruction, address is the offset shown in the trace
+func (store *Storage) writeMemoryAt(physical int, address uint16, value []byte) {
+	for _, observer := range store.observers {
+		observer.observeWrite(physical, len(value))
+	}
+
+	// Words are shown even for bytes, the 8087 write up to 10 bytes
+	shown := max(len(value), 2)
+	fmt.Fprintf(store.trace, "[%d 0x%02x->", address, store.readMemory(physical, shown))
+	store.rememberMemory(physical, len(value))
+	ignored := ""
+	for i, b := range value {
+		if region := store.writeMapped((physical+i)%len(store.memory), b); region != "" {
+			ignored = region
+		}
+	}
+	fmt.Fprintf(store.trace, "0x%02x] ", store.readMemory(physical, shown))
+	if ignored != "" {
+		fmt.Fprintf(store.trace, "[write to %s ignored] ", ignored)
+	}
+}
+
+// Push a word at SS:SP
+func (store *Storage) push(value uint16) {
+	sp := store.getRegister("sp") - 2
+	store.write("sp", binary.LittleEndian.AppendUint16(nil, sp))
+	store.writeMemoryAt(physicalAddress(store.getRegister("ss"), sp), sp, binary.LittleEndian.AppendUint16(nil, value))
+}
+
+// Pop the word at SS:SP
+func (store *Storage) pop() uint16 {
+	sp := store.getRegister("sp")
+	value := store.readMemoryAt(physicalAddress(store.getRegister("ss"), sp), 2)
+	store.write("sp", binary.LittleEndian.AppendUint16(nil, sp+2))
+	return binary.LittleEndian.Uint16(value)
+}
+
+func (store *Storage) readMemory(address int, size int) []byte {
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = store.memory[(address+i)%len(store.memory)]
+	}
+	return value
 }
 
 func (store *Storage) effectiveAdressCalculation(EACalc string, size int8) uint16 {
-	// Normalize EA
+	// Do the calc
+	address := uint16(0)
+	for _, loc := range addressTerms(EACalc) {
+		address += store.readAsInt(loc, 2)
+	}
+	return address
+}
+
+// Calculations using BP are relative to the stack segment, everything else
+// to the data segment.
+func (store *Storage) physicalAddressOf(EACalc string, address uint16) int {
+	segment := store.getRegister("ds")
+	for _, loc := range addressTerms(EACalc) {
+		if loc == "bp" {
+			segment = store.getRegister("ss")
+		}
+	}
+	return physicalAddress(segment, address)
+}
+
+func addressTerms(EACalc string) []string {
+	// Normalize EA, the size (byte, word, dword...) is before the brackets
+	if start := strings.Index(EACalc, "["); start >= 0 {
+		EACalc = EACalc[start:]
+	}
 	EACalc = strings.ReplaceAll(EACalc, "[", "")
 	EACalc = strings.ReplaceAll(EACalc, "]", "")
 	EACalc = strings.ReplaceAll(EACalc, "byte", "")
 	EACalc = strings.ReplaceAll(EACalc, "word", "")
 	EACalc = strings.ReplaceAll(EACalc, " ", "")
 
-	// Do the calc
-	address := uint16(0)
-	locations := strings.Split(EACalc, "+")
-	for _, loc := range locations {
-		address += store.readAsInt(loc, 2)
+	return strings.Split(EACalc, "+")
+}
+
+// The 8086 has a 20 bits address bus, addresses wrap around at 1Mb
+func physicalAddress(segment uint16, offset uint16) int {
+	return (int(segment)<<4 + int(offset)) & 0xFFFFF
+}
+
+func (store *Storage) getRegister(reg string) uint16 {
+	offset := registersOffsets[reg]
+	return binary.LittleEndian.Uint16(store.internal[offset:])
+}
+
+func (store *Storage) setRegister(reg string, value uint16) {
+	offset := registersOffsets[reg]
+	store.rememberRegister(offset, 2)
+	binary.LittleEndian.PutUint16(store.internal[offset:], value)
+	if reg != "fl" {
+		store.undefined.define(offset, 2)
 	}
-	return address
 }
 
-func (store *Storage) setZeroFlag(flag bool) {
-	fmt.Printf("[ZF %t] ", flag)
-	if flag {
-		store.internal[19] = store.internal[19] | 0x80
-		return
+func (store *Storage) getFlag(flag uint16) bool {
+	store.undefined.checkFlags(store.trace, flag)
+	return store.getRegister("fl")&flag != 0
+}
+
+func (store *Storage) setFlag(flag uint16, value bool) {
+	flags := store.getRegister("fl") &^ flag
+	if value {
+		flags |= flag
 	}
-	store.internal[19] = store.internal[19] & 0x7F
+	store.setRegister("fl", flags)
+	store.undefined.defineFlags(flag)
+}
+
+func (store *Storage) printFlag(name string, flag uint16, value bool) {
+	fmt.Fprintf(store.trace, "[%s %t] ", name, value)
+	store.setFlag(flag, value)
+}
+
+func (store *Storage) setZeroFlag(flag bool) {
+	store.printFlag("ZF", zeroFlag, flag)
 }
 
 func (store *Storage) getZeroFlag() bool {
-	return store.internal[19]>>7 == 1
+	return store.getFlag(zeroFlag)
 }
 
 func (store *Storage) setSignFlag(flag bool) {
-	fmt.Printf("[SF %t] ", flag)
-	if flag {
-		store.internal[18] = store.internal[18] | 0x01
-		return
-	}
-	store.internal[18] = store.internal[18] & 0xFE
+	store.printFlag("SF", signFlag, flag)
 }
 
 func (store *Storage) getSignFlag() bool {
-	return store.internal[18]&0b1 == 1
+	return store.getFlag(signFlag)
 }
 
 func (store *Storage) incrementIP(size uint16) {
-	current := binary.LittleEndian.Uint16(store.internal[16:18])
-	current += uint16(size)
-
-	currentByte := make([]byte, 2)
-	binary.LittleEndian.PutUint16(currentByte, current)
-
-	copy(store.internal[16:], currentByte)
-	fmt.Printf("[IP 0x%04x] ", currentByte)
-
+	current := store.getRegister("ip") + size
+	store.setRegister("ip", current)
+	fmt.Fprintf(store.trace, "[IP 0x%04x] ", store.internal[16:18])
 }
 
 // I LOVE ASCII TABLES
-func (store *Storage) PrintRegistersBinary() {
+func (store *Storage) PrintRegistersBinary(out io.Writer) {
 	r := store.internal
 
-	fmt.Printf("     ┌─────────────────────┐\n")
-	fmt.Printf("     │       STORAGE       │\n")
-	fmt.Printf("┌────┼──────────┬──────────┤\n")
-	fmt.Printf("│ ax │ %08b │ %08b │\n", r[0], r[1])
-	fmt.Printf("│ bx │ %08b │ %08b │\n", r[2], r[3])
-	fmt.Printf("│ cx │ %08b │ %08b │\n", r[4], r[5])
-	fmt.Printf("│ dx │ %08b │ %08b │\n", r[6], r[7])
-	fmt.Printf("├────┼──────────┴──────────┤\n")
-	fmt.Printf("│ sp │ %08b   %08b │\n", r[8], r[9])
-	fmt.Printf("│ bp │ %08b   %08b │\n", r[10], r[11])
-	fmt.Printf("│ si │ %08b   %08b │\n", r[12], r[13])
-	fmt.Printf("│ di │ %08b   %08b │\n", r[14], r[15])
-	fmt.Printf("├────┼─────────────────────┤\n")
-	fmt.Printf("│ ip │ %08b   %08b │\n", r[16], r[17])
-	fmt.Printf("├────┼─────────────────────┤\n")
-	fmt.Printf("│ fl │ %08b   %08b │\n", r[18], r[19])
-	fmt.Printf("└────┴─────────────────────┘\n")
+	fmt.Fprintf(out, "     ┌─────────────────────┐\n")
+	fmt.Fprintf(out, "     │       STORAGE       │\n")
+	fmt.Fprintf(out, "┌────┼──────────┬──────────┤\n")
+	fmt.Fprintf(out, "│ ax │ %08b │ %08b │\n", r[0], r[1])
+	fmt.Fprintf(out, "│ bx │ %08b │ %08b │\n", r[2], r[3])
+	fmt.Fprintf(out, "│ cx │ %08b │ %08b │\n", r[4], r[5])
+	fmt.Fprintf(out, "│ dx │ %08b │ %08b │\n", r[6], r[7])
+	fmt.Fprintf(out, "├────┼──────────┴──────────┤\n")
+	fmt.Fprintf(out, "│ sp │ %08b   %08b │\n", r[8], r[9])
+	fmt.Fprintf(out, "│ bp │ %08b   %08b │\n", r[10], r[11])
+	fmt.Fprintf(out, "│ si │ %08b   %08b │\n", r[12], r[13])
+	fmt.Fprintf(out, "│ di │ %08b   %08b │\n", r[14], r[15])
+	fmt.Fprintf(out, "├────┼─────────────────────┤\n")
+	fmt.Fprintf(out, "│ es │ %08b   %08b │\n", r[20], r[21])
+	fmt.Fprintf(out, "│ cs │ %08b   %08b │\n", r[22], r[23])
+	fmt.Fprintf(out, "│ ss │ %08b   %08b │\n", r[24], r[25])
+	fmt.Fprintf(out, "│ ds │ %08b   %08b │\n", r[26], r[27])
+	fmt.Fprintf(out, "├────┼─────────────────────┤\n")
+	fmt.Fprintf(out, "│ ip │ %08b   %08b │\n", r[16], r[17])
+	fmt.Fprintf(out, "├────┼─────────────────────┤\n")
+	fmt.Fprintf(out, "│ fl │ %08b   %08b │\n", r[18], r[19])
+	fmt.Fprintf(out, "└────┴─────────────────────┘\n")
 }
 
 // MOOOAAARE ASCII TABLES
-func (store *Storage) PrintRegistersHex() {
+func (store *Storage) PrintRegistersHex(out io.Writer) {
 	r := store.internal
 
-	fmt.Printf("     ┌─────────────┐\n")
-	fmt.Printf("     │  REGISTERS  │\n")
-	fmt.Printf("┌────┼──────┬──────│\n")
-	fmt.Printf("│ ax │ 0x%02x │ 0x%02x │\n", r[0], r[1])
-	fmt.Printf("│ bx │ 0x%02x │ 0x%02x │\n", r[2], r[3])
-	fmt.Printf("│ cx │ 0x%02x │ 0x%02x │\n", r[4], r[5])
-	fmt.Printf("│ dx │ 0x%02x │ 0x%02x │\n", r[6], r[7])
-	fmt.Printf("├────┼──────┴──────┤\n")
-	fmt.Printf("│ sp │ 0x%02x   0x%02x │\n", r[8], r[9])
-	fmt.Printf("│ bp │ 0x%02x   0x%02x │\n", r[10], r[11])
-	fmt.Printf("│ si │ 0x%02x   0x%02x │\n", r[12], r[13])
-	fmt.Printf("│ di │ 0x%02x   0x%02x │\n", r[14], r[15])
-	fmt.Printf("├────┼─────────────┤\n")
-	fmt.Printf("│ ip │ 0x%02x   0x%02x │\n", r[16], r[17])
-	fmt.Printf("├────┼─────────────┤\n")
-	fmt.Printf("│ fl │ 0x%02x   0x%02x │\n", r[18], r[19])
-	fmt.Printf("└────┴─────────────┘\n")
+	fmt.Fprintf(out, "     ┌─────────────┐\n")
+	fmt.Fprintf(out, "     │  REGISTERS  │\n")
+	fmt.Fprintf(out, "┌────┼──────┬──────│\n")
+	fmt.Fprintf(out, "│ ax │ 0x%02x │ 0x%02x │\n", r[0], r[1])
+	fmt.Fprintf(out, "│ bx │ 0x%02x │ 0x%02x │\n", r[2], r[3])
+	fmt.Fprintf(out, "│ cx │ 0x%02x │ 0x%02x │\n", r[4], r[5])
+	fmt.Fprintf(out, "│ dx │ 0x%02x │ 0x%02x │\n", r[6], r[7])
+	fmt.Fprintf(out, "├────┼──────┴──────┤\n")
+	fmt.Fprintf(out, "│ sp │ 0x%02x   0x%02x │\n", r[8], r[9])
+	fmt.Fprintf(out, "│ bp │ 0x%02x   0x%02x │\n", r[10], r[11])
+	fmt.Fprintf(out, "│ si │ 0x%02x   0x%02x │\n", r[12], r[13])
+	fmt.Fprintf(out, "│ di │ 0x%02x   0x%02x │\n", r[14], r[15])
+	fmt.Fprintf(out, "├────┼─────────────┤\n")
+	fmt.Fprintf(out, "│ es │ 0x%02x   0x%02x │\n", r[20], r[21])
+	fmt.Fprintf(out, "│ cs │ 0x%02x   0x%02x │\n", r[22], r[23])
+	fmt.Fprintf(out, "│ ss │ 0x%02x   0x%02x │\n", r[24], r[25])
+	fmt.Fprintf(out, "│ ds │ 0x%02x   0x%02x │\n", r[26], r[27])
+	fmt.Fprintf(out, "├────┼─────────────┤\n")
+	fmt.Fprintf(out, "│ ip │ 0x%02x   0x%02x │\n", r[16], r[17])
+	fmt.Fprintf(out, "├────┼─────────────┤\n")
+	fmt.Fprintf(out, "│ fl │ 0x%02x   0x%02x │\n", r[18], r[19])
+	fmt.Fprintf(out, "└────┴─────────────┘\n")
 }
 
 // ==================
@@ -355,34 +1088,109 @@ func (store *Storage) PrintRegistersHex() {
 // ==================
 
 // The following table represent the beginning of each register in our array
+// Registers are little endian so the low half come first.
 var registersOffsets = map[string]int8{
 	"ax": 0,
-	"ah": 0,
-	"al": 1,
+	"al": 0,
+	"ah": 1,
 	"bx": 2,
-	"bh": 2,
-	"bl": 3,
+	"bl": 2,
+	"bh": 3,
 	"cx": 4,
-	"ch": 4,
-	"cl": 5,
+	"cl": 4,
+	"ch": 5,
 	"dx": 6,
-	"dh": 6,
-	"dl": 7,
+	"dl": 6,
+	"dh": 7,
 	"sp": 8,
 	"bp": 10,
 	"si": 12,
 	"di": 14,
-	"fl": 14,
+	"ip": 16,
+	"fl": 18,
+	"es": 20,
+	"cs": 22,
+	"ss": 24,
+	"ds": 26,
+}
+
+// Reference figure 2-9 Flags
+const (
+	carryFlag     = 1 << 0
+	parityFlag    = 1 << 2
+	auxCarryFlag  = 1 << 4
+	zeroFlag      = 1 << 6
+	signFlag      = 1 << 7
+	trapFlag      = 1 << 8
+	interruptFlag = 1 << 9
+	directionFlag = 1 << 10
+	overflowFlag  = 1 << 11
+)
+
+// Registers in the order they are shown to humans
+var registerNames = []string{
+	"ax", "bx", "cx", "dx", "sp", "bp", "si", "di",
+	"es", "cs", "ss", "ds", "ip", "fl",
+}
+
+var flagNames = []struct {
+	name string
+	mask uint16
+}{
+	{"CF", carryFlag},
+	{"PF", parityFlag},
+	{"AF", auxCarryFlag},
+	{"ZF", zeroFlag},
+	{"SF", signFlag},
+	{"TF", trapFlag},
+	{"IF", interruptFlag},
+	{"DF", directionFlag},
+	{"OF", overflowFlag},
 }
 
 var executors = map[string]func(*Storage, Instruction){
-	"mov": mov,
-	"add": add,
-	"sub": sub,
-	"cmp": cmp,
-	"jmp": jmp,
-	"je":  je,
-	"jne": jne,
-	"js":  js,
-	"jns": jns,
+	"mov":   mov,
+	"add":   add,
+	"sub":   sub,
+	"cmp":   cmp,
+	"jmp":   jmp,
+	"je":    je,
+	"jne":   jne,
+	"js":    js,
+	"jns":   jns,
+	"hlt":   hlt,
+	"fwait": fwait,
+	"cli":   cli,
+	"sti":   sti,
+	"clc":   clc,
+	"stc":   stc,
+	"cmc":   cmc,
+
+	"push":  push,
+	"pop":   pop,
+	"pusha": pusha,
+	"popa":  popa,
+	"enter": enter,
+	"leave": leave,
+	"imul":  imul,
+	"rol":   shift,
+	"ror":   shift,
+	"rcl":   shift,
+	"rcr":   shift,
+	"shl":   shift,
+	"shr":   shift,
+	"sar":   shift,
+	"bound": bound,
+
+	"in":    in,
+	"out":   out,
+	"insb":  ins,
+	"insw":  ins,
+	"outsb": outs,
+	"outsw": outs,
+
+	"int":  softwareInterrupt,
+	"int3": int3,
+	"into": into,
+	"iret": iret,
 }
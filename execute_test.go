@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Assemble the source, load it at 1000:0000 and run it until its end
+func runSource(t *testing.T, source string) *Storage {
+	t.Helper()
+	code, err := Assemble(strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("%q: %s", source, err)
+	}
+	return runCode(t, "8086", code)
+}
+
+// Same as runSource for machine code, for the instructions that the
+// assembler does not know.
+func runCode(t *testing.T, cpu string, code []byte) *Storage {
+	t.Helper()
+	store := NewStorage(io.Discard)
+	store.cpu = cpus[cpu]
+	err := store.load(bytes.NewReader(code), codeSegment, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.run(context.Background(), Limits{MaxInstructions: 1000}, nil)
+	if err != nil {
+		t.Fatalf("% x: %s", code, err)
+	}
+	return store
+}
+
+// A jump to the next instruction is taken even if IP end up where it would
+// be without the jump.
+func TestJumpTaken(t *testing.T) {
+	tests := []struct {
+		source string
+		cycles int
+	}{
+		{"jne $+2", 16},
+		{"jne $+5\nmov cx, 1", 16},
+		{"cmp cx, cx\njne $+2", 3 + 4},
+		{"cmp cx, cx\nje $+2", 3 + 16},
+		{"cmp cx, cx\nje $+5\nmov cx, 1", 3 + 16},
+		{"jmp $+2", 15},
+		{"jmp $+5\nmov cx, 1", 15},
+	}
+	for _, test := range tests {
+		store := runSource(t, test.source)
+		if store.cycles != test.cycles {
+			t.Errorf("%q: %d cycles, expected %d", test.source, store.cycles, test.cycles)
+		}
+	}
+}
+
+// Shifts by 1 of AL with the 80186 encoding C0 /r ib, after `mov al, x`
+func TestShiftFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  []byte
+		al    byte
+		flags uint16
+	}{
+		{"shl 0x81", []byte{0xb0, 0x81, 0xc0, 0xe0, 0x01}, 0x02, carryFlag | overflowFlag},
+		{"shl 0x40", []byte{0xb0, 0x40, 0xc0, 0xe0, 0x01}, 0x80, overflowFlag | signFlag},
+		{"shl 0x03", []byte{0xb0, 0x03, 0xc0, 0xe0, 0x01}, 0x06, parityFlag},
+		{"shl 0x80", []byte{0xb0, 0x80, 0xc0, 0xe0, 0x01}, 0x00, carryFlag | overflowFlag | parityFlag | zeroFlag},
+		{"shr 0x81", []byte{0xb0, 0x81, 0xc0, 0xe8, 0x01}, 0x40, carryFlag | overflowFlag},
+		{"sar 0x81", []byte{0xb0, 0x81, 0xc0, 0xf8, 0x01}, 0xc0, carryFlag | parityFlag | signFlag},
+		{"shr 0x81 by 2", []byte{0xb0, 0x81, 0xc0, 0xe8, 0x02}, 0x20, 0},
+		{"rol 0x40", []byte{0xb0, 0x40, 0xc0, 0xc0, 0x01}, 0x80, overflowFlag},
+		{"rol 0x81", []byte{0xb0, 0x81, 0xc0, 0xc0, 0x01}, 0x03, carryFlag | overflowFlag},
+		{"ror 0x01", []byte{0xb0, 0x01, 0xc0, 0xc8, 0x01}, 0x80, carryFlag | overflowFlag},
+		{"ror 0x02", []byte{0xb0, 0x02, 0xc0, 0xc8, 0x01}, 0x01, 0},
+	}
+	for _, test := range tests {
+		store := runCode(t, "80186", test.code)
+		al := store.read("al", 1)[0]
+		flags := store.getRegister("fl") & statusFlags
+		if al != test.al || flags != test.flags {
+			t.Errorf("%s: al 0x%02x flags 0x%03x, expected 0x%02x and 0x%03x", test.name, al, flags, test.al, test.flags)
+		}
+	}
+}
+
+// `mov bx, 300` then IMUL with a byte and a word immediate
+func TestImulImmediate(t *testing.T) {
+	tests := []struct {
+		code  []byte
+		ax    uint16
+		flags uint16
+	}{
+		{[]byte{0xbb, 0x2c, 0x01, 0x6b, 0xc3, 0x0a}, 3000, 0},
+		{[]byte{0xbb, 0x2c, 0x01, 0x6b, 0xc3, 0xf6}, 0xf448, 0},
+		{[]byte{0xbb, 0x2c, 0x01, 0x69, 0xc3, 0xc8, 0x00}, 60000, carryFlag | overflowFlag},
+	}
+	for _, test := range tests {
+		store := runCode(t, "80186", test.code)
+		ax := store.getRegister("ax")
+		flags := store.getRegister("fl") & (carryFlag | overflowFlag)
+		if ax != test.ax || flags != test.flags {
+			t.Errorf("% x: ax 0x%04x flags 0x%03x, expected 0x%04x and 0x%03x", test.code, ax, flags, test.ax, test.flags)
+		}
+	}
+}
+
+// Options given by the user return an error instead of stopping the
+// simulator, the final state is not printed.
+func TestInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  ExecuteOptions
+		expected string
+	}{
+		{"map", ExecuteOptions{MemoryMap: "flash:0-10"}, "invalid memory region"},
+		{"cpu", ExecuteOptions{CPU: "z80"}, "z80"},
+		{"break when", ExecuteOptions{BreakWhen: "ax =="}, "ax =="},
+		{"device", ExecuteOptions{Devices: []PortDevice{{0x40, 0x40, &recordingDevice{}}}}, "overlap"},
+		{"watch", ExecuteOptions{Watches: Watches{Registers: "zz"}}, "zz"},
+		{"heatmap", ExecuteOptions{Heatmap: t.TempDir()}, "heatmap"},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		test.options.Output = out
+		err := Execute(bytes.NewReader([]byte{0xb0, 0x01}), test.options) // mov al, 1
+		if err == nil || !strings.Contains(out.String(), test.expected) && !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: error %v, expected %q\n%s", test.name, err, test.expected, out)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expression on the state of the CPU used by conditional breakpoints, like
+// `cx == 63 && [bp + 2] != 0`. The syntax follow C with the operators
+// || && | ^ & == != < <= > >= + - * / % ! - ~ and parentheses. Operands are
+// numbers in NASM notation, registers, flags (cf, pf, af, zf, sf, tf, if, df,
+// of) and memory written like the decoder print it: `[bp + si + 4]`, read as
+// a word unless prefixed by `byte`. Like for instructions memory is in the
+// data segment, or in the stack segment when bp is used.
+//
+// Everything is an unsigned 16 bits value except comparisons and logical
+// operators that give 0 or 1.
+type Expression struct {
+	text string
+	eval func(store *Storage) int
+}
+
+func (e *Expression) String() string {
+	return e.text
+}
+
+// Evaluate the expression, reading memory does not notify the observers.
+func (e *Expression) Value(store *Storage) int {
+	return e.eval(store) & 0xFFFF
+}
+
+func (e *Expression) True(store *Storage) bool {
+	return e.Value(store) != 0
+}
+
+func CompileExpression(text string) (*Expression, error) {
+	p := exprParser{tokens: tokenizeExpression(text)}
+	eval, err := p.binary(0)
+	if err == nil && p.position < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.position])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", text, err)
+	}
+	return &Expression{text: strings.TrimSpace(text), eval: eval}, nil
+}
+
+func tokenizeExpression(text string) []string {
+	tokens := []string{}
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case isIdentifierByte(c):
+			start := i
+			for i < len(text) && isIdentifierByte(text[i]) {
+				i++
+			}
+			tokens = append(tokens, strings.ToLower(text[start:i]))
+		case i+1 < len(text) && exprTwoCharacters[text[i:i+2]]:
+			tokens = append(tokens, text[i:i+2])
+			i += 2
+		default:
+			tokens = append(tokens, text[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+type exprParser struct {
+	tokens   []string
+	position int
+	stack    bool // The memory operand being parsed use bp
+}
+
+func (p *exprParser) peek() string {
+	if p.position < len(p.tokens) {
+		return p.tokens[p.position]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	token := p.peek()
+	p.position++
+	return token
+}
+
+// Parse the binary operators of at least the given precedence
+func (p *exprParser) binary(precedence int) (func(*Storage) int, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := exprBinaryOperators[p.peek()]
+		if !ok || operator.precedence < precedence {
+			return left, nil
+		}
+		p.next()
+		right, err := p.binary(operator.precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = func(l func(*Storage) int, r func(*Storage) int) func(*Storage) int {
+			return func(store *Storage) int {
+				return operator.apply(l(store)&0xFFFF, r(store)&0xFFFF)
+			}
+		}(left, right)
+	}
+}
+
+func (p *exprParser) unary() (func(*Storage) int, error) {
+	switch token := p.next(); token {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+
+	case "!", "-", "~", "+":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case "!":
+			return func(store *Storage) int { return boolToInt(operand(store)&0xFFFF == 0) }, nil
+		case "-":
+			return func(store *Storage) int { return -operand(store) }, nil
+		case "~":
+			return func(store *Storage) int { return ^operand(store) }, nil
+		}
+		return operand, nil
+
+	case "(":
+		inner, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+
+	case "byte", "word", "[":
+		size := 2
+		if token == "byte" {
+			size = 1
+		}
+		if token != "[" && p.next() != "[" {
+			return nil, fmt.Errorf("missing [ after %s", token)
+		}
+		outer := p.stack
+		p.stack = false
+		offset, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != "]" {
+			return nil, fmt.Errorf("missing ]")
+		}
+		segment := "ds"
+		if p.stack {
+			segment = "ss"
+		}
+		p.stack = outer
+		return func(store *Storage) int {
+			address := physicalAddress(store.getRegister(segment), uint16(offset(store)))
+			value := store.readMemory(address, size)
+			if size == 1 {
+				return int(value[0])
+			}
+			return int(value[0]) | int(value[1])<<8
+		}, nil
+
+	default:
+		if flag, ok := exprFlags[token]; ok {
+			return func(store *Storage) int { return boolToInt(store.getFlag(flag)) }, nil
+		}
+		if offset, ok := registersOffsets[token]; ok {
+			if token == "bp" {
+				p.stack = true
+			}
+			if isByteRegister(token) {
+				return func(store *Storage) int { return int(store.internal[offset]) }, nil
+			}
+			return func(store *Storage) int { return int(store.getRegister(token)) }, nil
+		}
+		if token[0] >= '0' && token[0] <= '9' {
+			value, err := parseNumber(token)
+			if err != nil {
+				return nil, err
+			}
+			return func(*Storage) int { return value }, nil
+		}
+		return nil, fmt.Errorf("unexpected %s", token)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Registers of 8 bits have an even key in the decoder table, w is the low bit
+func isByteRegister(name string) bool {
+	for key, reg := range registers {
+		if reg == name {
+			return key&1 == 0
+		}
+	}
+	return false
+}
+
+type exprOperator struct {
+	precedence int
+	apply      func(a int, b int) int
+}
+
+var exprBinaryOperators = map[string]exprOperator{
+	"||": {1, func(a, b int) int { return boolToInt(a != 0 || b != 0) }},
+	"&&": {2, func(a, b int) int { return boolToInt(a != 0 && b != 0) }},
+	"|":  {3, func(a, b int) int { return a | b }},
+	"^":  {4, func(a, b int) int { return a ^ b }},
+	"&":  {5, func(a, b int) int { return a & b }},
+	"==": {6, func(a, b int) int { return boolToInt(a == b) }},
+	"!=": {6, func(a, b int) int { return boolToInt(a != b) }},
+	"<":  {7, func(a, b int) int { return boolToInt(a < b) }},
+	"<=": {7, func(a, b int) int { return boolToInt(a <= b) }},
+	">":  {7, func(a, b int) int { return boolToInt(a > b) }},
+	">=": {7, func(a, b int) int { return boolToInt(a >= b) }},
+	"+":  {8, func(a, b int) int { return a + b }},
+	"-":  {8, func(a, b int) int { return a - b }},
+	"*":  {9, func(a, b int) int { return a * b }},
+	"/": {9, func(a, b int) int {
+		if b == 0 {
+			return 0
+		}
+		return a / b
+	}},
+	"%": {9, func(a, b int) int {
+		if b == 0 {
+			return 0
+		}
+		return a % b
+	}},
+}
+
+var exprTwoCharacters = map[string]bool{
+	"||": true, "&&": true, "==": true, "!=": true, "<=": true, ">=": true,
+}
+
+var exprFlags = map[string]uint16{
+	"cf": carryFlag,
+	"pf": parityFlag,
+	"af": auxCarryFlag,
+	"zf": zeroFlag,
+	"sf": signFlag,
+	"tf": trapFlag,
+	"if": interruptFlag,
+	"df": directionFlag,
+	"of": overflowFlag,
+}
@@ -0,0 +1,1074 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Model of the 8087 coprocessor.
+//
+// Registers are kept in the 80 bits extended format. Arithmetic, square root
+// and conversions are done with math/big so that results are rounded like the
+// 8087 would, to the precision and with the rounding mode of the control word.
+// Transcendental instructions are computed with float64 so only their first
+// 53 bits are right.
+//
+// Exceptions set their flag in the status word and the masked response is
+// always used: there is no interrupt controller to deliver the unmasked ones.
+//
+// The 8087 execute an instruction while the CPU continue, FWAIT make the CPU
+// wait until the 8087 is done. An instruction sent while the 8087 is busy is
+// marked in the trace, the 8087 would have ignored it or worse.
+type FPU struct {
+	registers [8]extended // Physical registers, ST0 is the one pointed by TOP
+	control   uint16
+	status    uint16
+	tag       uint16 // 2 bits per physical register
+
+	// Saved by FSTENV and FSAVE for the exception handlers
+	instruction int    // Physical address of the last instruction
+	opcode      uint16 // Its 11 low bits
+	operand     int    // Physical address of its memory operand
+
+	busyUntil int       // Cycle of the CPU when the 8087 finish its instruction
+	trace     io.Writer // Trace of the instruction being executed
+	changed   [8]bool   // Registers written by the instruction being executed
+	before    [8]string // Value of the changed registers before the instruction
+}
+
+// Value in the 80 bits extended precision format: the sign, 15 bits of
+// exponent biased by 16383 and 64 bits of significand with an explicit
+// integer bit.
+type extended struct {
+	signExponent uint16
+	significand  uint64
+}
+
+// Reference 8087 status word, the exceptions are also the masks of the
+// control word.
+const (
+	fpuInvalid          = 1 << 0
+	fpuDenormal         = 1 << 1
+	fpuZeroDivide       = 1 << 2
+	fpuOverflow         = 1 << 3
+	fpuUnderflow        = 1 << 4
+	fpuPrecision        = 1 << 5
+	fpuInterruptRequest = 1 << 7  // Status word, an unmasked exception is pending
+	fpuInterruptMask    = 1 << 7  // Control word, mask every exception
+	fpuC0               = 1 << 8  // Condition codes
+	fpuC1               = 1 << 9  //
+	fpuC2               = 1 << 10 //
+	fpuC3               = 1 << 14 //
+	fpuTopShift         = 11      // Index of ST0 in the status word
+
+	fpuTagValid   = 0b00
+	fpuTagZero    = 0b01
+	fpuTagSpecial = 0b10
+	fpuTagEmpty   = 0b11
+)
+
+// The QNaN returned by invalid operations
+var indefinite = extended{0xFFFF, 0xC000000000000000}
+
+func NewFPU() *FPU {
+	f := &FPU{}
+	f.reset()
+	return f
+}
+
+// Same as FNINIT
+func (f *FPU) reset() {
+	f.control = 0x03FF
+	f.status = 0
+	f.tag = 0xFFFF
+	f.instruction, f.opcode, f.operand = 0, 0, 0
+}
+
+// =====================
+// ===== EXECUTION =====
+// =====================
+
+// Execute an ESC instruction, the memory operand is read and written through
+// the storage so that observers see the accesses.
+func (f *FPU) execute(store *Storage, i Instruction, address int) {
+	operation := fpuOperations[i.operator]
+	if operation == nil {
+		panic(fmt.Sprintf("8087 instruction %s not supported", i.operator))
+	}
+	if store.cycles < f.busyUntil {
+		fmt.Fprint(store.trace, "[8087 busy] ")
+	}
+
+	f.trace = store.trace
+	f.changed = [8]bool{}
+	operands := fpuOperands{store: store, left: i.operandLeft, right: i.operandRight}
+	if operandKind(i.operandLeft) == 'm' {
+		offset := store.effectiveAdressCalculation(i.operandLeft, 2)
+		operands.memory = store.physicalAddressOf(i.operandLeft, offset)
+		operands.offset = offset
+		operands.size = fpuOperandSizes[strings.Fields(i.operandLeft)[0]]
+	}
+
+	// The control instructions do not change the pointers
+	if !strings.HasPrefix(i.operator, "fn") && i.operator != "fldcw" && i.operator != "fldenv" && i.operator != "frstor" {
+		f.instruction = address
+		f.opcode = uint16(store.memory[address])<<8&0x700 | uint16(store.memory[(address+1)&0xFFFFF])
+		f.operand = operands.memory
+	}
+
+	operation(f, &operands)
+
+	for p, changed := range f.changed {
+		if changed {
+			fmt.Fprintf(f.trace, "[st%d %s->%s] ", (p-f.top())&7, f.before[p], f.describe(p))
+		}
+	}
+	f.busyUntil = store.cycles + fpuCycles[i.operator]
+}
+
+// Operands of the instruction being executed
+type fpuOperands struct {
+	store  *Storage
+	left   string
+	right  string
+	memory int    // Physical address of the memory operand
+	offset uint16 // Its offset in the segment, for the trace
+	size   int    // Bytes of the memory operand, 0 without memory operand
+}
+
+// Index in the stack of a register operand
+func (o *fpuOperands) register(operand string) int {
+	index, err := strconv.Atoi(strings.TrimPrefix(operand, "st"))
+	if err != nil || index < 0 || index > 7 {
+		panic(fmt.Sprintf("invalid 8087 register %s", operand))
+	}
+	return index
+}
+
+func (o *fpuOperands) read(size int) []byte {
+	return o.store.readMemoryAt(o.memory, size)
+}
+
+func (o *fpuOperands) write(value []byte) {
+	o.store.writeMemoryAt(o.memory, o.offset, value)
+}
+
+// Wait for the 8087 to finish its instruction
+func fwait(store *Storage, i Instruction) {
+	if store.fpu == nil || store.cycles >= store.fpu.busyUntil {
+		return
+	}
+	wait := store.fpu.busyUntil - store.cycles
+	fmt.Fprintf(store.trace, "[wait %d] ", wait)
+	store.cycles += wait
+}
+
+// ESC instructions, without 8087 the CPU still read the memory operand
+func esc(store *Storage, i Instruction) {
+	cs, ip := store.getRegister("cs"), store.getRegister("ip")-uint16(i.size)
+	if store.fpu != nil {
+		store.fpu.execute(store, i, physicalAddress(cs, ip))
+		return
+	}
+	if operandKind(i.operandLeft) == 'm' {
+		address := store.effectiveAdressCalculation(i.operandLeft, 2)
+		store.readMemoryAt(store.physicalAddressOf(i.operandLeft, address), 2)
+	}
+}
+
+// ======================
+// ===== OPERATIONS =====
+// ======================
+
+// Arithmetic between ST0 and the memory or between two registers, the result
+// is written in the left operand. Reversed operations swap the operands.
+func fpuArithmetic(f *FPU, o *fpuOperands, operator string) {
+	operation := strings.TrimPrefix(strings.TrimPrefix(operator, "fi"), "f")
+	pop := false
+	if strings.HasSuffix(operation, "p") && operation != "p" {
+		operation, pop = strings.TrimSuffix(operation, "p"), true
+	}
+	reversed := strings.HasSuffix(operation, "r")
+	operation = strings.TrimSuffix(operation, "r")
+
+	destination := 0
+	var a, b extended
+	if o.size > 0 {
+		a, b = f.get(0), f.loadMemory(o, strings.HasPrefix(operator, "fi"))
+	} else {
+		destination = o.register(o.left)
+		a, b = f.get(destination), f.get(o.register(o.right))
+	}
+	if reversed {
+		a, b = b, a
+	}
+
+	f.set(destination, f.calculate(func(z *big.Float, x []*big.Float) {
+		switch operation {
+		case "add":
+			z.Add(x[0], x[1])
+		case "sub":
+			z.Sub(x[0], x[1])
+		case "mul":
+			z.Mul(x[0], x[1])
+		case "div":
+			if x[1].Sign() == 0 && x[0].Sign() != 0 && !x[0].IsInf() {
+				f.raise(fpuZeroDivide)
+			}
+			z.Quo(x[0], x[1])
+		}
+	}, a, b))
+	if pop {
+		f.pop()
+	}
+}
+
+// Compare ST0 to the memory or a register and set C3 C2 C0
+func fpuCompare(f *FPU, o *fpuOperands, operator string) {
+	var b extended
+	switch {
+	case operator == "ftst":
+		b = extended{}
+	case o.size > 0:
+		b = f.loadMemory(o, strings.HasPrefix(operator, "fi"))
+	case o.left == "":
+		b = f.get(1)
+	default:
+		b = f.get(o.register(o.left))
+	}
+	f.compare(f.get(0), b)
+
+	switch operator {
+	case "fcompp":
+		f.pop()
+		f.pop()
+	case "fcomp", "ficomp":
+		f.pop()
+	}
+}
+
+func fpuLoad(f *FPU, o *fpuOperands, operator string) {
+	switch {
+	case operator == "fbld":
+		f.push(f.fromBCD(o.read(10)))
+	case o.size > 0:
+		f.push(f.loadMemory(o, operator == "fild"))
+	default:
+		f.push(f.get(o.register(o.left)))
+	}
+}
+
+func fpuStore(f *FPU, o *fpuOperands, operator string) {
+	value := f.get(0)
+	switch {
+	case operator == "fbstp":
+		o.write(f.toBCD(value))
+	case o.size > 0:
+		f.storeMemory(o, value, strings.HasPrefix(operator, "fi"))
+	default:
+		f.set(o.register(o.left), value)
+	}
+	if strings.HasSuffix(operator, "p") {
+		f.pop()
+	}
+}
+
+var fpuConstants = map[string]extended{
+	"fld1":   {0x3FFF, 0x8000000000000000},
+	"fldz":   {0x0000, 0x0000000000000000},
+	"fldpi":  {0x4000, 0xC90FDAA22168C235},
+	"fldl2t": {0x4000, 0xD49A784BCD1B8AFE},
+	"fldl2e": {0x3FFF, 0xB8AA3B295C17F0BC},
+	"fldlg2": {0x3FFD, 0x9A209A84FBCFF799},
+	"fldln2": {0x3FFE, 0xB17217F7D1CF79AC},
+}
+
+func fpuConstant(f *FPU, o *fpuOperands, operator string) {
+	f.push(fpuConstants[operator])
+}
+
+func fpuExchange(f *FPU, o *fpuOperands, operator string) {
+	other := o.register(o.left)
+	a, b := f.get(0), f.get(other)
+	f.set(0, b)
+	f.set(other, a)
+}
+
+func fpuFree(f *FPU, o *fpuOperands, operator string) {
+	f.setTag(f.physical(o.register(o.left)), fpuTagEmpty)
+}
+
+// Operations on ST0 alone
+func fpuUnary(f *FPU, o *fpuOperands, operator string) {
+	x := f.get(0)
+	switch operator {
+	case "fchs":
+		x.signExponent ^= 0x8000
+		f.set(0, x)
+	case "fabs":
+		x.signExponent &^= 0x8000
+		f.set(0, x)
+	case "fsqrt":
+		if !x.isNaN() && x.negative() && !x.isZero() {
+			f.raise(fpuInvalid)
+			f.set(0, indefinite)
+			return
+		}
+		f.set(0, f.calculate(func(z *big.Float, x []*big.Float) { z.Sqrt(x[0]) }, x))
+	case "frndint":
+		if x.isNaN() || x.isInf() {
+			return
+		}
+		rounded := roundToInteger(x.big(), f.roundingMode())
+		if rounded.Cmp(x.big()) != 0 {
+			f.raise(fpuPrecision)
+		}
+		f.set(0, f.round(rounded))
+	}
+}
+
+// Scale ST0 by 2 to the power of ST1 truncated
+func fpuScale(f *FPU, o *fpuOperands, operator string) {
+	x, scale := f.get(0), f.get(1)
+	if x.isNaN() || scale.isNaN() || scale.isInf() {
+		f.set(0, f.calculate(nil, x, scale))
+		return
+	}
+	n, _ := scale.big().Int64()
+	n = max(min(n, 1<<20), -1<<20)
+	f.set(0, f.calculate(func(z *big.Float, x []*big.Float) {
+		z.SetMantExp(x[0], int(n))
+	}, x))
+}
+
+// Split ST0 into its exponent, left in ST1, and its significand in ST0
+func fpuExtract(f *FPU, o *fpuOperands, operator string) {
+	x := f.get(0)
+	if x.isNaN() || x.isInf() || x.isZero() {
+		if x.isZero() {
+			f.raise(fpuZeroDivide)
+			f.set(0, extended{0xFFFF, 0x8000000000000000}) // -inf
+			f.push(x)
+		}
+		return
+	}
+	mant := new(big.Float)
+	exp := x.big().MantExp(mant)
+	f.set(0, f.round(new(big.Float).SetInt64(int64(exp-1))))
+	f.push(f.round(mant.SetMantExp(mant, 1)))
+}
+
+// Partial remainder of ST0 divided by ST1. The quotient is truncated, its 3
+// low bits go in C0 C3 C1. When the exponents are too far apart only a part
+// of the reduction is done and C2 is set, the program loop until C2 is clear.
+func fpuRemainder(f *FPU, o *fpuOperands, operator string) {
+	a, b := f.get(0), f.get(1)
+	if a.isNaN() || b.isNaN() || a.isInf() || b.isZero() {
+		if !a.isNaN() && !b.isNaN() {
+			f.raise(fpuInvalid)
+			f.set(0, indefinite)
+			return
+		}
+		f.set(0, f.calculate(nil, a, b))
+		return
+	}
+	if b.isInf() || a.isZero() {
+		f.setConditions(0, 0, 0, 0)
+		return
+	}
+
+	// a = ma * 2^ea and b = mb * 2^eb with integer significands
+	ma, ea := a.integer()
+	mb, eb := b.integer()
+	difference := ea - eb
+	partial := difference >= 64
+	if partial {
+		// Reduce the exponents difference by some bits at a time
+		difference = 32
+		eb = ea - difference
+	}
+
+	dividend := new(big.Int).Lsh(ma, uint(max(difference, 0)))
+	divisor := new(big.Int).Lsh(mb, uint(max(-difference, 0)))
+	quotient, remainder := new(big.Int).QuoRem(dividend, divisor, new(big.Int))
+	if difference < 0 {
+		// |a| < |b|, the remainder is a
+		quotient.SetInt64(0)
+		remainder.Set(ma)
+		eb = ea
+	} else {
+		eb = min(ea, eb)
+	}
+
+	result := new(big.Float).SetInt(remainder)
+	result.SetMantExp(result, eb)
+	if a.negative() {
+		result.Neg(result)
+	}
+	q := quotient.Uint64()
+	if partial {
+		f.setConditions(0, 1, 0, 0)
+	} else {
+		f.setConditions(int(q>>1&1), 0, int(q&1), int(q>>2&1))
+	}
+	f.set(0, f.round(result))
+}
+
+// Transcendental instructions, computed with float64
+func fpuTranscendental(f *FPU, o *fpuOperands, operator string) {
+	x := f.get(0)
+	y := extended{}
+	if operator == "fyl2x" || operator == "fyl2xp1" || operator == "fpatan" {
+		y = f.get(1)
+	}
+	if x.isNaN() || y.isNaN() {
+		f.set(0, f.calculate(nil, x, y))
+		return
+	}
+
+	a, b := x.float64(), y.float64()
+	switch operator {
+	case "f2xm1":
+		f.set(0, f.fromFloat64(math.Expm1(a*math.Ln2)))
+	case "fptan":
+		// The 8087 give the tangent as a ratio Y/X, we always give X = 1
+		f.set(0, f.fromFloat64(math.Tan(a)))
+		f.push(fpuConstants["fld1"])
+	case "fpatan":
+		f.pop()
+		f.set(0, f.fromFloat64(math.Atan2(b, a)))
+	case "fyl2x":
+		if a < 0 || (a == 0 && b == 0) {
+			f.raise(fpuInvalid)
+		} else if a == 0 {
+			f.raise(fpuZeroDivide)
+		}
+		f.pop()
+		f.set(0, f.fromFloat64(b*math.Log2(a)))
+	case "fyl2xp1":
+		f.pop()
+		f.set(0, f.fromFloat64(b*math.Log1p(a)/math.Ln2))
+	}
+}
+
+// Classify ST0 in the condition codes, C1 is the sign
+func fpuExamine(f *FPU, o *fpuOperands, operator string) {
+	p := f.physical(0)
+	x := f.registers[p]
+	sign := int(x.signExponent >> 15)
+	switch {
+	case f.getTag(p) == fpuTagEmpty:
+		f.setConditions(1, 0, sign, 1)
+	case x.isNaN():
+		f.setConditions(0, 0, sign, 1)
+	case x.isInf():
+		f.setConditions(0, 1, sign, 1)
+	case x.isZero():
+		f.setConditions(1, 0, sign, 0)
+	case x.signExponent&0x7FFF == 0:
+		f.setConditions(1, 1, sign, 0) // Denormal
+	case x.significand>>63 == 0:
+		f.setConditions(0, 0, sign, 0) // Unnormal
+	default:
+		f.setConditions(0, 1, sign, 0)
+	}
+}
+
+func fpuStack(f *FPU, o *fpuOperands, operator string) {
+	switch operator {
+	case "fincstp":
+		f.setTop(f.top() + 1)
+	case "fdecstp":
+		f.setTop(f.top() - 1)
+	}
+}
+
+func fpuControl(f *FPU, o *fpuOperands, operator string) {
+	switch operator {
+	case "fninit":
+		f.reset()
+	case "fnclex":
+		f.status &^= 0x80FF
+	case "fneni":
+		f.control &^= fpuInterruptMask
+	case "fndisi":
+		f.control |= fpuInterruptMask
+	case "fldcw":
+		f.control = binary.LittleEndian.Uint16(o.read(2))
+	case "fnstcw":
+		o.write(binary.LittleEndian.AppendUint16(nil, f.control))
+	case "fnstsw":
+		o.write(binary.LittleEndian.AppendUint16(nil, f.status))
+	case "fldenv":
+		f.loadEnvironment(o.read(14))
+	case "fnstenv":
+		o.write(f.environment())
+	case "frstor":
+		state := o.read(94)
+		f.loadEnvironment(state)
+		for i := 0; i < 8; i++ {
+			f.registers[f.physical(i)] = extendedFromBytes(state[14+10*i:])
+		}
+	case "fnsave":
+		state := f.environment()
+		for i := 0; i < 8; i++ {
+			state = append(state, f.registers[f.physical(i)].bytes()...)
+		}
+		o.write(state)
+		f.reset()
+	}
+}
+
+func fpuNop(f *FPU, o *fpuOperands, operator string) {}
+
+// Real mode layout of FSTENV
+func (f *FPU) environment() []byte {
+	env := []byte{}
+	for _, word := range []uint16{
+		f.control,
+		f.status,
+		f.tag,
+		uint16(f.instruction),
+		uint16(f.instruction>>16)<<12 | f.opcode&0x7FF,
+		uint16(f.operand),
+		uint16(f.operand>>16) << 12,
+	} {
+		env = binary.LittleEndian.AppendUint16(env, word)
+	}
+	return env
+}
+
+func (f *FPU) loadEnvironment(env []byte) {
+	word := func(i int) uint16 { return binary.LittleEndian.Uint16(env[2*i:]) }
+	f.control, f.status, f.tag = word(0), word(1), word(2)
+	f.instruction = int(word(3)) | int(word(4)>>12)<<16
+	f.opcode = word(4) & 0x7FF
+	f.operand = int(word(5)) | int(word(6)>>12)<<16
+}
+
+// =================
+// ===== STACK =====
+// =================
+
+func (f *FPU) top() int {
+	return int(f.status>>fpuTopShift) & 7
+}
+
+func (f *FPU) setTop(top int) {
+	f.status = f.status&^(7<<fpuTopShift) | uint16(top&7)<<fpuTopShift
+}
+
+// Physical register of ST(i)
+func (f *FPU) physical(i int) int {
+	return (f.top() + i) & 7
+}
+
+func (f *FPU) getTag(p int) int {
+	return int(f.tag>>(2*p)) & 0b11
+}
+
+func (f *FPU) setTag(p int, tag int) {
+	f.tag = f.tag&^(0b11<<(2*p)) | uint16(tag)<<(2*p)
+}
+
+// Read ST(i), an empty register is a stack underflow
+func (f *FPU) get(i int) extended {
+	p := f.physical(i)
+	if f.getTag(p) == fpuTagEmpty {
+		f.raise(fpuInvalid)
+		return indefinite
+	}
+	return f.registers[p]
+}
+
+func (f *FPU) set(i int, value extended) {
+	p := f.physical(i)
+	if !f.changed[p] {
+		f.changed[p] = true
+		f.before[p] = f.describe(p)
+	}
+	f.registers[p] = value
+	f.setTag(p, value.tag())
+}
+
+// Pushing on a full stack is a stack overflow
+func (f *FPU) push(value extended) {
+	f.setTop(f.top() - 1)
+	if f.getTag(f.physical(0)) != fpuTagEmpty {
+		f.raise(fpuInvalid)
+		value = indefinite
+	}
+	f.set(0, value)
+}
+
+func (f *FPU) pop() {
+	f.setTag(f.physical(0), fpuTagEmpty)
+	fmt.Fprintf(f.trace, "[pop %s] ", f.registers[f.physical(0)])
+	f.setTop(f.top() + 1)
+}
+
+// Value of a physical register for the trace
+func (f *FPU) describe(p int) string {
+	if f.getTag(p) == fpuTagEmpty {
+		return "empty"
+	}
+	return f.registers[p].String()
+}
+
+// ======================
+// ===== EXCEPTIONS =====
+// ======================
+
+func (f *FPU) raise(exception uint16) {
+	f.status |= exception
+	if f.control&exception == 0 && f.control&fpuInterruptMask == 0 {
+		f.status |= fpuInterruptRequest
+	}
+}
+
+func (f *FPU) setConditions(c3 int, c2 int, c1 int, c0 int) {
+	f.status &^= fpuC3 | fpuC2 | fpuC1 | fpuC0
+	f.status |= uint16(c3)*fpuC3 | uint16(c2)*fpuC2 | uint16(c1)*fpuC1 | uint16(c0)*fpuC0
+}
+
+// Compare a to b: C3 for equal, C0 for less and all of them when one is NaN
+func (f *FPU) compare(a extended, b extended) {
+	if a.isNaN() || b.isNaN() {
+		f.raise(fpuInvalid)
+		f.setConditions(1, 1, 0, 1)
+		return
+	}
+	switch a.big().Cmp(b.big()) {
+	case -1:
+		f.setConditions(0, 0, 0, 1)
+	case 0:
+		f.setConditions(1, 0, 0, 0)
+	case 1:
+		f.setConditions(0, 0, 0, 0)
+	}
+}
+
+// ======================
+// ===== ARITHMETIC =====
+// ======================
+
+// Precision control of the control word, 24 53 or 64 bits
+func (f *FPU) precision() uint {
+	switch f.control >> 8 & 0b11 {
+	case 0b00:
+		return 24
+	case 0b10:
+		return 53
+	}
+	return 64
+}
+
+func (f *FPU) roundingMode() big.RoundingMode {
+	return []big.RoundingMode{big.ToNearestEven, big.ToNegativeInf, big.ToPositiveInf, big.ToZero}[f.control>>10&0b11]
+}
+
+// Compute an operation with the precision and the rounding of the control
+// word. A NaN operand give a NaN, like an invalid operation.
+func (f *FPU) calculate(operation func(z *big.Float, x []*big.Float), operands ...extended) (result extended) {
+	for _, x := range operands {
+		if x.isNaN() {
+			x.significand |= 1 << 62 // Quiet
+			return x
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(big.ErrNaN); !ok {
+				panic(r)
+			}
+			f.raise(fpuInvalid)
+			result = indefinite
+		}
+	}()
+
+	x := make([]*big.Float, len(operands))
+	for i, operand := range operands {
+		x[i] = operand.big()
+	}
+	z := new(big.Float).SetPrec(f.precision()).SetMode(f.roundingMode())
+	operation(z, x)
+	return f.round(z)
+}
+
+// Convert to the extended format with the precision and the rounding of the
+// control word.
+func (f *FPU) round(x *big.Float) extended {
+	sign := uint16(0)
+	if x.Signbit() {
+		sign = 0x8000
+	}
+	if x.IsInf() {
+		return extended{sign | 0x7FFF, 1 << 63}
+	}
+
+	r := new(big.Float).SetPrec(f.precision()).SetMode(f.roundingMode()).Set(x)
+	if x.Acc() != big.Exact || r.Acc() != big.Exact {
+		f.raise(fpuPrecision)
+	}
+	if r.Sign() == 0 {
+		return extended{sign, 0}
+	}
+
+	mant := new(big.Float)
+	exp := r.MantExp(mant)
+	mant.Abs(mant)
+	biased := exp - 1 + 16383
+	if biased >= 0x7FFF {
+		f.raise(fpuOverflow | fpuPrecision)
+		return extended{sign | 0x7FFF, 1 << 63}
+	}
+	if biased <= 0 {
+		// Denormal, the significand is shifted right and lose bits
+		f.raise(fpuUnderflow)
+		significand, _ := mant.SetMantExp(mant, exp+16382+63).Uint64()
+		return extended{sign, significand}
+	}
+	significand, _ := mant.SetMantExp(mant, 64).Uint64()
+	return extended{sign | uint16(biased), significand}
+}
+
+// Round to an integer with the given mode
+func roundToInteger(x *big.Float, mode big.RoundingMode) *big.Float {
+	if x.IsInf() || x.IsInt() {
+		return x
+	}
+	exp := x.MantExp(nil)
+	if exp > 0 {
+		// Keeping exp bits leave only the integer part
+		return new(big.Float).SetPrec(uint(exp)).SetMode(mode).Set(x)
+	}
+
+	// |x| < 1
+	one := big.NewFloat(1)
+	if x.Signbit() {
+		one.Neg(one)
+	}
+	half := new(big.Float).Abs(x).Cmp(big.NewFloat(0.5))
+	up := false
+	switch mode {
+	case big.ToNearestEven:
+		up = half > 0
+	case big.ToNegativeInf:
+		up = x.Signbit()
+	case big.ToPositiveInf:
+		up = !x.Signbit()
+	}
+	if up {
+		return one
+	}
+	zero := new(big.Float)
+	if x.Signbit() {
+		zero.Neg(zero)
+	}
+	return zero
+}
+
+// ======================
+// ===== CONVERSION =====
+// ======================
+
+// Load the memory operand, a real of 4 8 or 10 bytes or an integer of 2 4 or
+// 8 bytes.
+func (f *FPU) loadMemory(o *fpuOperands, integer bool) extended {
+	data := o.read(o.size)
+	if integer {
+		value := int64(0)
+		switch o.size {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(data))
+		}
+		return f.round(new(big.Float).SetInt64(value))
+	}
+
+	switch o.size {
+	case 4:
+		bits := binary.LittleEndian.Uint32(data)
+		value := math.Float32frombits(bits)
+		if value != value {
+			// Keep the payload of NaN
+			return extended{uint16(bits>>31)<<15 | 0x7FFF, 1<<63 | uint64(bits&0x7FFFFF)<<40}
+		}
+		return f.round(big.NewFloat(float64(value)))
+	case 8:
+		return f.fromFloat64(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+	}
+	return extendedFromBytes(data)
+}
+
+// Store ST0 in the memory operand, with the rounding of the control word
+func (f *FPU) storeMemory(o *fpuOperands, value extended, integer bool) {
+	if integer {
+		bits := o.size * 8
+		result := int64(-1) << (bits - 1) // Integer indefinite
+		if !value.isNaN() && !value.isInf() {
+			rounded := roundToInteger(value.big(), f.roundingMode())
+			if rounded.Cmp(value.big()) != 0 {
+				f.raise(fpuPrecision)
+			}
+			n, accuracy := rounded.Int64()
+			if accuracy == big.Exact && (bits == 64 || n >= -1<<(bits-1) && n < 1<<(bits-1)) {
+				result = n
+			} else {
+				f.raise(fpuInvalid)
+			}
+		} else {
+			f.raise(fpuInvalid)
+		}
+		o.write(binary.LittleEndian.AppendUint64(nil, uint64(result))[:o.size])
+		return
+	}
+
+	switch o.size {
+	case 4:
+		o.write(binary.LittleEndian.AppendUint32(nil, math.Float32bits(float32(f.toFloat(value, 24)))))
+	case 8:
+		o.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(f.toFloat(value, 53))))
+	default:
+		o.write(value.bytes())
+	}
+}
+
+func (f *FPU) fromFloat64(value float64) extended {
+	if value != value {
+		bits := math.Float64bits(value)
+		return extended{uint16(bits>>63)<<15 | 0x7FFF, 1<<63 | bits<<11}
+	}
+	return f.round(big.NewFloat(value))
+}
+
+// Round to a float of the given precision, 24 bits for a float32 which is
+// exact in a float64.
+func (f *FPU) toFloat(value extended, precision uint) float64 {
+	if value.isNaN() {
+		bits := uint64(value.signExponent>>15)<<63 | 0x7FF<<52 | value.significand<<1>>12
+		return math.Float64frombits(bits)
+	}
+	r := new(big.Float).SetPrec(precision).SetMode(f.roundingMode()).Set(value.big())
+	if r.Acc() != big.Exact {
+		f.raise(fpuPrecision)
+	}
+	result, _ := r.Float64()
+	limit := math.MaxFloat64
+	if precision == 24 {
+		limit = math.MaxFloat32
+	}
+	if !value.isInf() && math.Abs(result) > limit {
+		f.raise(fpuOverflow)
+		result = math.Copysign(math.Inf(1), result)
+	}
+	return result
+}
+
+// Packed decimal of FBLD: 18 digits, 2 per byte, and the sign in the last
+// byte.
+func (f *FPU) fromBCD(data []byte) extended {
+	value := int64(0)
+	for i := 8; i >= 0; i-- {
+		value = value*100 + int64(data[i]>>4)*10 + int64(data[i]&0xF)
+	}
+	result := f.round(new(big.Float).SetInt64(value))
+	if data[9]&0x80 != 0 {
+		result.signExponent |= 0x8000
+	}
+	return result
+}
+
+func (f *FPU) toBCD(value extended) []byte {
+	data := make([]byte, 10)
+	rounded := roundToInteger(value.big(), f.roundingMode())
+	n, accuracy := new(big.Float).Abs(rounded).Int64()
+	if value.isNaN() || value.isInf() || accuracy != big.Exact || n >= 1e18 {
+		f.raise(fpuInvalid)
+		data[7], data[8], data[9] = 0xC0, 0xFF, 0xFF // Decimal indefinite
+		return data
+	}
+	for i := 0; i < 9; i++ {
+		data[i] = byte(n%10) | byte(n/10%10)<<4
+		n /= 100
+	}
+	if value.negative() {
+		data[9] = 0x80
+	}
+	return data
+}
+
+func extendedFromBytes(data []byte) extended {
+	return extended{binary.LittleEndian.Uint16(data[8:]), binary.LittleEndian.Uint64(data)}
+}
+
+func (x extended) bytes() []byte {
+	return binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint64(nil, x.significand), x.signExponent)
+}
+
+func (x extended) negative() bool {
+	return x.signExponent>>15 == 1
+}
+
+func (x extended) isNaN() bool {
+	return x.signExponent&0x7FFF == 0x7FFF && x.significand<<1 != 0
+}
+
+func (x extended) isInf() bool {
+	return x.signExponent&0x7FFF == 0x7FFF && x.significand<<1 == 0
+}
+
+func (x extended) isZero() bool {
+	return x.signExponent&0x7FFF == 0 && x.significand == 0
+}
+
+func (x extended) tag() int {
+	switch {
+	case x.isZero():
+		return fpuTagZero
+	case x.signExponent&0x7FFF == 0x7FFF, x.signExponent&0x7FFF == 0, x.significand>>63 == 0:
+		return fpuTagSpecial
+	}
+	return fpuTagValid
+}
+
+// Exact value, NaN cannot be represented
+func (x extended) big() *big.Float {
+	f := new(big.Float).SetPrec(64)
+	if x.isInf() {
+		return f.SetInf(x.negative())
+	}
+	exponent := int(x.signExponent&0x7FFF) - 16383 - 63
+	if x.signExponent&0x7FFF == 0 {
+		exponent++ // Denormals have the exponent of the smallest normal
+	}
+	f.SetUint64(x.significand)
+	f.SetMantExp(f, exponent)
+	if x.negative() {
+		f.Neg(f)
+	}
+	return f
+}
+
+// Signed integer significand and exponent of a finite value
+func (x extended) integer() (*big.Int, int) {
+	exponent := int(x.signExponent&0x7FFF) - 16383 - 63
+	if x.signExponent&0x7FFF == 0 {
+		exponent++
+	}
+	return new(big.Int).SetUint64(x.significand), exponent
+}
+
+func (x extended) float64() float64 {
+	if x.isNaN() {
+		return math.NaN()
+	}
+	value, _ := x.big().Float64()
+	return value
+}
+
+func (x extended) String() string {
+	switch {
+	case x.isNaN():
+		return "nan"
+	case x.isInf() && x.negative():
+		return "-inf"
+	case x.isInf():
+		return "+inf"
+	}
+	return x.big().Text('g', -1)
+}
+
+// Part of the state that decide what the 8087 will do next, the zero value
+// without 8087.
+type fpuState struct {
+	registers [8]extended
+	control   uint16
+	status    uint16
+	tag       uint16
+}
+
+func (f *FPU) state() fpuState {
+	if f == nil {
+		return fpuState{}
+	}
+	return fpuState{f.registers, f.control, f.status, f.tag}
+}
+
+// Print the stack and the control words for the final state
+func (f *FPU) Print(out io.Writer) {
+	tags := []string{"valid", "zero", "special", "empty"}
+	for i := 0; i < 8; i++ {
+		p := f.physical(i)
+		fmt.Fprintf(out, "  st%d  %-7s 0x%04x%016x  %s\n", i, tags[f.getTag(p)], f.registers[p].signExponent, f.registers[p].significand, f.describe(p))
+	}
+	fmt.Fprintf(out, "  control 0x%04x  status 0x%04x  tag 0x%04x\n", f.control, f.status, f.tag)
+}
+
+// ==================
+// ===== TABLES =====
+// ==================
+
+var fpuOperations = map[string]func(*FPU, *fpuOperands){}
+
+func init() {
+	groups := map[string]func(*FPU, *fpuOperands, string){
+		"fadd fsub fsubr fmul fdiv fdivr faddp fsubp fsubrp fmulp fdivp fdivrp " +
+			"fiadd fisub fisubr fimul fidiv fidivr": fpuArithmetic,
+		"fcom fcomp fcompp ficom ficomp ftst":         fpuCompare,
+		"fld fild fbld":                               fpuLoad,
+		"fst fstp fist fistp fbstp":                   fpuStore,
+		"fld1 fldz fldpi fldl2t fldl2e fldlg2 fldln2": fpuConstant,
+		"fxch":                             fpuExchange,
+		"ffree":                            fpuFree,
+		"fchs fabs fsqrt frndint":          fpuUnary,
+		"fscale":                           fpuScale,
+		"fxtract":                          fpuExtract,
+		"fprem":                            fpuRemainder,
+		"f2xm1 fptan fpatan fyl2x fyl2xp1": fpuTranscendental,
+		"fxam":                             fpuExamine,
+		"fincstp fdecstp":                  fpuStack,
+		"fnop":                             fpuNop,
+		"fninit fnclex fneni fndisi fldcw fnstcw fnstsw " +
+			"fldenv fnstenv frstor fnsave": fpuControl,
+	}
+	for operators, operation := range groups {
+		for _, operator := range strings.Fields(operators) {
+			operation, operator := operation, operator
+			fpuOperations[operator] = func(f *FPU, o *fpuOperands) { operation(f, o, operator) }
+			executors[operator] = esc
+		}
+	}
+}
+
+var fpuOperandSizes = map[string]int{
+	"word":  2,
+	"dword": 4,
+	"qword": 8,
+	"tword": 10,
+}
+
+// Cycles the 8087 is busy, reference 8087 Instruction Set Summary (typical
+// values).
+var fpuCycles = map[string]int{
+	"fadd": 85, "fsub": 85, "fsubr": 87, "fmul": 130, "fdiv": 198, "fdivr": 199,
+	"faddp": 90, "fsubp": 90, "fsubrp": 90, "fmulp": 134, "fdivp": 202, "fdivrp": 203,
+	"fiadd": 120, "fisub": 120, "fisubr": 120, "fimul": 130, "fidiv": 230, "fidivr": 230,
+	"fcom": 45, "fcomp": 47, "fcompp": 50, "ficom": 80, "ficomp": 82, "ftst": 42,
+	"fld": 50, "fild": 50, "fbld": 300, "fst": 100, "fstp": 100, "fist": 85, "fistp": 88, "fbstp": 530,
+	"fld1": 18, "fldz": 14, "fldpi": 19, "fldl2t": 19, "fldl2e": 18, "fldlg2": 21, "fldln2": 20,
+	"fxch": 12, "ffree": 11, "fchs": 15, "fabs": 14, "fsqrt": 183, "frndint": 45,
+	"fscale": 35, "fxtract": 50, "fprem": 125, "f2xm1": 500, "fptan": 450, "fpatan": 650,
+	"fyl2x": 950, "fyl2xp1": 850, "fxam": 17, "fincstp": 9, "fdecstp": 9, "fnop": 13,
+	"fninit": 5, "fnclex": 5, "fneni": 5, "fndisi": 5, "fldcw": 10, "fnstcw": 15, "fnstsw": 15,
+	"fldenv": 45, "fnstenv": 45, "frstor": 210, "fnsave": 210,
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+// A storage with an 8087, the memory operands are written as `qword [256]`
+// and are in DS which is 0
+func newFPUStorage() *Storage {
+	store := NewStorage(io.Discard)
+	store.fpu = NewFPU()
+	store.fpu.trace = io.Discard
+	return store
+}
+
+// Execute 8087 instructions written like the decoder print them
+func executeFPU(store *Storage, sources ...string) {
+	for _, source := range sources {
+		operator, operands, _ := strings.Cut(source, " ")
+		left, right, _ := strings.Cut(operands, ", ")
+		store.fpu.execute(store, Instruction{operator, left, right, 1, 2, nil, ""}, 0)
+	}
+}
+
+// 1/3 with each precision and rounding mode of the control word
+func TestFPURounding(t *testing.T) {
+	tests := []struct {
+		control  uint16
+		dividend string
+		expected extended
+	}{
+		{0x033F, "fld1", extended{0x3FFD, 0xAAAAAAAAAAAAAAAB}}, // 64 bits to nearest
+		{0x073F, "fld1", extended{0x3FFD, 0xAAAAAAAAAAAAAAAA}}, // 64 bits down
+		{0x0B3F, "fld1", extended{0x3FFD, 0xAAAAAAAAAAAAAAAB}}, // 64 bits up
+		{0x0F3F, "fld1", extended{0x3FFD, 0xAAAAAAAAAAAAAAAA}}, // 64 bits toward zero
+		{0x023F, "fld1", extended{0x3FFD, 0xAAAAAAAAAAAAA800}}, // 53 bits to nearest
+		{0x0A3F, "fld1", extended{0x3FFD, 0xAAAAAAAAAAAAB000}}, // 53 bits up
+		{0x003F, "fld1", extended{0x3FFD, 0xAAAAAB0000000000}}, // 24 bits to nearest
+		{0x0C3F, "fld1", extended{0x3FFD, 0xAAAAAA0000000000}}, // 24 bits toward zero
+		{0x073F, "fchs", extended{0xBFFD, 0xAAAAAAAAAAAAAAAB}}, // -1/3 down
+		{0x0B3F, "fchs", extended{0xBFFD, 0xAAAAAAAAAAAAAAAA}}, // -1/3 up
+	}
+	for _, test := range tests {
+		store := newFPUStorage()
+		store.fpu.control = test.control
+		store.writeMemoryAt(256, 256, []byte{3, 0})
+		executeFPU(store, "fld1")
+		if test.dividend == "fchs" {
+			executeFPU(store, "fchs")
+		}
+		executeFPU(store, "fidiv word [256]")
+
+		result := store.fpu.get(0)
+		if result != test.expected {
+			t.Errorf("control 0x%04x %s: 0x%04x%016x, expected 0x%04x%016x", test.control, test.dividend, result.signExponent, result.significand, test.expected.signExponent, test.expected.significand)
+		}
+		if store.fpu.status&fpuPrecision == 0 {
+			t.Errorf("control 0x%04x %s: precision exception not raised", test.control, test.dividend)
+		}
+	}
+}
+
+// FPREM of ST0 by ST1, the 3 low bits of the quotient are in C0 C3 C1
+func TestFPURemainder(t *testing.T) {
+	tests := []struct {
+		a, b      float64
+		remainder float64
+		status    uint16
+	}{
+		{10, 3, 1, fpuC3 | fpuC1},         // quotient 3
+		{23, 3, 2, fpuC0 | fpuC3 | fpuC1}, // quotient 7
+		{-10, 3, -1, fpuC3 | fpuC1},       // quotient 3
+		{13, 3, 1, fpuC0},                 // quotient 4
+		{2, 3, 2, 0},                      // quotient 0
+		{5.5, 2, 1.5, fpuC3},              // quotient 2
+		{math.Ldexp(1, 100), 3, 0, fpuC2}, // partial, the remainder is not checked
+		{math.Ldexp(1, 60), 1, 0, 0},      // quotient 2^60
+	}
+	for _, test := range tests {
+		store := newFPUStorage()
+		f := store.fpu
+		f.push(f.fromFloat64(test.b))
+		f.push(f.fromFloat64(test.a))
+		executeFPU(store, "fprem")
+
+		conditions := f.status & (fpuC0 | fpuC1 | fpuC2 | fpuC3)
+		if conditions != test.status {
+			t.Errorf("%g fprem %g: conditions 0x%04x, expected 0x%04x", test.a, test.b, conditions, test.status)
+		}
+		if test.status&fpuC2 == 0 && f.get(0).float64() != test.remainder {
+			t.Errorf("%g fprem %g: remainder %s, expected %g", test.a, test.b, f.get(0), test.remainder)
+		}
+	}
+
+	// The program loop until C2 is clear
+	store := newFPUStorage()
+	f := store.fpu
+	f.push(f.fromFloat64(3))
+	f.push(f.fromFloat64(math.Ldexp(1, 100)))
+	for n := 0; f.status&fpuC2 != 0 || n == 0; n++ {
+		if n == 10 {
+			t.Fatalf("fprem still partial after %d iterations", n)
+		}
+		executeFPU(store, "fprem")
+	}
+	if remainder := f.get(0).float64(); remainder != 1 { // 2^100 = 1 mod 3
+		t.Errorf("2^100 fprem 3: remainder %g, expected 1", remainder)
+	}
+}
+
+// FBLD then FBSTP of a packed decimal, and the values that do not fit
+func TestFPUPackedDecimal(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    []byte // Loaded with FBLD, or ST0 is value when nil
+		st0      float64
+		expected []byte
+		invalid  bool
+	}{
+		{"positive", []byte{0x90, 0x78, 0x56, 0x34, 0x12, 0, 0, 0, 0, 0}, 1234567890, nil, false},
+		{"negative", []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x80}, -1, nil, false},
+		{"18 digits", []byte{0x99, 0x99, 0x99, 0x99, 0x99, 0x99, 0x99, 0x99, 0x99, 0}, 999999999999999999, nil, false},
+		{"rounded to even", nil, 2.5, []byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{"too large", nil, 1e18, []byte{0, 0, 0, 0, 0, 0, 0, 0xC0, 0xFF, 0xFF}, true},
+		{"infinity", nil, math.Inf(-1), []byte{0, 0, 0, 0, 0, 0, 0, 0xC0, 0xFF, 0xFF}, true},
+	}
+	for _, test := range tests {
+		store := newFPUStorage()
+		f := store.fpu
+		if test.value != nil {
+			store.writeMemoryAt(256, 256, test.value)
+			executeFPU(store, "fbld tword [256]")
+			if value := f.get(0).float64(); value != test.st0 {
+				t.Errorf("%s: fbld loaded %g, expected %g", test.name, value, test.st0)
+			}
+			test.expected = test.value
+		} else {
+			f.push(f.fromFloat64(test.st0))
+		}
+
+		executeFPU(store, "fbstp tword [512]")
+		stored := store.readMemoryAt(512, 10)
+		if !bytes.Equal(stored, test.expected) {
+			t.Errorf("%s: fbstp stored % x, expected % x", test.name, stored, test.expected)
+		}
+		if invalid := f.status&fpuInvalid != 0; invalid != test.invalid {
+			t.Errorf("%s: invalid %t, expected %t", test.name, invalid, test.invalid)
+		}
+		if f.getTag(f.physical(-1)) != fpuTagEmpty {
+			t.Errorf("%s: fbstp did not pop", test.name)
+		}
+	}
+}
+
+// Real mode FSTENV: the 20 bits addresses are split with their high nibble
+// in the top of the next word, next to the opcode.
+func TestFPUEnvironment(t *testing.T) {
+	store := newFPUStorage()
+	store.setRegister("ds", 0x2000)
+	store.writeMemoryAt(0x12345, 0x2345, []byte{0xDD, 0x06, 0x00, 0x01}) // fld qword [256]
+	store.writeMemoryAt(0x20100, 0x0100, binary.LittleEndian.AppendUint64(nil, math.Float64bits(1.5)))
+	store.fpu.execute(store, Instruction{"fld", "qword [256]", "", 1, 4, nil, ""}, 0x12345)
+	executeFPU(store, "fnstenv [512]")
+
+	env := store.readMemoryAt(0x20200, 14)
+	expected := []uint16{
+		0x03FF,                 // Control word of FNINIT
+		7 << fpuTopShift,       // TOP is 7 after one push
+		0xFFFF&^(0b11<<14) | 0, // ST0 is the physical register 7, valid
+		0x2345,                 // Instruction address
+		0x1<<12 | 0x506,        // Its high nibble and the opcode without ESC
+		0x0100,                 // Operand address
+		0x2 << 12,              // Its high nibble
+	}
+	for n, word := range expected {
+		if got := binary.LittleEndian.Uint16(env[2*n:]); got != word {
+			t.Errorf("fstenv word %d: 0x%04x, expected 0x%04x", n, got, word)
+		}
+	}
+
+	// FLDENV give the same state back
+	other := newFPUStorage()
+	other.setRegister("ds", 0x2000)
+	other.writeMemoryAt(0x20200, 0x0200, env)
+	executeFPU(other, "fldenv [512]")
+	if other.fpu.control != store.fpu.control || other.fpu.status != store.fpu.status || other.fpu.tag != store.fpu.tag ||
+		other.fpu.instruction != 0x12345 || other.fpu.opcode != 0x506 || other.fpu.operand != 0x20100 {
+		t.Errorf("fldenv: %+v, expected %+v", other.fpu.state(), store.fpu.state())
+	}
+}
+
+// Pushing on a full stack and reading an empty register are invalid
+// operations, the masked response is the indefinite NaN.
+func TestFPUStackFaults(t *testing.T) {
+	store := newFPUStorage()
+	f := store.fpu
+	for n := 0; n < 8; n++ {
+		executeFPU(store, "fld1")
+	}
+	if f.status&fpuInvalid != 0 {
+		t.Fatalf("8 pushes raised invalid, status 0x%04x", f.status)
+	}
+	executeFPU(store, "fldz")
+	if f.status&fpuInvalid == 0 || f.get(0) != indefinite {
+		t.Errorf("overflow: status 0x%04x st0 %s, expected invalid and nan", f.status, f.get(0))
+	}
+
+	store = newFPUStorage()
+	f = store.fpu
+	executeFPU(store, "fld1", "fadd st0, st1")
+	if f.status&fpuInvalid == 0 || f.get(0) != indefinite {
+		t.Errorf("underflow: status 0x%04x st0 %s, expected invalid and nan", f.status, f.get(0))
+	}
+
+	// Unmasked, the interrupt request is set
+	store = newFPUStorage()
+	f = store.fpu
+	f.control &^= fpuInvalid | fpuInterruptMask
+	executeFPU(store, "fsqrt")
+	if f.status&(fpuInvalid|fpuInterruptRequest) != fpuInvalid|fpuInterruptRequest {
+		t.Errorf("unmasked underflow: status 0x%04x, expected an interrupt request", f.status)
+	}
+}
+
+// FWAIT wait for the cycles left of the 8087 instruction
+func TestFPUWait(t *testing.T) {
+	tests := []struct {
+		cycles   int // When FWAIT execute, the FSQRT started at 1000
+		expected int
+		trace    string
+	}{
+		{1000, 1183, "[wait 183] "},
+		{1100, 1183, "[wait 83] "},
+		{1183, 1183, ""},
+		{2000, 2000, ""},
+	}
+	for _, test := range tests {
+		store := newFPUStorage()
+		trace := &bytes.Buffer{}
+		store.trace = trace
+		store.fpu.push(fpuConstants["fld1"])
+		store.cycles = 1000
+		executeFPU(store, "fsqrt")
+		trace.Reset()
+
+		store.cycles = test.cycles
+		fwait(store, Instruction{})
+		if store.cycles != test.expected || trace.String() != test.trace {
+			t.Errorf("fwait at %d: %d cycles %q, expected %d %q", test.cycles, store.cycles, trace, test.expected, test.trace)
+		}
+	}
+
+	// Without 8087 FWAIT does nothing
+	store := NewStorage(io.Discard)
+	fwait(store, Instruction{})
+	if store.cycles != 0 {
+		t.Errorf("fwait without 8087: %d cycles", store.cycles)
+	}
+
+	// An instruction sent while the 8087 is busy is marked
+	store = newFPUStorage()
+	trace := &bytes.Buffer{}
+	store.trace = trace
+	executeFPU(store, "fld1", "fldpi")
+	if !strings.Contains(trace.String(), "[8087 busy]") {
+		t.Errorf("no busy mark in %q", trace)
+	}
+}
+
+// fld1, fldpi, fadd, fstp qword then fild and fsqrt
+func TestFPUProgram(t *testing.T) {
+	store := newFPUStorage()
+	store.writeMemoryAt(264, 264, []byte{2, 0})
+	executeFPU(store,
+		"fld1",
+		"fldpi",
+		"fadd st0, st1",
+		"fstp qword [256]",
+		"fild word [264]",
+		"fsqrt",
+	)
+	f := store.fpu
+
+	stored := math.Float64frombits(binary.LittleEndian.Uint64(store.readMemoryAt(256, 8)))
+	if stored != math.Pi+1 {
+		t.Errorf("fstp stored %v, expected %v", stored, math.Pi+1)
+	}
+	if f.top() != 6 {
+		t.Errorf("top %d, expected 6", f.top())
+	}
+	if st0, expected := f.get(0), (extended{0x3FFF, 0xB504F333F9DE6484}); st0 != expected {
+		t.Errorf("st0 0x%04x%016x, expected 0x%04x%016x (sqrt 2)", st0.signExponent, st0.significand, expected.signExponent, expected.significand)
+	}
+	if st1, expected := f.get(1), (extended{0x3FFF, 0x8000000000000000}); st1 != expected {
+		t.Errorf("st1 %s, expected 1", st1)
+	}
+	if f.status&0x3F != fpuPrecision {
+		t.Errorf("exceptions 0x%02x, expected only precision", f.status&0x3F)
+	}
+}
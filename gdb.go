@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Serve the simulated CPU over the GDB Remote Serial Protocol until the
+// debugger detach or kill the program.
+//
+// GDB has no 8086 target so registers are exposed like on a i386: eax, ecx,
+// edx, ebx, esp, ebp, esi, edi, eip, eflags, cs, ss, ds, es, fs, gs, each 32
+// bits wide with the upper half always zero. fs and gs do not exist on the
+// 8086 and are always zero. Addresses are physical everywhere: eip is CS:IP
+// as a linear address like memory packets and breakpoints. Setting eip keep
+// CS when the address is in the code segment.
+//
+//	gdb -ex "set architecture i8086" -ex "target remote :1234"
+func ServeGDB(store *Storage, address string) error {
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	fmt.Fprintf(store.trace, "Waiting for GDB on %s\n", listener.Addr())
+
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return serveGDBConnection(store, conn)
+}
+
+// Serve a debugger already connected, the connection is not closed
+func serveGDBConnection(store *Storage, conn io.ReadWriter) error {
+	session := gdbSession{
+		debugger:   NewDebugger(store),
+		conn:       conn,
+		packets:    make(chan string),
+		interrupts: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		ack:        true,
+	}
+	defer close(session.done)
+	go session.receive(bufio.NewReader(conn))
+	return session.serve()
+}
+
+type gdbSession struct {
+	debugger   *Debugger
+	conn       io.Writer
+	packets    chan string
+	interrupts chan struct{}
+	done       chan struct{} // Closed when the session is over, nobody read the packets
+	ack        bool
+	exited     bool
+}
+
+// Read packets from GDB, interruptions (Ctrl-C) are sent out of band so that
+// they can stop a running program. It stop when the connection is closed or
+// at the first packet after the end of the session.
+func (s *gdbSession) receive(reader *bufio.Reader) {
+	defer close(s.packets)
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case 0x03:
+			select {
+			case s.interrupts <- struct{}{}:
+			default:
+			}
+		case '$':
+			data, err := reader.ReadString('#')
+			if err != nil {
+				return
+			}
+			checksum := make([]byte, 2)
+			if _, err := io.ReadFull(reader, checksum); err != nil {
+				return
+			}
+			select {
+			case s.packets <- strings.TrimSuffix(data, "#"):
+			case <-s.done:
+				return
+			}
+		}
+		// Acknowledgments from GDB ('+' and '-') are ignored, we are on a
+		// reliable transport.
+	}
+}
+
+func (s *gdbSession) serve() error {
+	for packet := range s.packets {
+		if s.ack {
+			if _, err := io.WriteString(s.conn, "+"); err != nil {
+				return err
+			}
+		}
+
+		reply, done := s.handle(packet)
+		if err := s.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *gdbSession) send(data string) error {
+	checksum := byte(0)
+	for i := 0; i < len(data); i++ {
+		checksum += data[i]
+	}
+	_, err := fmt.Fprintf(s.conn, "$%s#%02x", data, checksum)
+	return err
+}
+
+// Handle a packet and return the reply, done is true when the session is over.
+func (s *gdbSession) handle(packet string) (reply string, done bool) {
+	if packet == "" {
+		return "", false
+	}
+	d := s.debugger
+	command, args := packet[0], packet[1:]
+
+	switch command {
+	case '?':
+		if s.exited {
+			return "W00", false
+		}
+		return "S05", false
+
+	case 'q':
+		switch {
+		case strings.HasPrefix(args, "Supported"):
+			return "PacketSize=4000;swbreak+;hwbreak+;QStartNoAckMode+;ReverseStep+;ReverseContinue+", false
+		case strings.HasPrefix(args, "Rcmd,"):
+			command, err := hex.DecodeString(args[len("Rcmd,"):])
+			if err != nil {
+				return "E01", false
+			}
+			if err := s.send("O" + hex.EncodeToString([]byte(s.monitor(string(command))))); err != nil {
+				return "E01", false
+			}
+			return "OK", false
+		case args == "Attached":
+			return "1", false
+		case args == "C":
+			return "QC1", false
+		case args == "fThreadInfo":
+			return "m1", false
+		case args == "sThreadInfo":
+			return "l", false
+		}
+		return "", false
+
+	case 'Q':
+		if args == "StartNoAckMode" {
+			s.ack = false
+			return "OK", false
+		}
+		return "", false
+
+	case 'H', 'T':
+		return "OK", false
+
+	case 'g':
+		reply := ""
+		for n := range gdbRegisters {
+			reply += s.readRegister(n)
+		}
+		return reply, false
+
+	case 'G':
+		for n := range gdbRegisters {
+			if len(args) < 8*(n+1) {
+				return "E01", false
+			}
+			if !s.writeRegister(n, args[8*n:8*(n+1)]) {
+				return "E01", false
+			}
+		}
+		return "OK", false
+
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || int(n) >= len(gdbRegisters) {
+			return "E01", false
+		}
+		return s.readRegister(int(n)), false
+
+	case 'P':
+		reg, value, _ := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(reg, 16, 8)
+		if err != nil || int(n) >= len(gdbRegisters) || !s.writeRegister(int(n), value) {
+			return "E01", false
+		}
+		return "OK", false
+
+	case 'm':
+		address, length, ok := parseAddressLength(args)
+		if !ok {
+			return "E01", false
+		}
+		length = min(length, 0x1000) // Must fit in PacketSize once in hex
+		return hex.EncodeToString(d.store.readMemory(address, length)), false
+
+	case 'M':
+		location, data, _ := strings.Cut(args, ":")
+		address, length, ok := parseAddressLength(location)
+		content, err := hex.DecodeString(data)
+		if !ok || err != nil || len(content) != length {
+			return "E01", false
+		}
+		// Like an instruction so that ROM is not written, but it is not
+		// undone by stepping back
+		d.store.withoutHistory(func() {
+			d.store.writeMemoryAt(address, uint16(address-int(d.store.getRegister("ds"))<<4), content)
+		})
+		return "OK", false
+
+	case 's', 'c':
+		if s.exited {
+			return "W00", false
+		}
+		if args != "" {
+			address, err := strconv.ParseUint(args, 16, 32)
+			if err != nil {
+				return "E01", false
+			}
+			s.setPC(int(address) & 0xFFFFF)
+		}
+		if command == 's' {
+			return s.stopReply(d.Step()), false
+		}
+		return s.stopReply(d.Continue(s.interrupted)), false
+
+	case 'b':
+		// Going backward is possible even after the end of the program
+		s.exited = false
+		switch args {
+		case "s":
+			return s.stopReply(d.StepBack()), false
+		case "c":
+			return s.stopReply(d.ReverseContinue(s.interrupted)), false
+		}
+		return "", false
+
+	case 'Z', 'z':
+		kind, location, _ := strings.Cut(args, ",")
+		address, length, ok := parseAddressLength(location)
+		if !ok {
+			return "E01", false
+		}
+		switch kind {
+		case "0", "1": // Software and hardware breakpoints are the same for us
+			if command == 'Z' {
+				d.addBreakpoint(address, nil)
+			} else {
+				d.removeBreakpoint(address)
+			}
+		case "2", "3", "4":
+			watch := map[string]int{"2": watchWrite, "3": watchRead, "4": watchAccess}[kind]
+			if command == 'Z' {
+				d.addWatchpoint(watch, address, length)
+			} else {
+				d.removeWatchpoint(watch, address, length)
+			}
+		default:
+			return "", false
+		}
+		return "OK", false
+
+	case 'k':
+		return "", true
+
+	case 'D':
+		return "OK", true
+	}
+
+	return "", false
+}
+
+func (s *gdbSession) interrupted() bool {
+	select {
+	case <-s.interrupts:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *gdbSession) stopReply(reason stopReason) string {
+	switch reason.kind {
+	case stopExited:
+		s.exited = true
+		return fmt.Sprintf("W%02x", s.debugger.store.exitCode)
+	case stopError:
+		fmt.Fprintf(s.debugger.store.trace, "\n%s\n", reason.err)
+		return "S04" // SIGILL
+	case stopInterrupted:
+		return "S02" // SIGINT
+	case stopWatchpoint:
+		name := [...]string{watchWrite: "watch", watchRead: "rwatch", watchAccess: "awatch"}
+		return fmt.Sprintf("T05%s:%x;", name[reason.watch.kind], reason.watch.hit)
+	case stopBreakpoint:
+		return "T05swbreak:;"
+	case stopHistoryStart:
+		return "T05replaylog:begin;"
+	case stopCondition:
+		// GDB print console output received while the program run
+		s.send("O" + hex.EncodeToString([]byte("Stopped: "+reason.detail+"\n")))
+		return "S05"
+	}
+	return "S05"
+}
+
+// Execute a `monitor` command and return its output
+func (s *gdbSession) monitor(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		fields = []string{"help"}
+	}
+	history := s.debugger.store.history
+
+	switch fields[0] {
+	case "last-write":
+		if len(fields) != 2 {
+			break
+		}
+		address, err := strconv.ParseUint(fields[1], 0, 32)
+		if err != nil {
+			return fmt.Sprintf("invalid address %s\n", fields[1])
+		}
+		return s.debugger.lastWrite(int(address)&0xFFFFF) + "\n"
+	case "history":
+		return fmt.Sprintf("%d instructions executed, the last %d can be undone\n", history.count(), len(history.steps))
+	case "eval", "break-when", "break-if":
+		text := strings.TrimSpace(strings.TrimPrefix(command, fields[0]))
+		address := uint64(0)
+		if fields[0] == "break-if" {
+			if len(fields) < 3 {
+				break
+			}
+			var err error
+			address, err = strconv.ParseUint(fields[1], 0, 32)
+			if err != nil {
+				return fmt.Sprintf("invalid address %s\n", fields[1])
+			}
+			text = strings.TrimSpace(strings.TrimPrefix(text, fields[1]))
+		}
+		expression, err := CompileExpression(text)
+		if err != nil {
+			return err.Error() + "\n"
+		}
+		switch fields[0] {
+		case "eval":
+			value := expression.Value(s.debugger.store)
+			return fmt.Sprintf("0x%04x (%d)\n", value, value)
+		case "break-when":
+			s.debugger.addCondition(expression)
+			return fmt.Sprintf("Stop when %s\n", expression)
+		}
+		s.debugger.addBreakpoint(int(address)&0xFFFFF, expression)
+		return fmt.Sprintf("Breakpoint at 0x%05x when %s\n", address, expression)
+	case "delete-when":
+		text := strings.TrimSpace(strings.TrimPrefix(command, fields[0]))
+		if !s.debugger.removeCondition(text) {
+			return fmt.Sprintf("No condition %s\n", text)
+		}
+		return fmt.Sprintf("Deleted %s\n", text)
+	case "watch-register", "unwatch-register":
+		if len(fields) != 2 {
+			break
+		}
+		reg := strings.ToLower(fields[1])
+		if _, ok := registersOffsets[reg]; !ok {
+			return fmt.Sprintf("unknown register %s\n", fields[1])
+		}
+		if fields[0] == "watch-register" {
+			s.debugger.watchRegister(reg)
+			return fmt.Sprintf("Stop when %s change\n", reg)
+		}
+		s.debugger.unwatchRegister(reg)
+		return fmt.Sprintf("Stopped watching %s\n", reg)
+	}
+	return "monitor commands:\n" +
+		"  last-write <address>        find the last instruction that wrote to a physical address\n" +
+		"  history                     show the number of instructions that can be undone\n" +
+		"  eval <expression>           evaluate an expression like `cx == 63 && [bp + 2] != 0`\n" +
+		"  break-when <expression>     stop when the expression become true\n" +
+		"  delete-when <expression>    delete a condition added by break-when\n" +
+		"  break-if <address> <expr>   break at a physical address when the expression is true\n" +
+		"  watch-register <register>   stop when the register change\n" +
+		"  unwatch-register <register> stop watching the register\n"
+}
+
+// Return the register in GDB format: hexadecimal of its little endian bytes
+func (s *gdbSession) readRegister(n int) string {
+	store := s.debugger.store
+	value := uint32(0)
+	switch reg := gdbRegisters[n]; reg {
+	case "":
+	case "ip":
+		value = uint32(physicalAddress(store.getRegister("cs"), store.getRegister("ip")))
+	default:
+		value = uint32(store.getRegister(reg))
+	}
+	raw := make([]byte, 4)
+	binary.LittleEndian.PutUint32(raw, value)
+	return hex.EncodeToString(raw)
+}
+
+func (s *gdbSession) writeRegister(n int, value string) bool {
+	raw, err := hex.DecodeString(value)
+	if err != nil || len(raw) < 2 {
+		return false
+	}
+	switch reg := gdbRegisters[n]; reg {
+	case "":
+	case "ip":
+		raw = append(raw, 0, 0)
+		s.setPC(int(binary.LittleEndian.Uint32(raw)) & 0xFFFFF)
+	default:
+		s.debugger.store.withoutHistory(func() {
+			s.debugger.store.setRegister(reg, binary.LittleEndian.Uint16(raw))
+		})
+	}
+	return true
+}
+
+// Point CS:IP to a physical address, CS change only when the address is not
+// in the code segment.
+func (s *gdbSession) setPC(address int) {
+	store := s.debugger.store
+	store.withoutHistory(func() {
+		offset := address - int(store.getRegister("cs"))<<4
+		if offset < 0 || offset > 0xFFFF {
+			store.setRegister("cs", uint16(address>>4))
+			offset = address & 0xF
+		}
+		store.setRegister("ip", uint16(offset))
+	})
+}
+
+func parseAddressLength(text string) (int, int, bool) {
+	address, length, _ := strings.Cut(text, ",")
+	a, err := strconv.ParseUint(address, 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	l, err := strconv.ParseUint(length, 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int(a) & 0xFFFFF, int(l), true
+}
+
+// Registers in the order of the i386 GDB target, empty for the registers that
+// do not exist on the 8086.
+var gdbRegisters = []string{
+	"ax", "cx", "dx", "bx", "sp", "bp", "si", "di",
+	"ip", "fl", "cs", "ss", "ds", "es", "", "",
+}
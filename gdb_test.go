@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A GDB client talking to the stub over a pipe
+type gdbClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Send a packet and return the reply
+func (c *gdbClient) send(packet string) string {
+	c.t.Helper()
+	checksum := byte(0)
+	for i := 0; i < len(packet); i++ {
+		checksum += packet[i]
+	}
+	_, err := fmt.Fprintf(c.conn, "$%s#%02x", packet, checksum)
+	if err != nil {
+		c.t.Fatalf("%s: %s", packet, err)
+	}
+	ack, err := c.reader.ReadByte()
+	if err != nil || ack != '+' {
+		c.t.Fatalf("%s: expected an acknowledgment, got %q %v", packet, ack, err)
+	}
+	if _, err := c.reader.ReadString('$'); err != nil {
+		c.t.Fatalf("%s: %s", packet, err)
+	}
+	reply, err := c.reader.ReadString('#')
+	if err != nil {
+		c.t.Fatalf("%s: %s", packet, err)
+	}
+	if _, err := io.ReadFull(c.reader, make([]byte, 2)); err != nil {
+		c.t.Fatalf("%s: %s", packet, err)
+	}
+	return strings.TrimSuffix(reply, "#")
+}
+
+func TestGDBSession(t *testing.T) {
+	// 1000:0000 mov ax, 1
+	// 1000:0003 mov bx, 2
+	// 1000:0006 mov cx, 3
+	code, err := Assemble(strings.NewReader("mov ax, 1\nmov bx, 2\nmov cx, 3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	err = store.load(strings.NewReader(string(code)), codeSegment, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goroutines := runtime.NumGoroutine()
+	server, conn := net.Pipe()
+	served := make(chan error)
+	go func() { served <- serveGDBConnection(store, server) }()
+	client := gdbClient{t, conn, bufio.NewReader(conn)}
+
+	// eax, ecx, edx, ebx then eip is the 9th register
+	register := func(registers string, n int) string { return registers[8*n : 8*(n+1)] }
+
+	tests := []struct {
+		packet string
+		reply  string
+	}{
+		{"?", "S05"},
+		{"m10000,3", "b80100"},
+		{"Z0,10006,1", "OK"},
+		{"c", "T05swbreak:;"},
+		{"s", "S05"},
+		{"M20000,2:3412", "OK"},
+		{"m20000,2", "3412"},
+		{"c", "W00"},
+	}
+	registers := client.send("g")
+	if register(registers, 8) != "00000100" || register(registers, 10) != "00100000" {
+		t.Errorf("g: eip %s cs %s, expected 0x10000 and 0x1000", register(registers, 8), register(registers, 10))
+	}
+	for _, test := range tests {
+		reply := client.send(test.packet)
+		if reply != test.reply {
+			t.Errorf("%s: replied %q, expected %q", test.packet, reply, test.reply)
+		}
+		if test.packet == "s" {
+			registers := client.send("g")
+			if register(registers, 8) != "09000100" || register(registers, 3) != "02000000" {
+				t.Errorf("g after s: eip %s ebx %s, expected 0x10009 and 2", register(registers, 8), register(registers, 3))
+			}
+		}
+	}
+
+	// The packets sent after the end of the session must not block the stub
+	if reply := client.send("k"); reply != "" {
+		t.Errorf("k: replied %q", reply)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "$g#67")
+	conn.Close()
+	server.Close()
+	for wait := 0; runtime.NumGoroutine() > goroutines; wait++ {
+		if wait == 100 {
+			t.Fatalf("%d goroutines left, expected %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The writes of the debugger are not undone with the instruction before them
+func TestGDBWriteThenStepBack(t *testing.T) {
+	code, err := Assemble(strings.NewReader("mov ax, 1\nmov bx, 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	err = store.load(strings.NewReader(string(code)), codeSegment, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, conn := net.Pipe()
+	served := make(chan error)
+	go func() { served <- serveGDBConnection(store, server) }()
+	client := gdbClient{t, conn, bufio.NewReader(conn)}
+
+	tests := []struct {
+		packet string
+		reply  string
+	}{
+		{"s", "S05"},
+		{"M20000,2:3412", "OK"},
+		{"P3=07000000", "OK"},
+		{"bs", "S05"},
+		{"m20000,2", "3412"},
+		{"p3", "07000000"},
+		{"p0", "00000000"},
+		{"p8", "00000100"},
+	}
+	for _, test := range tests {
+		reply := client.send(test.packet)
+		if reply != test.reply {
+			t.Errorf("%s: replied %q, expected %q", test.packet, reply, test.reply)
+		}
+	}
+	client.send("k")
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	server.Close()
+}
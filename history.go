@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+)
+
+// Undo log of every mutation of the registers and the memory, grouped by
+// instruction, so that the execution can go backward.
+type History struct {
+	changes []change      // Every mutation, oldest first
+	steps   []historyStep // Every instruction executed, oldest first
+	dropped int           // Instructions forgotten to bound the memory used
+}
+
+// Old value of the bytes overwritten by a mutation
+type change struct {
+	memory  bool // Otherwise address is an offset in Storage.internal
+	address int
+	old     []byte
+}
+
+type historyStep struct {
+	change int  // Index in changes of the first mutation of the instruction
+	pc     int  // Physical address of the instruction
+	cycles int  // Cycles before the instruction
+	halted bool // The CPU was halted, only an interrupt can be undone then
+	fpu    *FPU // State of the 8087 before an ESC instruction
+
+	devices devicesState // State of the devices of the PC before the instruction
+}
+
+// Number of instructions remembered, the oldest ones are forgotten past it
+const historyLimit = 1 << 20
+
+func NewHistory() *History {
+	return &History{}
+}
+
+// Start recording the mutations of a new instruction
+func (h *History) begin(pc int, cycles int, halted bool, devices devicesState) {
+	if len(h.steps) >= historyLimit {
+		// Forget the oldest half, in one go so that it does not happen at
+		// each instruction.
+		forget := len(h.steps) / 2
+		first := h.steps[forget].change
+		h.changes = append([]change{}, h.changes[first:]...)
+		h.steps = append([]historyStep{}, h.steps[forget:]...)
+		for i := range h.steps {
+			h.steps[i].change -= first
+		}
+		h.dropped += forget
+	}
+	h.steps = append(h.steps, historyStep{change: len(h.changes), pc: pc, cycles: cycles, halted: halted, devices: devices})
+}
+
+// Remember the state of the 8087 before the instruction, it is small enough
+// to be copied whole.
+func (h *History) rememberFPU(f *FPU) {
+	saved := *f
+	h.steps[len(h.steps)-1].fpu = &saved
+}
+
+func (h *History) record(memory bool, address int, old []byte) {
+	h.changes = append(h.changes, change{memory: memory, address: address, old: old})
+}
+
+// Number of instructions executed since the start of the program
+func (h *History) count() int {
+	return h.dropped + len(h.steps)
+}
+
+// Return the last instruction that wrote to address, ok is false when no
+// remembered instruction did.
+func (h *History) lastWrite(address int) (step int, pc int, ok bool) {
+	end := len(h.changes)
+	for s := len(h.steps) - 1; s >= 0; s-- {
+		for _, w := range h.changes[h.steps[s].change:end] {
+			if w.memory && address >= w.address && address < w.address+len(w.old) {
+				return h.dropped + s + 1, h.steps[s].pc, true
+			}
+		}
+		end = h.steps[s].change
+	}
+	return 0, 0, false
+}
+
+// Apply a change made by a debugger. It is not done by an instruction, it
+// must not be undone with the last one, and lastWrite must not blame it.
+func (store *Storage) withoutHistory(change func()) {
+	history := store.history
+	store.history = nil
+	defer func() { store.history = history }()
+	change()
+}
+
+// Remember the old value of a register before it is written
+func (store *Storage) rememberRegister(offset int8, size int) {
+	if store.history == nil {
+		return
+	}
+	store.history.record(false, int(offset), bytes.Clone(store.internal[offset:int(offset)+size]))
+}
+
+// Remember the old value of the memory before it is written
+func (store *Storage) rememberMemory(address int, size int) {
+	if store.history == nil {
+		return
+	}
+	store.history.record(true, address, store.readMemory(address, size))
+}
+
+// Undo the last instruction executed and return the mutations it made,
+// ok is false when there is no instruction to undo.
+func (store *Storage) stepBack() (undone []change, ok bool) {
+	h := store.history
+	if h == nil || len(h.steps) == 0 {
+		return nil, false
+	}
+	step := h.steps[len(h.steps)-1]
+	undone = h.changes[step.change:]
+	for c := len(undone) - 1; c >= 0; c-- {
+		w := undone[c]
+		if w.memory {
+			for i, b := range w.old {
+				address := (w.address + i) % len(store.memory)
+				store.memory[address] = b
+				// The devices mapped in memory get their old value back
+				if region := store.memoryMap.find(address); region != nil && region.kind == regionMMIO {
+					region.write(address, b)
+				}
+			}
+		} else {
+			copy(store.internal[w.address:], w.old)
+		}
+	}
+	if step.fpu != nil {
+		*store.fpu = *step.fpu
+	}
+	store.ports.restore(step.devices, step.cycles)
+	store.cycles = step.cycles
+	store.executed--
+	store.halted = step.halted
+	store.exited = false // Nothing is executed after the exit, only it can be undone
+	h.changes = h.changes[:step.change]
+	h.steps = h.steps[:len(h.steps)-1]
+	return undone, true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Interrupts save FLAGS, CS and IP on the stack, clear IF and TF and jump to
+// the vector of the interrupt vector table at 0000:0000, IRET come back.
+//
+// Hardware interrupts come from the PIC and are taken between instructions
+// when IF is set. After STI, and after a write to SS, the next instruction is
+// always executed first so that `sti; hlt` and `mov ss, ax; mov sp, bx`
+// cannot be interrupted in the middle.
+
+// Cycles of the CPU to acknowledge a hardware interrupt and enter its handler
+const interruptCycles = 61
+
+// Enter the handler of an interrupt, ip is the return address
+func (store *Storage) interrupt(vector byte, ip uint16) {
+	handler := store.readMemoryAt(int(vector)*4, 4)
+
+	store.push(store.getRegister("fl"))
+	if store.getFlag(interruptFlag) {
+		store.printFlag("IF", interruptFlag, false)
+	}
+	if store.getFlag(trapFlag) {
+		store.printFlag("TF", trapFlag, false)
+	}
+	store.push(store.getRegister("cs"))
+	store.push(ip)
+	store.write("cs", handler[2:4])
+	store.write("ip", handler[0:2])
+	store.jumped = true
+}
+
+// Take the highest hardware interrupt waiting in the PIC, ok is false when
+// no interrupt can be taken before the next instruction.
+func (store *Storage) hardwareInterrupt() (Instruction, bool) {
+	if store.inhibit || !store.getFlag(interruptFlag) {
+		return Instruction{}, false
+	}
+	irq, vector, ok := store.ports.pic.interrupt()
+	if !ok {
+		return Instruction{}, false
+	}
+
+	i := Instruction{"irq", strconv.Itoa(irq), "", 0, 0, nil, ""}
+	if store.history != nil {
+		store.history.begin(physicalAddress(store.getRegister("cs"), store.getRegister("ip")), store.cycles, store.halted, store.ports.state())
+	}
+	fmt.Fprintf(store.trace, "%- 12s [int 0x%02x] ", &i, vector)
+	if store.halted {
+		fmt.Fprint(store.trace, "[wake up] ")
+		store.halted = false
+	}
+	store.interrupt(vector, store.getRegister("ip"))
+	fmt.Fprint(store.trace, "\n")
+
+	store.cycles += interruptCycles
+	store.executed++
+	store.ports.advance(store.cycles)
+	if store.biu != nil {
+		// The handler is somewhere else, the queue is flushed
+		store.biu.instruction(physicalAddress(store.getRegister("cs"), store.getRegister("ip")), 0, interruptCycles)
+	}
+	return i, true
+}
+
+// ========================
+// ===== INSTRUCTIONS =====
+// ========================
+
+// Software interrupt. There is no DOS to answer INT 20h and INT 21h, the
+// vector table is empty, but an .EXE end with them so they end the program.
+func softwareInterrupt(store *Storage, i Instruction) {
+	vector, err := strconv.ParseUint(i.operandLeft, 10, 8)
+	if err != nil {
+		panic(fmt.Sprintf("INT only support immediate value, %s", err))
+	}
+	ax := store.getRegister("ax")
+	switch {
+	case store.dos && vector == 0x20:
+		store.exit(0)
+	case store.dos && vector == 0x21 && ax>>8 == 0x4C:
+		store.exit(byte(ax))
+	default:
+		store.interrupt(byte(vector), store.getRegister("ip"))
+	}
+}
+
+// Terminate the program like DOS, the next step return io.EOF
+func (store *Storage) exit(code byte) {
+	fmt.Fprintf(store.trace, "[exit %d] ", code)
+	store.exited, store.exitCode = true, code
+}
+
+// Breakpoint, the one byte INT 3
+func int3(store *Storage, i Instruction) {
+	store.interrupt(3, store.getRegister("ip"))
+}
+
+// Interrupt 4 when OF is set
+func into(store *Storage, i Instruction) {
+	if store.getFlag(overflowFlag) {
+		store.interrupt(4, store.getRegister("ip"))
+	}
+}
+
+// Return from an interrupt handler
+func iret(store *Storage, i Instruction) {
+	ip := store.pop()
+	cs := store.pop()
+	flags := store.pop()
+	store.write("ip", binary.LittleEndian.AppendUint16(nil, ip))
+	store.write("cs", binary.LittleEndian.AppendUint16(nil, cs))
+	store.write("fl", binary.LittleEndian.AppendUint16(nil, flags))
+	store.jumped = true
+}
+
+// Interrupt 5 when the signed register is not between the two words in
+// memory. The return address is the BOUND itself so the handler can fix the
+// index and try again.
+func bound(store *Storage, i Instruction) {
+	index := int16(store.readAsInt(i.operandLeft, 2))
+	address := store.effectiveAdressCalculation(i.operandRight, 2)
+	bounds := store.readMemoryAt(store.physicalAddressOf(i.operandRight, address), 4)
+	lower := int16(binary.LittleEndian.Uint16(bounds))
+	upper := int16(binary.LittleEndian.Uint16(bounds[2:]))
+	if index < lower || index > upper {
+		fmt.Fprintf(store.trace, "[out of bounds %d..%d] ", lower, upper)
+		store.interrupt(5, store.getRegister("ip")-uint16(i.size))
+	}
+}
+
+// STI and writes to SS protect the next instruction from interrupts
+func sti(store *Storage, i Instruction) {
+	store.printFlag("IF", interruptFlag, true)
+	store.inhibit = true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Limits of an execution, zero means no limit
+type Limits struct {
+	MaxInstructions int  // Steps of the CPU, a halted CPU still count its steps
+	MaxCycles       int  // Estimated cycles
+	DetectLoops     bool // Stop as soon as the execution is known to never end
+}
+
+var (
+	ErrInstructionLimit = errors.New("instruction limit reached")
+	ErrCycleLimit       = errors.New("cycle limit reached")
+)
+
+// Returned when the execution can never end
+type LoopError struct {
+	Address int    // Physical address where the loop was found
+	Length  int    // Instructions in the loop, 0 when the CPU is halted
+	Reason  string // What the CPU is doing
+}
+
+func (e *LoopError) Error() string {
+	if e.Length <= 1 {
+		return fmt.Sprintf("infinite loop at 0x%05x: %s", e.Address, e.Reason)
+	}
+	return fmt.Sprintf("infinite loop at 0x%05x: %s (every %d instructions)", e.Address, e.Reason, e.Length)
+}
+
+// Execute until the end of the program, until a limit is reached or until
+// stop return true. stop is optional and called after every instruction.
+func (store *Storage) run(ctx context.Context, limits Limits, stop func() bool) error {
+	var detector *loopDetector
+	if limits.DetectLoops {
+		detector = newLoopDetector(store)
+		observers := store.observers
+		store.observers = append(store.observers, detector)
+		defer func() { store.observers = observers }()
+	}
+
+	for count := 0; ; count++ {
+		if limits.MaxInstructions > 0 && count >= limits.MaxInstructions {
+			return ErrInstructionLimit
+		}
+		if limits.MaxCycles > 0 && store.cycles >= limits.MaxCycles {
+			return ErrCycleLimit
+		}
+		// Checking the context is slow compared to an instruction
+		if count%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		_, err := store.step()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if detector != nil {
+			if err := detector.check(); err != nil {
+				return err
+			}
+		}
+		if stop != nil && stop() {
+			return nil
+		}
+	}
+}
+
+// Find when the CPU come back to a state it already was in. The program
+// being deterministic, it will then loop forever.
+//
+// Comparing the whole memory at every instruction would be too slow so we
+// keep a hash of it, updated on every write. The state is saved after a
+// power of two number of instructions and compared to the following ones,
+// this is Brent's cycle detection: a loop is found in at most twice the
+// instructions needed to enter it and go around it once.
+type loopDetector struct {
+	store   *Storage
+	memory  uint64 // Hash of the memory
+	written []int  // Addresses written by the current instruction
+
+	saved       [28]byte
+	savedMemory uint64
+	savedHalted bool
+	savedFPU    fpuState
+	savedPorts  devicesState
+	power       int // Instructions before the state is saved again
+	length      int // Instructions since the state was saved
+}
+
+func newLoopDetector(store *Storage) *loopDetector {
+	d := &loopDetector{store: store, power: 1}
+	for address, value := range store.memory {
+		d.memory ^= memoryHash(address, value)
+	}
+	d.save()
+	return d
+}
+
+// Hash of a byte of the memory, zero for zero so that the hash of the empty
+// memory is zero.
+func memoryHash(address int, value byte) uint64 {
+	if value == 0 {
+		return 0
+	}
+	// splitmix64 finalizer
+	x := uint64(address)<<8 | uint64(value)
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+func (d *loopDetector) observeRead(address int, size int) {}
+
+// Remove the old value from the hash, the new one is added after the
+// instruction.
+func (d *loopDetector) observeWrite(address int, size int) {
+	for i := 0; i < size; i++ {
+		a := (address + i) & 0xFFFFF
+		known := false
+		for _, w := range d.written {
+			known = known || w == a
+		}
+		if !known {
+			d.memory ^= memoryHash(a, d.store.memory[a])
+			d.written = append(d.written, a)
+		}
+	}
+}
+
+// The state of the CPU, the memory, the 8087 and the devices is saved to be
+// compared to the following ones.
+func (d *loopDetector) save() {
+	store := d.store
+	d.saved, d.savedMemory, d.savedHalted = store.internal, d.memory, store.halted
+	d.savedFPU, d.savedPorts = store.fpu.state(), store.ports.state()
+}
+
+func (d *loopDetector) same() bool {
+	store := d.store
+	return store.internal == d.saved && d.memory == d.savedMemory && store.halted == d.savedHalted &&
+		store.fpu.state() == d.savedFPU && store.ports.state() == d.savedPorts
+}
+
+// Called after every instruction
+func (d *loopDetector) check() error {
+	store := d.store
+	for _, a := range d.written {
+		d.memory ^= memoryHash(a, store.memory[a])
+	}
+	d.written = d.written[:0]
+
+	cs, ip := store.getRegister("cs"), store.getRegister("ip")
+	if store.halted {
+		// IP is after the HLT
+		hlt := physicalAddress(cs, ip-1)
+		if !store.getFlag(interruptFlag) {
+			return &LoopError{Address: hlt, Reason: "halted with interrupts disabled"}
+		}
+		if d.same() {
+			return &LoopError{Address: hlt, Reason: "halted waiting for an interrupt that never come"}
+		}
+	}
+
+	d.length++
+	if d.same() {
+		reason := "the same state repeat"
+		if d.length == 1 {
+			reason = "jump to itself"
+		}
+		return &LoopError{Address: physicalAddress(cs, ip), Length: d.length, Reason: reason}
+	}
+	if d.length == d.power {
+		d.save()
+		d.power *= 2
+		d.length = 0
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		source   string
+		limits   Limits
+		err      error
+		loop     *LoopError
+		executed int // Calls of stop, it is not called when a loop is found
+	}{
+		{"mov ax, 1\nmov bx, 2\nmov cx, 3\n", Limits{}, nil, nil, 3},
+		{"mov ax, 1\nmov bx, 2\nmov cx, 3\n", Limits{MaxInstructions: 2}, ErrInstructionLimit, nil, 2},
+		{"mov ax, 1\nmov bx, 2\nmov cx, 3\n", Limits{MaxInstructions: 4}, nil, nil, 3},
+		{"mov ax, 1\nmov bx, 2\nmov cx, 3\n", Limits{MaxCycles: 1}, ErrCycleLimit, nil, 1},
+		{"jmp $\n", Limits{MaxInstructions: 100}, ErrInstructionLimit, nil, 100},
+		{"jmp $\n", Limits{DetectLoops: true}, nil, &LoopError{0x10000, 1, "jump to itself"}, 0},
+		{"cli\nhlt\n", Limits{DetectLoops: true}, nil, &LoopError{0x10001, 0, "halted with interrupts disabled"}, 1},
+		// Come back to the same state every 3 instructions
+		{"mov ax, 1\nadd ax, 1\nsub ax, 1\njmp 3\n", Limits{DetectLoops: true}, nil, &LoopError{0x10009, 3, "the same state repeat"}, 5},
+		// The counter change the state, it is not a loop
+		{"mov cx, 300\nsub cx, 1\njne 3\n", Limits{DetectLoops: true}, nil, nil, 601},
+	}
+	for _, test := range tests {
+		code, err := Assemble(strings.NewReader(test.source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := NewStorage(io.Discard)
+		store.load(strings.NewReader(string(code)), codeSegment, 0)
+
+		executed := 0
+		err = store.run(context.Background(), test.limits, func() bool {
+			executed++
+			return false
+		})
+		var loop *LoopError
+		switch {
+		case test.loop != nil:
+			if !errors.As(err, &loop) {
+				t.Errorf("%q %+v: %v, expected an infinite loop", test.source, test.limits, err)
+			} else if *loop != *test.loop {
+				t.Errorf("%q: %+v, expected %+v", test.source, *loop, *test.loop)
+			}
+		case err != test.err:
+			t.Errorf("%q %+v: %v, expected %v", test.source, test.limits, err, test.err)
+		}
+		if executed != test.executed {
+			t.Errorf("%q %+v: %d instructions executed, expected %d", test.source, test.limits, executed, test.executed)
+		}
+	}
+}
+
+// Cancelling the context stop a program that never end
+func TestLimitsCancel(t *testing.T) {
+	code, err := Assemble(strings.NewReader("jmp $\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStorage(io.Discard)
+	store.load(strings.NewReader(string(code)), codeSegment, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.run(ctx, Limits{}, nil); err != context.Canceled {
+		t.Errorf("%v with a cancelled context, expected %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Programs are flat binaries, like those of part1/, DOS executables with an
+// MZ header or Intel HEX files. An executable is detected from its first
+// bytes, an Intel HEX file from its extension or from its records.
+
+// Load a program in the segment and point CS:IP to its entry, return the
+// physical address of its first byte, where a listing of it start.
+func (store *Storage) loadProgram(program io.Reader, segment uint16) (int, error) {
+	content, err := io.ReadAll(program)
+	if err != nil {
+		return 0, err
+	}
+	if isEXE(content) {
+		return store.loadEXE(content, segment)
+	}
+	if isIntelHex(program, content) {
+		return store.loadIntelHex(content)
+	}
+	return physicalAddress(segment, 0), store.load(bytes.NewReader(content), segment, 0)
+}
+
+// ===================
+// ===== MZ .EXE =====
+// ===================
+
+// Header of a DOS executable, the sizes are in pages of 512 bytes and in
+// paragraphs of 16 bytes.
+type exeHeader struct {
+	Signature     [2]byte
+	LastPageBytes uint16 // Bytes used in the last page, 0 when it is full
+	Pages         uint16
+	Relocations   uint16
+	HeaderSize    uint16 // In paragraphs
+	MinAlloc      uint16 // Paragraphs needed after the image
+	MaxAlloc      uint16 // Paragraphs wanted after the image
+	SS            uint16 // Relative to the image
+	SP            uint16
+	Checksum      uint16
+	IP            uint16
+	CS            uint16 // Relative to the image
+	RelocationsAt uint16 // Offset of the relocation table in the file
+	Overlay       uint16
+}
+
+const exeHeaderSize = 28
+
+// The end of the conventional memory, where the video memory start
+const memoryTopSegment = 0xA000
+
+func isEXE(content []byte) bool {
+	return len(content) >= exeHeaderSize && (string(content[:2]) == "MZ" || string(content[:2]) == "ZM")
+}
+
+// Load an executable like DOS do: the PSP take the first 256 bytes of the
+// segment and the image follow it. The segments in the relocation table are
+// fixed with the segment of the image, DS and ES point to the PSP. The program
+// end with INT 20h or INT 21h/4Ch, see softwareInterrupt.
+//
+// The memory block of the program is the image plus MaxAlloc paragraphs,
+// less when it does not fit below 0xA000 but never less than MinAlloc. The
+// segment after the block is written in the PSP at offset 2.
+func (store *Storage) loadEXE(content []byte, segment uint16) (int, error) {
+	header := exeHeader{}
+	binary.Read(bytes.NewReader(content), binary.LittleEndian, &header)
+
+	size := int(header.Pages) * 512
+	if header.LastPageBytes != 0 {
+		size -= 512 - int(header.LastPageBytes)
+	}
+	start := int(header.HeaderSize) * 16
+	if header.Pages == 0 || size > len(content) || start > size {
+		return 0, fmt.Errorf("invalid MZ header: image of %d bytes after a header of %d bytes in a file of %d bytes", size-start, start, len(content))
+	}
+	image := content[start:size]
+
+	pspSegment := segment
+	imageSegment := segment + 0x10
+	paragraphs := (len(image) + 15) / 16
+	available := memoryTopSegment - int(imageSegment) - paragraphs
+	if available < int(header.MinAlloc) {
+		return 0, fmt.Errorf("program need %d paragraphs but only %d are free", paragraphs+int(header.MinAlloc), max(available+paragraphs, 0))
+	}
+	allocated := min(int(header.MaxAlloc), available)
+
+	base := physicalAddress(imageSegment, 0)
+	copy(store.memory[base:], image)
+	store.codeEnd = base + len(image)
+	store.memoryMap.loaded(base, len(image))
+
+	table := int(header.RelocationsAt)
+	if table+int(header.Relocations)*4 > len(content) {
+		return 0, fmt.Errorf("relocation table of %d entries is out of the file", header.Relocations)
+	}
+	for n := 0; n < int(header.Relocations); n++ {
+		entry := content[table+n*4:]
+		offset := binary.LittleEndian.Uint16(entry)
+		relative := binary.LittleEndian.Uint16(entry[2:])
+		address := physicalAddress(imageSegment+relative, offset)
+		if address+2 > len(store.memory) {
+			return 0, fmt.Errorf("relocation %04x:%04x is out of memory", relative, offset)
+		}
+		value := binary.LittleEndian.Uint16(store.memory[address:]) + imageSegment
+		binary.LittleEndian.PutUint16(store.memory[address:], value)
+	}
+
+	// INT 20h to terminate at the start of the PSP and the end of the block
+	psp := physicalAddress(pspSegment, 0)
+	copy(store.memory[psp:], []byte{0xCD, 0x20})
+	store.memoryMap.initialize(psp, 0x100)
+	binary.LittleEndian.PutUint16(store.memory[psp+2:], uint16(int(imageSegment)+paragraphs+allocated))
+
+	store.setRegister("cs", imageSegment+header.CS)
+	store.setRegister("ip", header.IP)
+	store.setRegister("ss", imageSegment+header.SS)
+	store.setRegister("sp", header.SP)
+	store.setRegister("ds", pspSegment)
+	store.setRegister("es", pspSegment)
+	store.dos = true
+	return base, nil
+}
+
+// =====================
+// ===== INTEL HEX =====
+// =====================
+
+// Records of an Intel HEX file
+const (
+	hexData           = 0x00
+	hexEndOfFile      = 0x01
+	hexSegmentAddress = 0x02 // Segment added to the offsets of the next data
+	hexStartSegment   = 0x03 // CS:IP of the entry
+	hexLinearAddress  = 0x04 // Upper 16 bits of the address of the next data
+	hexStartLinear    = 0x05 // Physical address of the entry
+)
+
+// A file named .hex or .ihx is loaded as Intel HEX and its errors are
+// reported. Otherwise every line must be a record with a valid checksum up to
+// the end of file record: a flat binary can start with ':', it is CMP.
+func isIntelHex(program io.Reader, content []byte) bool {
+	if file, ok := program.(interface{ Name() string }); ok {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if ext == ".hex" || ext == ".ihx" {
+			return true
+		}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		record, err := parseHexRecord(text)
+		if err != nil {
+			return false
+		}
+		if record[3] == hexEndOfFile {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode a line of an Intel HEX file: the byte count, the offset, the type,
+// the data and the checksum.
+func parseHexRecord(text string) ([]byte, error) {
+	record, err := hex.DecodeString(strings.TrimPrefix(text, ":"))
+	if !strings.HasPrefix(text, ":") || err != nil || len(record) < 5 || len(record) != int(record[0])+5 {
+		return nil, fmt.Errorf("invalid Intel HEX record %q", text)
+	}
+	sum := byte(0)
+	for _, b := range record {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("invalid checksum")
+	}
+	return record, nil
+}
+
+// Load the data records of an Intel HEX file where they say. The CPU start
+// at the start address record, or at the first data record without one.
+//
+// The segment of a type 02 record become CS when the entry is in it, the
+// linear addresses of types 04 and 05 are cut in a 0x1000 aligned segment.
+func (store *Storage) loadIntelHex(content []byte) (int, error) {
+	segment, upper := uint16(0), 0
+	cs, ip, entry := uint16(0), uint16(0), false
+	lowest, highest := len(store.memory), 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		record, err := parseHexRecord(text)
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		offset := binary.BigEndian.Uint16(record[1:])
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case hexData:
+			for n, b := range data {
+				// The offset wrap around in its segment
+				address := (upper + physicalAddress(segment, offset+uint16(n))) % len(store.memory)
+				store.memory[address] = b
+				lowest, highest = min(lowest, address), max(highest, address+1)
+			}
+			store.memoryMap.loaded((upper+physicalAddress(segment, offset))%len(store.memory), len(data))
+			if !entry && len(data) > 0 {
+				cs, ip = segment+uint16(upper>>4), offset
+				entry = true
+			}
+		case hexEndOfFile:
+			return store.startIntelHex(cs, ip, lowest, highest)
+		case hexSegmentAddress, hexLinearAddress:
+			if len(data) != 2 {
+				return 0, fmt.Errorf("line %d: address record of %d bytes", line, len(data))
+			}
+			segment, upper = 0, 0
+			if record[3] == hexSegmentAddress {
+				segment = binary.BigEndian.Uint16(data)
+			} else {
+				upper = int(binary.BigEndian.Uint16(data)) << 16
+			}
+		case hexStartSegment, hexStartLinear:
+			if len(data) != 4 {
+				return 0, fmt.Errorf("line %d: start record of %d bytes", line, len(data))
+			}
+			if record[3] == hexStartSegment {
+				cs, ip = binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+			} else {
+				address := binary.BigEndian.Uint32(data) % uint32(len(store.memory))
+				cs, ip = uint16(address>>4&0xF000), uint16(address)
+			}
+			entry = true
+		default:
+			return 0, fmt.Errorf("line %d: unknown record type %02x", line, record[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return store.startIntelHex(cs, ip, lowest, highest)
+}
+
+func (store *Storage) startIntelHex(cs uint16, ip uint16, lowest int, highest int) (int, error) {
+	if highest == 0 {
+		return 0, fmt.Errorf("no data in the Intel HEX file")
+	}
+	store.codeEnd = highest
+	store.setRegister("cs", cs)
+	store.setRegister("ip", ip)
+	return lowest, nil
+}
+
+// ================
+// ===== BIOS =====
+// ================
+
+// Map a ROM image at the top of the memory and start at FFFF:0000 like the
+// 8086 do after a reset. Writes to the ROM are ignored.
+func (store *Storage) loadBIOS(program io.Reader) (int, error) {
+	rom, err := io.ReadAll(program)
+	if err != nil {
+		return 0, err
+	}
+	if len(rom) == 0 || len(rom) >= len(store.memory) {
+		return 0, fmt.Errorf("ROM of %d bytes does not fit in memory", len(rom))
+	}
+	start := len(store.memory) - len(rom)
+	copy(store.memory[start:], rom)
+	err = store.memoryMap.add(memoryRegion{name: regionNames[regionROM], first: start, last: len(store.memory) - 1, kind: regionROM})
+	if err != nil {
+		return 0, err
+	}
+	store.codeEnd = len(store.memory)
+	// The reset clear the flags and the segments other than CS
+	store.setRegister("cs", 0xFFFF)
+	store.setRegister("ip", 0x0000)
+	for _, reg := range []string{"ds", "es", "ss"} {
+		store.setRegister(reg, 0)
+	}
+	store.undefined.defineFlags(0xFFFF)
+	return start, nil
+}
+
+// ==================
+// ===== ORIGIN =====
+// ==================
+
+// Load a raw binary at the origin, whatever its format, and point CS:IP to
+// its first byte. For dumps of ROM made to be at a given address.
+func (store *Storage) loadAtOrigin(program io.Reader, origin string) (int, error) {
+	segment, offset, err := parseSegmentOffset(origin)
+	if err != nil {
+		return 0, err
+	}
+	return physicalAddress(segment, offset), store.load(program, segment, offset)
+}
+
+// Point CS:IP somewhere else than the entry of the loader, like the reset
+// vector at F000:FFF0 of a ROM loaded at F000:0000. The entry must be in the
+// memory loaded.
+func (store *Storage) setEntry(entry string) error {
+	segment, offset, err := parseSegmentOffset(entry)
+	if err != nil {
+		return err
+	}
+	if address := physicalAddress(segment, offset); address >= store.codeEnd {
+		return fmt.Errorf("entry %s is after the end of the program at 0x%05x", entry, store.codeEnd)
+	}
+	store.setRegister("cs", segment)
+	store.setRegister("ip", offset)
+	return nil
+}
+
+// Parse an address like F000:FFF0, the segment and the offset are in
+// hexadecimal.
+func parseSegmentOffset(text string) (uint16, uint16, error) {
+	segmentText, offsetText, ok := strings.Cut(text, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid address %q, expected segment:offset", text)
+	}
+	segment, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(segmentText), "0x"), 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid segment %q", segmentText)
+	}
+	offset, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(offsetText), "0x"), 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid offset %q", offsetText)
+	}
+	return uint16(segment), uint16(offset), nil
+}
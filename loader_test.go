@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// An .EXE with a header of 2 paragraphs, the relocation table of at most one
+// entry follow the fixed part.
+func makeEXE(header exeHeader, image []byte, relocations ...[2]uint16) []byte {
+	header.Signature = [2]byte{'M', 'Z'}
+	header.HeaderSize = 2
+	header.Relocations = uint16(len(relocations))
+	header.RelocationsAt = exeHeaderSize
+	size := 32 + len(image)
+	header.Pages = uint16((size + 511) / 512)
+	header.LastPageBytes = uint16(size % 512)
+
+	content := &bytes.Buffer{}
+	binary.Write(content, binary.LittleEndian, header)
+	for _, r := range relocations {
+		binary.Write(content, binary.LittleEndian, r)
+	}
+	content.Write(make([]byte, 32-content.Len()))
+	content.Write(image)
+	return content.Bytes()
+}
+
+// mov ax, seg (relocated), mov bx, 3, mov ax, 0x4c03, int 0x21, mov bx, 7
+var exeImage = []byte{0xB8, 0x01, 0x00, 0xBB, 0x03, 0x00, 0xB8, 0x03, 0x4C, 0xCD, 0x21, 0xBB, 0x07, 0x00}
+
+func TestLoadEXE(t *testing.T) {
+	tests := []struct {
+		minAlloc, maxAlloc uint16
+		top                uint16 // Segment after the block in the PSP
+		err                string
+	}{
+		{0x10, 0xFFFF, 0xA000, ""},
+		{0x10, 0x20, 0x1031, ""},
+		{0x9000, 0xFFFF, 0, "program need 36865 paragraphs but only 36848 are free"},
+	}
+	for _, test := range tests {
+		content := makeEXE(exeHeader{MinAlloc: test.minAlloc, MaxAlloc: test.maxAlloc, SS: 1, SP: 0x100}, exeImage, [2]uint16{1, 0})
+		store := NewStorage(io.Discard)
+		base, err := store.loadProgram(bytes.NewReader(content), codeSegment)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("MinAlloc 0x%x: error %v, expected %q", test.minAlloc, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The PSP is at 1000:0000 and the image in the next 256 bytes
+		if base != 0x10100 {
+			t.Errorf("image at 0x%05x, expected 0x10100", base)
+		}
+		if relocated := binary.LittleEndian.Uint16(store.memory[base+1:]); relocated != 0x1011 {
+			t.Errorf("relocated segment 0x%04x, expected 0x1011", relocated)
+		}
+		registers := map[string]uint16{"cs": 0x1010, "ip": 0, "ss": 0x1011, "sp": 0x100, "ds": 0x1000, "es": 0x1000}
+		for reg, expected := range registers {
+			if value := store.getRegister(reg); value != expected {
+				t.Errorf("%s 0x%04x, expected 0x%04x", reg, value, expected)
+			}
+		}
+		if !bytes.Equal(store.memory[0x10000:0x10002], []byte{0xCD, 0x20}) {
+			t.Errorf("PSP start with % x, expected int 0x20", store.memory[0x10000:0x10002])
+		}
+		if top := binary.LittleEndian.Uint16(store.memory[0x10002:]); top != test.top {
+			t.Errorf("MaxAlloc 0x%x: block end at 0x%04x, expected 0x%04x", test.maxAlloc, top, test.top)
+		}
+	}
+}
+
+// The vector table is empty, INT 20h and INT 21h/4Ch must stop the program
+// instead of jumping to 0000:0000.
+func TestEXEExit(t *testing.T) {
+	tests := []struct {
+		image    []byte
+		code     byte
+		executed int
+	}{
+		{exeImage, 3, 4},
+		{[]byte{0xCD, 0x20, 0xBB, 0x07, 0x00}, 0, 1},
+		{[]byte{0xB8, 0x00, 0x4C, 0xCD, 0x21}, 0, 2},
+	}
+	for _, test := range tests {
+		content := makeEXE(exeHeader{MaxAlloc: 0xFFFF, SP: 0x100}, test.image)
+		store := NewStorage(io.Discard)
+		_, err := store.loadProgram(bytes.NewReader(content), codeSegment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.run(context.Background(), Limits{MaxInstructions: 100}, nil)
+		if err != nil {
+			t.Fatalf("% x: %s", test.image, err)
+		}
+		if !store.exited || store.exitCode != test.code || store.executed != test.executed || store.getRegister("bx") == 7 {
+			t.Errorf("% x: exited %t with %d after %d instructions, expected %d after %d",
+				test.image, store.exited, store.exitCode, store.executed, test.code, test.executed)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	err := Execute(bytes.NewReader(makeEXE(exeHeader{MaxAlloc: 0xFFFF, SP: 0x100}, exeImage)), ExecuteOptions{PrintHex: true, Output: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Exited with code 3") || !strings.Contains(out.String(), "│ bx │ 0x03 │ 0x00 │") {
+		t.Errorf("exit not reported\n%s", out)
+	}
+
+	// Without DOS the interrupt go through the vector table
+	store := NewStorage(io.Discard)
+	store.load(bytes.NewReader([]byte{0xB8, 0x01, 0x4C, 0xCD, 0x21}), codeSegment, 0)
+	for n := 0; n < 2; n++ {
+		if _, err := store.step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.exited || store.getRegister("cs") != 0 {
+		t.Errorf("flat binary: exited %t cs 0x%04x, expected the vector 0x21", store.exited, store.getRegister("cs"))
+	}
+}
+
+// A record of an Intel HEX file with its checksum
+func hexRecord(kind byte, offset uint16, data ...byte) string {
+	record := append([]byte{byte(len(data)), byte(offset >> 8), byte(offset), kind}, data...)
+	sum := byte(0)
+	for _, b := range record {
+		sum -= b
+	}
+	return fmt.Sprintf(":%X\n", append(record, sum))
+}
+
+// A reader with the name of a file, like *os.File
+type namedReader struct {
+	io.Reader
+	name string
+}
+
+func (r namedReader) Name() string {
+	return r.name
+}
+
+func TestLoadIntelHex(t *testing.T) {
+	end := hexRecord(hexEndOfFile, 0)
+	tests := []struct {
+		name     string
+		content  string
+		base     int
+		cs, ip   uint16
+		memory   map[int]byte
+		expected string // Error
+	}{
+		{
+			"segment address",
+			hexRecord(hexSegmentAddress, 0, 0x20, 0x00) + hexRecord(hexData, 0x0010, 0xAA, 0xBB) + end,
+			0x20010, 0x2000, 0x0010, map[int]byte{0x20010: 0xAA, 0x20011: 0xBB}, "",
+		},
+		{
+			"linear address",
+			hexRecord(hexLinearAddress, 0, 0x00, 0x03) + hexRecord(hexData, 0x1234, 0xCC) + end,
+			0x31234, 0x3000, 0x1234, map[int]byte{0x31234: 0xCC}, "",
+		},
+		{
+			"start segment",
+			hexRecord(hexSegmentAddress, 0, 0x12, 0x34) + hexRecord(hexData, 0, 1, 2, 3, 4, 5, 6) +
+				hexRecord(hexStartSegment, 0, 0x12, 0x34, 0x00, 0x05) + end,
+			0x12340, 0x1234, 0x0005, map[int]byte{0x12345: 6}, "",
+		},
+		{
+			"start linear",
+			hexRecord(hexLinearAddress, 0, 0x00, 0x0F) + hexRecord(hexData, 0xFFF0, 0xEA) +
+				hexRecord(hexStartLinear, 0, 0x00, 0x0F, 0xFF, 0xF0) + end,
+			0xFFFF0, 0xF000, 0xFFF0, map[int]byte{0xFFFF0: 0xEA}, "",
+		},
+		{
+			"offset wrap around in the segment",
+			hexRecord(hexSegmentAddress, 0, 0xF0, 0x00) + hexRecord(hexData, 0xFFFE, 1, 2, 3, 4) + end,
+			0xF0000, 0xF000, 0xFFFE, map[int]byte{0xFFFFE: 1, 0xFFFFF: 2, 0xF0000: 3, 0xF0001: 4}, "",
+		},
+		{
+			"records after the end are ignored",
+			hexRecord(hexData, 0x100, 0x90) + end + ":bad\n",
+			0x100, 0, 0x100, map[int]byte{0x100: 0x90}, "",
+		},
+		{"bad checksum", hexRecord(hexData, 0, 0x90) + ":01000000900F\n" + end, 0, 0, 0, nil, "line 2: invalid checksum"},
+		{"bad length", ":0200000090FF\n", 0, 0, 0, nil, "line 1: invalid Intel HEX record \":0200000090FF\""},
+		{"unknown record", hexRecord(6, 0, 1) + end, 0, 0, 0, nil, "line 1: unknown record type 06"},
+		{"short start record", hexRecord(hexStartLinear, 0, 1, 2) + end, 0, 0, 0, nil, "line 1: start record of 2 bytes"},
+		{"no data", hexRecord(hexSegmentAddress, 0, 0x20, 0x00) + end, 0, 0, 0, nil, "no data in the Intel HEX file"},
+	}
+	for _, test := range tests {
+		store := NewStorage(io.Discard)
+		base, err := store.loadProgram(namedReader{strings.NewReader(test.content), "program.hex"}, codeSegment)
+		if test.expected != "" {
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("%s: error %v, expected %q", test.name, err, test.expected)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		cs, ip := store.getRegister("cs"), store.getRegister("ip")
+		if base != test.base || cs != test.cs || ip != test.ip {
+			t.Errorf("%s: base 0x%05x entry %04x:%04x, expected 0x%05x %04x:%04x", test.name, base, cs, ip, test.base, test.cs, test.ip)
+		}
+		for address, expected := range test.memory {
+			if store.memory[address] != expected {
+				t.Errorf("%s: 0x%05x is 0x%02x, expected 0x%02x", test.name, address, store.memory[address], expected)
+			}
+		}
+	}
+}
+
+// Without the extension a file is Intel HEX only when all its records are
+// valid, otherwise it is a flat binary.
+func TestDetectIntelHex(t *testing.T) {
+	valid := hexRecord(hexData, 0x100, 0x90) + hexRecord(hexEndOfFile, 0)
+	tests := []struct {
+		name    string
+		content string
+		hex     bool
+	}{
+		{"program", valid, true},
+		{"program", "\r\n" + strings.ReplaceAll(valid, "\n", "\r\n"), true},
+		{"program.bin", valid, true},
+		{"program", hexRecord(hexData, 0x100, 0x90), false}, // No end of file
+		{"program", ":01010000900F\n" + valid, false},       // Bad checksum
+		{"program", "\x3a\x3f\xb8\x01\x00", false},          // cmp bh, [bx]
+		{"program", ":", false},
+		{"program.hex", ":01010000900F\n", true},
+		{"PROGRAM.IHX", "", true},
+	}
+	for _, test := range tests {
+		if hex := isIntelHex(namedReader{nil, test.name}, []byte(test.content)); hex != test.hex {
+			t.Errorf("%s %q: Intel HEX %t, expected %t", test.name, test.content, hex, test.hex)
+		}
+	}
+
+	// A flat binary starting with CMP is loaded as it is
+	trace := &bytes.Buffer{}
+	store := NewStorage(trace)
+	program := []byte{0x3A, 0x3F, 0xB8, 0x01, 0x00}
+	base, err := store.loadProgram(bytes.NewReader(program), codeSegment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base != 0x10000 || !bytes.Equal(store.memory[base:base+len(program)], program) {
+		t.Errorf("loaded at 0x%05x % x, expected % x at 0x10000", base, store.memory[base:base+len(program)], program)
+	}
+	if _, err := store.step(); err != nil || !strings.HasPrefix(trace.String(), "cmp bh, [bx]") {
+		t.Errorf("first instruction %q (%v), expected cmp bh, [bx]", trace, err)
+	}
+}
+
+// A ROM dump loaded at its address and started at the reset vector, the
+// errors are returned instead of stopping the simulator.
+func TestLoadAtOrigin(t *testing.T) {
+	tests := []struct {
+		origin, entry string
+		size          int
+		cs, ip        uint16
+		expected      string
+	}{
+		{"F000:0000", "", 0x10000, 0xF000, 0x0000, ""},
+		{"F000:0000", "F000:FFF0", 0x10000, 0xF000, 0xFFF0, ""},
+		{"F000:0000", "FFFF:0000", 0x10000, 0xFFFF, 0x0000, ""},
+		{"1000:0000", "1000:0010", 0x10, 0, 0, "entry 1000:0010 is after the end of the program at 0x10010"},
+		{"F000:FFFE", "", 4, 0, 0, "program of 4 bytes does not fit in memory"},
+		{"F000", "", 4, 0, 0, "invalid address \"F000\", expected segment:offset"},
+		{"F000:0000", "G000:0000", 4, 0, 0, "invalid segment \"G000\""},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		program := bytes.Repeat([]byte{0xF4}, test.size) // hlt
+		err := Execute(bytes.NewReader(program), ExecuteOptions{Origin: test.origin, Entry: test.entry, DecodeOnly: true, PrintHex: true, Output: out})
+		if test.expected != "" {
+			if err == nil || err.Error() != test.expected || !strings.Contains(out.String(), test.expected) {
+				t.Errorf("-org %s -entry %s: error %v, expected %q\n%s", test.origin, test.entry, err, test.expected, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("-org %s -entry %s: %s", test.origin, test.entry, err)
+			continue
+		}
+
+		store := NewStorage(io.Discard)
+		_, err = store.loadAtOrigin(bytes.NewReader(program), test.origin)
+		if err == nil && test.entry != "" {
+			err = store.setEntry(test.entry)
+		}
+		if err != nil || store.getRegister("cs") != test.cs || store.getRegister("ip") != test.ip {
+			t.Errorf("-org %s -entry %s: entry %04x:%04x (%v), expected %04x:%04x", test.origin, test.entry,
+				store.getRegister("cs"), store.getRegister("ip"), err, test.cs, test.ip)
+		}
+	}
+}
+
+// A ROM of 256 bytes at F000:FF00, the reset vector at FFFF:0000 jump to its
+// start which write the POST codes.
+func TestBIOSBoot(t *testing.T) {
+	code, err := Assemble(strings.NewReader(`
+		mov al, 1
+		out 0x80, al
+		mov ax, 0x9000
+		mov ss, ax
+		mov sp, 0xfffe
+		mov al, 2
+		out 0x80, al
+		mov ax, 0x40
+		mov ds, ax
+		mov es, [0x10]
+		mov al, 3
+		out 0x80, al
+		hlt
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset, err := Assemble(strings.NewReader("jmp 0xf000:0xff00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := make([]byte, 0x100)
+	copy(rom, code)
+	copy(rom[0xF0:], reset)
+
+	out := &bytes.Buffer{}
+	// Interrupts are disabled after the reset, HLT never end
+	err = Execute(bytes.NewReader(rom), ExecuteOptions{BIOS: true, MaxInstructions: 100, PrintHex: true, Output: out})
+	if err != ErrInstructionLimit {
+		t.Fatalf("error %v, expected the instruction limit", err)
+	}
+	expected := []string{
+		"POST CODES ──────────────────────────\n01 02 03\n",
+		"│ cs │ 0x00   0xf0 │",
+		"│ ss │ 0x00   0x90 │",
+		"│ ds │ 0x40   0x00 │",
+	}
+	for _, text := range expected {
+		if !strings.Contains(out.String(), text) {
+			t.Errorf("%q not found\n%s", text, out)
+		}
+	}
+}
@@ -1,14 +1,45 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "asm":
+			assembleCommand(os.Args[2:])
+			return
+		case "conformance":
+			conformanceCommand(os.Args[2:])
+			return
+		case "dap":
+			dapCommand(os.Args[2:])
+			return
+		case "run-batch":
+			runBatchCommand(os.Args[2:])
+			return
+		case "diff":
+			diffCommand(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [flags] <path-to-instructions>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] -bios <path-to-rom>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s asm [flags] <path-to-source>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s conformance [flags] [path-to-test-vectors...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dap [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s run-batch [flags] [directory-or-program...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s diff [flags] <program> [<other-program>]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -17,6 +48,21 @@ func main() {
 		false,
 		"Only decode the instructions, do not execute them.",
 	)
+	recursiveFlag := flag.Bool(
+		"recursive",
+		false,
+		"With -decode, follow the jumps from the entry and show the bytes never reached as data",
+	)
+	listingFlag := flag.Bool(
+		"listing",
+		false,
+		"With -decode, show the offset, the bytes and the estimated cycles of each instruction like objdump",
+	)
+	cfgFlag := flag.String(
+		"cfg",
+		"",
+		"Save the control flow graph of the program in a Graphviz DOT file",
+	)
 	binaryFlag := flag.Bool(
 		"binary",
 		false,
@@ -27,10 +73,148 @@ func main() {
 		false,
 		"Dump memory into a `memory.data` file at the end of the program",
 	)
+	profileFlag := flag.Bool(
+		"profile",
+		false,
+		"Print the instructions that cost the most cycles at the end of the program",
+	)
+	memoryFlag := flag.Bool(
+		"memory",
+		false,
+		"Print the memory accesses and the working set at the end of the program",
+	)
+	heatmapFlag := flag.String(
+		"heatmap",
+		"",
+		"Save a PNG heatmap of the memory accesses to this file",
+	)
+	gdbFlag := flag.String(
+		"gdb",
+		"",
+		"Wait for GDB to connect on this address (e.g. `:1234`) and let it drive the execution",
+	)
+	sourceListingFlag := flag.String(
+		"lst",
+		"",
+		"NASM listing of the program, made with nasm -l, to show its source in the trace. Default to the program path with .lst appended when it exist",
+	)
+	cpuFlag := flag.String(
+		"cpu",
+		"8086",
+		"Processor model: 8086, 8088, 80186, 80188 or v20",
+	)
+	biuFlag := flag.Bool(
+		"biu",
+		false,
+		"Model the prefetch queue and the bus of the processor and print its cycles next to the table estimate",
+	)
+	fpuFlag := flag.Bool(
+		"fpu",
+		false,
+		"Add an 8087 coprocessor to execute the ESC instructions, without it they only read their memory operand",
+	)
+	keysFlag := flag.String(
+		"keys",
+		"",
+		"Scan codes in hexadecimal sent by the keyboard one after the other, like \"1e,9e\"",
+	)
+	biosFlag := flag.String(
+		"bios",
+		"",
+		"Boot a ROM image mapped at the top of the memory from FFFF:0000, instead of a program",
+	)
+	mapFlag := flag.String(
+		"map",
+		"",
+		"Regions of the memory with their kind, like \"rom:f0000-fffff,unmapped:a0000-bffff\", the rest is RAM",
+	)
+	displayFlag := flag.Bool(
+		"display",
+		false,
+		"Map the text memory of a CGA at B8000 and print the screen at the end",
+	)
+	trapCodeWritesFlag := flag.Bool(
+		"trap-code-writes",
+		false,
+		"Stop the execution when the program write to its own code",
+	)
+	trapUninitializedFlag := flag.Bool(
+		"trap-uninitialized",
+		false,
+		"Stop the execution when the program read memory that was never written",
+	)
+	warnUndefinedFlag := flag.Bool(
+		"warn-undefined",
+		false,
+		"Warn when the program use registers, memory or flags before writing them",
+	)
+	orgFlag := flag.String(
+		"org",
+		"",
+		"Load the program as raw bytes at this address in hexadecimal, like F000:FFF0, and start there",
+	)
+	entryFlag := flag.String(
+		"entry",
+		"",
+		"Start at this address in hexadecimal instead of the entry of the program, like F000:FFF0 with -org F000:0000",
+	)
+	waitStatesFlag := flag.Int(
+		"wait-states",
+		0,
+		"Wait states added to every bus cycle by the BIU model",
+	)
+	breakWhenFlag := flag.String(
+		"break-when",
+		"",
+		"Stop the execution and print the state when an expression like \"cx == 63 && [bp + 2] != 0\" become true",
+	)
+	watchReadFlag := flag.String(
+		"watch-read",
+		"",
+		"Stop the execution when the program read physical memory in ranges like \"20000-2000f,b8000\"",
+	)
+	watchWriteFlag := flag.String(
+		"watch-write",
+		"",
+		"Stop the execution when the program write physical memory in ranges like \"20000-2000f,b8000\"",
+	)
+	watchRegisterFlag := flag.String(
+		"watch-register",
+		"",
+		"Stop the execution when one of these registers, like \"ax,cl\", change",
+	)
+	maxInstructionsFlag := flag.Int(
+		"max-instructions",
+		0,
+		"Stop the execution after this many instructions, 0 for no limit",
+	)
+	maxCyclesFlag := flag.Int(
+		"max-cycles",
+		0,
+		"Stop the execution after this many estimated cycles, 0 for no limit",
+	)
+	timeoutFlag := flag.Duration(
+		"timeout",
+		0,
+		"Stop the execution after this long, like 10s, 0 for no limit",
+	)
+	detectLoopsFlag := flag.Bool(
+		"detect-loops",
+		true,
+		"Stop the execution when the program is stuck in an infinite loop",
+	)
 	flag.Parse()
 
 	// Open file with assembly insructions to decode
 	filePath := flag.Arg(0)
+	if *biosFlag != "" {
+		filePath = *biosFlag
+	}
+	if *sourceListingFlag == "" {
+		if _, err := os.Stat(filePath + ".lst"); err == nil {
+			*sourceListingFlag = filePath + ".lst"
+		}
+	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -38,5 +222,346 @@ func main() {
 	}
 	defer file.Close()
 
-	Execute(file, *decodeFlag, !*binaryFlag, *dumpFlag)
+	keys, err := parseScanCodes(*keysFlag)
+	if err != nil {
+		panic(err)
+	}
+
+	err = Execute(file, ExecuteOptions{
+		DecodeOnly: *decodeFlag,
+		Recursive:  *recursiveFlag,
+		CFG:        *cfgFlag,
+		PrintHex:   !*binaryFlag,
+		DumpMemory: *dumpFlag,
+		Profile:    *profileFlag,
+		Memory:     *memoryFlag,
+		Heatmap:    *heatmapFlag,
+		GDB:        *gdbFlag,
+		Listing:    *sourceListingFlag,
+		BreakWhen:  *breakWhenFlag,
+		CPU:        *cpuFlag,
+		BIU:        *biuFlag,
+		WaitStates: *waitStatesFlag,
+		FPU:        *fpuFlag,
+		Keys:       keys,
+		Origin:     *orgFlag,
+		Entry:      *entryFlag,
+		BIOS:       *biosFlag != "",
+		MemoryMap:  *mapFlag,
+		Display:    *displayFlag,
+
+		TrapCodeWrites:    *trapCodeWritesFlag,
+		TrapUninitialized: *trapUninitializedFlag,
+		WarnUndefined:     *warnUndefinedFlag,
+
+		DecodeListing: *listingFlag,
+
+		Watches: Watches{
+			Read:      *watchReadFlag,
+			Write:     *watchWriteFlag,
+			Registers: *watchRegisterFlag,
+		},
+
+		MaxInstructions: *maxInstructionsFlag,
+		MaxCycles:       *maxCyclesFlag,
+		Timeout:         *timeoutFlag,
+		DetectLoops:     *detectLoopsFlag,
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// Assemble a NASM source file into a flat binary, like `nasm file.asm` would.
+func assembleCommand(args []string) {
+	flags := flag.NewFlagSet("asm", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s asm [flags] <path-to-source>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	outputFlag := flags.String(
+		"o",
+		"",
+		"Output file, default to the source path without its extension",
+	)
+	flags.Parse(args)
+
+	sourcePath := flags.Arg(0)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		panic(err)
+	}
+	defer source.Close()
+
+	machineCode, err := Assemble(source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", sourcePath, err)
+		os.Exit(1)
+	}
+
+	outputPath := *outputFlag
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(sourcePath, filepath.Ext(sourcePath))
+	}
+	err = os.WriteFile(outputPath, machineCode, 0644)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Run the SingleStepTests test vectors, by default the ones in testdata/8088
+func conformanceCommand(args []string) {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s conformance [flags] [path-to-test-vectors...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	verboseFlag := flags.Bool(
+		"v",
+		false,
+		"Print the differences for each failing test vector",
+	)
+	cyclesFlag := flags.Bool(
+		"cycles",
+		false,
+		"Fail the test vectors whose estimated cycles differ from their bus cycles",
+	)
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{filepath.Join("testdata", "8088")}
+	}
+
+	err := RunConformance(paths, *verboseFlag, *cyclesFlag, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Debug programs from an editor with the Debug Adapter Protocol, the program
+// is given by the editor in the launch request.
+func dapCommand(args []string) {
+	flags := flag.NewFlagSet("dap", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s dap [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	listenFlag := flags.String(
+		"listen",
+		"",
+		"Wait for the editor on this address (like :4711) instead of using stdin and stdout",
+	)
+	flags.Parse(args)
+
+	err := ServeDAP(*listenFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Run many programs concurrently and write a report of their final state
+func runBatchCommand(args []string) {
+	flags := flag.NewFlagSet("run-batch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s run-batch [flags] [directory-or-program...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	manifestFlag := flags.String(
+		"manifest",
+		"",
+		"File listing the programs to run, one per line relative to the manifest",
+	)
+	workersFlag := flags.Int(
+		"j",
+		runtime.NumCPU(),
+		"Number of programs executed at the same time",
+	)
+	formatFlag := flags.String(
+		"format",
+		"csv",
+		"Format of the report, csv or json",
+	)
+	outputFlag := flags.String(
+		"o",
+		"",
+		"Write the report to this file instead of stdout",
+	)
+	timeoutFlag := flags.Duration(
+		"timeout",
+		10*time.Second,
+		"Stop each program after this long, 0 for no limit",
+	)
+	maxInstructionsFlag := flags.Int(
+		"max-instructions",
+		0,
+		"Stop each program after this many instructions, 0 for no limit",
+	)
+	maxCyclesFlag := flags.Int(
+		"max-cycles",
+		0,
+		"Stop each program after this many estimated cycles, 0 for no limit",
+	)
+	detectLoopsFlag := flags.Bool(
+		"detect-loops",
+		true,
+		"Stop each program when it is stuck in an infinite loop",
+	)
+	watchReadFlag := flags.String(
+		"watch-read",
+		"",
+		"Stop each program when it read physical memory in ranges like \"20000-2000f,b8000\"",
+	)
+	watchWriteFlag := flags.String(
+		"watch-write",
+		"",
+		"Stop each program when it write physical memory in ranges like \"20000-2000f,b8000\"",
+	)
+	watchRegisterFlag := flags.String(
+		"watch-register",
+		"",
+		"Stop each program when one of these registers, like \"ax,cl\", change",
+	)
+	flags.Parse(args)
+
+	programs, err := findBatchPrograms(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *manifestFlag != "" {
+		listed, err := readBatchManifest(*manifestFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		programs = append(programs, listed...)
+	}
+	if len(programs) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	write := WriteBatchCSV
+	switch *formatFlag {
+	case "csv":
+	case "json":
+		write = WriteBatchJSON
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %s\n", *formatFlag)
+		os.Exit(2)
+	}
+
+	results := RunBatch(context.Background(), programs, BatchOptions{
+		Workers: *workersFlag,
+		Timeout: *timeoutFlag,
+		Limits: Limits{
+			MaxInstructions: *maxInstructionsFlag,
+			MaxCycles:       *maxCyclesFlag,
+			DetectLoops:     *detectLoopsFlag,
+		},
+		Watches: Watches{
+			Read:      *watchReadFlag,
+			Write:     *watchWriteFlag,
+			Registers: *watchRegisterFlag,
+		},
+	})
+
+	out := os.Stdout
+	if *outputFlag != "" {
+		out, err = os.Create(*outputFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+	err = write(out, results)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Run two programs, or one program with two configurations, in lockstep and
+// stop at the first divergence. With -golden the program is compared to a
+// trace saved from a previous run instead.
+func diffCommand(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s diff [flags] <program> [<other-program>]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	aFlag := flags.String(
+		"a",
+		"",
+		"Processor and initial registers of the first program, like cpu=8088,ax=1,ds=0x2000",
+	)
+	bFlag := flags.String(
+		"b",
+		"",
+		"Processor and initial registers of the second program, like cpu=8088,ax=1,ds=0x2000",
+	)
+	ignoreFlag := flags.String(
+		"ignore",
+		"",
+		"Comma separated registers and flags not compared, like ip,CF",
+	)
+	goldenFlag := flags.String(
+		"golden",
+		"",
+		"Compare the trace of the program to this output of a previous run, like result/0054",
+	)
+	maxInstructionsFlag := flags.Int(
+		"max-instructions",
+		10_000_000,
+		"Stop comparing after this many instructions, 0 for no limit",
+	)
+	flags.Parse(args)
+
+	options := DiffOptions{MaxInstructions: *maxInstructionsFlag}
+	if *ignoreFlag != "" {
+		options.Ignore = strings.Split(*ignoreFlag, ",")
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 || (*goldenFlag != "" && flags.NArg() != 1) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := newDiffSide("a", flags.Arg(0), *aFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	diverged := false
+	if *goldenFlag != "" {
+		golden, err := os.Open(*goldenFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer golden.Close()
+		diverged, err = DiffGolden(a, golden, options, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	} else {
+		other := flags.Arg(0)
+		if flags.NArg() == 2 {
+			other = flags.Arg(1)
+		}
+		b, err := newDiffSide("b", other, *bFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		diverged = DiffExecutions(a, b, options, os.Stdout)
+	}
+	if diverged {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The memory map give a kind to regions of the physical memory, the
+// addresses that are not in a region are RAM:
+//
+//   - RAM is read and written.
+//   - ROM is read, writes are ignored.
+//   - MMIO call functions of a device model on every access.
+//   - Unmapped read 0xFF like an open bus, writes are lost.
+//
+// Only the CPU go through the map, for the accesses of the instructions and
+// for their fetch. Loaders and debuggers use the memory directly.
+//
+// Two optional traps stop the execution after the instruction: a write to
+// the code of the program, which is not done, and a read of memory that was
+// never written.
+type MemoryMap struct {
+	regions []memoryRegion
+	code    []memoryRegion // Bytes loaded as the program
+
+	TrapCodeWrites    bool
+	TrapUninitialized bool
+
+	initialized []uint64 // One bit per byte written once
+}
+
+type regionKind int
+
+const (
+	regionRAM regionKind = iota
+	regionROM
+	regionMMIO
+	regionUnmapped
+)
+
+var regionKinds = map[string]regionKind{
+	"ram":      regionRAM,
+	"rom":      regionROM,
+	"mmio":     regionMMIO,
+	"unmapped": regionUnmapped,
+}
+
+var regionNames = map[regionKind]string{
+	regionRAM:      "RAM",
+	regionROM:      "ROM",
+	regionMMIO:     "MMIO",
+	regionUnmapped: "unmapped memory",
+}
+
+type memoryRegion struct {
+	name  string
+	first int
+	last  int
+	kind  regionKind
+
+	// MMIO only, the physical address is given
+	read  func(address int) byte
+	write func(address int, value byte)
+}
+
+// Returned when an instruction hit a trap of the memory map
+type MemoryTrap struct {
+	Address int    // Physical address of the access
+	Reason  string // What the instruction did
+}
+
+func (e *MemoryTrap) Error() string {
+	return fmt.Sprintf("memory trap at 0x%05x: %s", e.Address, e.Reason)
+}
+
+func NewMemoryMap() *MemoryMap {
+	return &MemoryMap{initialized: make([]uint64, len(Storage{}.memory)/64)}
+}
+
+// Add a region, it must not overlap another one
+func (m *MemoryMap) add(region memoryRegion) error {
+	if region.first > region.last || region.first < 0 || region.last >= len(m.initialized)*64 {
+		return fmt.Errorf("invalid memory region 0x%05x-0x%05x", region.first, region.last)
+	}
+	for _, r := range m.regions {
+		if region.first <= r.last && region.last >= r.first {
+			return fmt.Errorf("memory region %s 0x%05x-0x%05x overlap %s 0x%05x-0x%05x", region.name, region.first, region.last, r.name, r.first, r.last)
+		}
+	}
+	if region.kind == regionROM || region.kind == regionMMIO {
+		m.initialize(region.first, region.last-region.first+1)
+	}
+	m.regions = append(m.regions, region)
+	return nil
+}
+
+// Map a device on the memory, like the video memory of a display adapter
+func (m *MemoryMap) mapIO(name string, first int, last int, read func(int) byte, write func(int, byte)) error {
+	return m.add(memoryRegion{name, first, last, regionMMIO, read, write})
+}
+
+// The program was loaded there, its bytes are initialized
+func (m *MemoryMap) loaded(first int, size int) {
+	if size <= 0 {
+		return
+	}
+	m.code = append(m.code, memoryRegion{name: "program", first: first, last: first + size - 1})
+	m.initialize(first, size)
+}
+
+// Region of an address, nil for RAM
+func (m *MemoryMap) find(address int) *memoryRegion {
+	for n := range m.regions {
+		if address >= m.regions[n].first && address <= m.regions[n].last {
+			return &m.regions[n]
+		}
+	}
+	return nil
+}
+
+func (m *MemoryMap) isCode(address int) bool {
+	for _, r := range m.code {
+		if address >= r.first && address <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryMap) initialize(address int, size int) {
+	for a := address; a < address+size; a++ {
+		a := a % (len(m.initialized) * 64)
+		m.initialized[a/64] |= 1 << (a % 64)
+	}
+}
+
+func (m *MemoryMap) isInitialized(address int) bool {
+	return m.initialized[address/64]&(1<<(address%64)) != 0
+}
+
+// Parse regions like "rom:f0000-fffff,unmapped:a0000-bffff", the addresses
+// are physical and in hexadecimal. MMIO regions need a device and cannot be
+// given this way, the text display of -display is one.
+func parseMemoryMap(m *MemoryMap, text string) error {
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kindText, rangeText, ok := strings.Cut(field, ":")
+		kind, known := regionKinds[strings.ToLower(kindText)]
+		if !ok || !known || kind == regionMMIO {
+			return fmt.Errorf("invalid memory region %q, expected ram, rom or unmapped:first-last", field)
+		}
+		firstText, lastText, ok := strings.Cut(rangeText, "-")
+		first, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(firstText), "0x"), 16, 20)
+		if err != nil || !ok {
+			return fmt.Errorf("invalid memory region %q, expected ram, rom or unmapped:first-last", field)
+		}
+		last, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(lastText), "0x"), 16, 20)
+		if err != nil {
+			return fmt.Errorf("invalid memory region %q, expected ram, rom or unmapped:first-last", field)
+		}
+		err = m.add(memoryRegion{name: regionNames[kind], first: int(first), last: int(last), kind: kind})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==================
+// ===== ACCESS =====
+// ==================
+
+// The trap hit by the last instruction, nil when there is none
+func (store *Storage) takeTrap() error {
+	if store.trap == nil {
+		return nil
+	}
+	err := store.trap
+	store.trap = nil
+	return err
+}
+
+// Read a byte for an instruction through the memory map
+func (store *Storage) readMapped(address int) byte {
+	m := store.memoryMap
+	if m.TrapUninitialized && !m.isInitialized(address) && store.trap == nil {
+		store.trap = &MemoryTrap{address, "read of uninitialized memory"}
+	}
+	region := m.find(address)
+	switch {
+	case region == nil:
+	case region.kind == regionMMIO:
+		return region.read(address)
+	case region.kind == regionUnmapped:
+		return 0xFF
+	}
+	return store.memory[address]
+}
+
+// Write a byte for an instruction through the memory map, return the name of
+// the region when the write is not done.
+func (store *Storage) writeMapped(address int, value byte) (ignored string) {
+	m := store.memoryMap
+	region := m.find(address)
+	switch {
+	case region == nil, region.kind == regionRAM:
+		if m.TrapCodeWrites && m.isCode(address) {
+			if store.trap == nil {
+				store.trap = &MemoryTrap{address, "write to the code of the program"}
+			}
+			return "code"
+		}
+	case region.kind == regionROM, region.kind == regionUnmapped:
+		return region.name
+	case region.kind == regionMMIO:
+		// The value is kept in memory to be shown in the trace
+		region.write(address, value)
+	}
+	store.memory[address] = value
+	m.initialize(address, 1)
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Write "Hi" on the first row and "!" on the second, read back the H
+func TestTextDisplay(t *testing.T) {
+	code, err := Assemble(strings.NewReader(`
+		mov ax, 0xb800
+		mov ds, ax
+		mov word [0], 0x0748
+		mov byte [2], 'i'
+		mov byte [162], '!'
+		mov bl, [0]
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	err = Execute(bytes.NewReader(code), ExecuteOptions{Display: true, PrintHex: true, Output: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"SCREEN ────────────────────────────\nHi\n !\n",
+		"│ bx │ 0x48 │ 0x00 │",
+	}
+	for _, text := range expected {
+		if !strings.Contains(out.String(), text) {
+			t.Errorf("%q not found\n%s", text, out)
+		}
+	}
+
+	// Stepping back restore the display
+	store := NewStorage(io.Discard)
+	store.load(bytes.NewReader(code), codeSegment, 0)
+	store.display = NewTextDisplay()
+	if err := store.display.mapOn(store.memoryMap); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDebugger(store)
+	for d.Step().kind == stopStep {
+	}
+	if store.display.cells[162] != '!' {
+		t.Fatalf("display not written: % x", store.display.cells[:4])
+	}
+	for d.StepBack().kind == stopStep {
+	}
+	if store.display.written() {
+		t.Errorf("display still written after stepping back: % x", store.display.cells[:4])
+	}
+
+	// Without a write the screen is not printed
+	out.Reset()
+	err = Execute(bytes.NewReader([]byte{0xB0, 0x01}), ExecuteOptions{Display: true, Output: out})
+	if err != nil || strings.Contains(out.String(), "SCREEN") {
+		t.Errorf("empty screen printed (%v)\n%s", err, out)
+	}
+}
+
+// The CPU fetch the instructions through the map, a debugger see the memory
+func TestFetchThroughMap(t *testing.T) {
+	store := NewStorage(io.Discard)
+	display := NewTextDisplay()
+	if err := display.mapOn(store.memoryMap); err != nil {
+		t.Fatal(err)
+	}
+	copy(display.cells[:], []byte{0xB8, 0x07, 0x00}) // mov ax, 7
+	store.setRegister("cs", 0xB800)
+	store.setRegister("ip", 0)
+
+	i, err := store.step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.String() != "mov ax, 7" || store.getRegister("ax") != 7 {
+		t.Errorf("executed %q ax %d, expected mov ax, 7", &i, store.getRegister("ax"))
+	}
+
+	debugged, err := store.cpu.Decode(&memoryReader{store, textDisplayAt, false})
+	if err != nil || debugged.String() != "add [bx + si], al" {
+		t.Errorf("debugger decoded %q (%v), expected the memory under the display", &debugged, err)
+	}
+
+	// Unmapped memory read 0xFF, not an instruction
+	err = parseMemoryMap(store.memoryMap, "unmapped:10000-1ffff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(store.memory[0x10000:], []byte{0xB0, 0x01}) // mov al, 1
+	store.setRegister("cs", 0x1000)
+	store.setRegister("ip", 0)
+	if i, err := store.step(); err == nil {
+		t.Errorf("executed %q from unmapped memory", &i)
+	}
+}
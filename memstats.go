@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// Size of a cache line, used to group memory accesses in the report
+const memoryLineSize = 64
+
+// Count the bytes read and written at each address of the memory.
+type MemoryStats struct {
+	reads       map[int]int // Physical address to number of reads
+	writes      map[int]int // Physical address to number of writes
+	readAccess  int
+	writeAccess int
+}
+
+func NewMemoryStats() *MemoryStats {
+	return &MemoryStats{reads: map[int]int{}, writes: map[int]int{}}
+}
+
+func (m *MemoryStats) observeRead(address int, size int) {
+	m.readAccess++
+	for i := 0; i < size; i++ {
+		m.reads[(address+i)&0xFFFFF]++
+	}
+}
+
+func (m *MemoryStats) observeWrite(address int, size int) {
+	m.writeAccess++
+	for i := 0; i < size; i++ {
+		m.writes[(address+i)&0xFFFFF]++
+	}
+}
+
+// Return the number of reads and writes per line
+func (m *MemoryStats) lines() map[int][2]int {
+	lines := map[int][2]int{}
+	for address, count := range m.reads {
+		line := lines[address/memoryLineSize]
+		line[0] += count
+		lines[address/memoryLineSize] = line
+	}
+	for address, count := range m.writes {
+		line := lines[address/memoryLineSize]
+		line[1] += count
+		lines[address/memoryLineSize] = line
+	}
+	return lines
+}
+
+func (m *MemoryStats) Print(out io.Writer, top int) {
+	readBytes, writeBytes := 0, 0
+	for _, count := range m.reads {
+		readBytes += count
+	}
+	for _, count := range m.writes {
+		writeBytes += count
+	}
+	touched := map[int]bool{}
+	for address := range m.reads {
+		touched[address] = true
+	}
+	for address := range m.writes {
+		touched[address] = true
+	}
+	lines := m.lines()
+
+	fmt.Fprintf(out, "  reads        %10d accesses %10d bytes %10d addresses\n", m.readAccess, readBytes, len(m.reads))
+	fmt.Fprintf(out, "  writes       %10d accesses %10d bytes %10d addresses\n", m.writeAccess, writeBytes, len(m.writes))
+	fmt.Fprintf(out, "  working set  %10d bytes    %10d lines of %d bytes\n", len(touched), len(lines), memoryLineSize)
+
+	hottest := make([]int, 0, len(lines))
+	for line := range lines {
+		hottest = append(hottest, line)
+	}
+	sort.Slice(hottest, func(a, b int) bool {
+		countA := lines[hottest[a]][0] + lines[hottest[a]][1]
+		countB := lines[hottest[b]][0] + lines[hottest[b]][1]
+		if countA != countB {
+			return countA > countB
+		}
+		return hottest[a] < hottest[b]
+	})
+	if len(hottest) > top {
+		hottest = hottest[:top]
+	}
+
+	if len(hottest) > 0 {
+		fmt.Fprintf(out, "\n  line     %10s %10s\n", "reads", "writes")
+	}
+	for _, line := range hottest {
+		fmt.Fprintf(out, "  %05x    %10d %10d\n", line*memoryLineSize, lines[line][0], lines[line][1])
+	}
+}
+
+// Save a heatmap of the accessed memory as a PNG. Each row is a line of
+// memory and each pixel a byte, from the lowest to the highest line that was
+// accessed. Reads are green, writes are red and the brightness is the number
+// of accesses on a log scale. Without any access the image is a black line.
+func (m *MemoryStats) SaveHeatmap(path string) error {
+	first, last, maxCount := math.MaxInt, -1, 0
+	for _, counts := range []map[int]int{m.reads, m.writes} {
+		for address, count := range counts {
+			first = min(first, address/memoryLineSize)
+			last = max(last, address/memoryLineSize)
+			maxCount = max(maxCount, count)
+		}
+	}
+	if last < 0 {
+		// A program that never touch the memory get an empty line
+		first, last = 0, 0
+	}
+
+	intensity := func(count int) uint8 {
+		if count == 0 {
+			return 0
+		}
+		// Even a single access must be visible
+		return uint8(64 + 191*math.Log1p(float64(count))/math.Log1p(float64(maxCount)))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, memoryLineSize, last-first+1))
+	for line := first; line <= last; line++ {
+		for x := 0; x < memoryLineSize; x++ {
+			address := line*memoryLineSize + x
+			img.Set(x, line-first, color.RGBA{
+				R: intensity(m.writes[address]),
+				G: intensity(m.reads[address]),
+				A: 255,
+			})
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return png.Encode(file, img)
+}
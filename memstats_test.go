@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Accesses are counted per byte and per line, the addresses wrap around at
+// 1MB.
+func TestMemoryStats(t *testing.T) {
+	m := NewMemoryStats()
+	m.observeRead(0x100, 2)
+	m.observeRead(0x100, 1)
+	m.observeWrite(0x13F, 2)
+	m.observeWrite(0xFFFFF, 2)
+
+	out := &strings.Builder{}
+	m.Print(out, 2)
+	expected := "" +
+		fmt.Sprintf("  reads        %10d accesses %10d bytes %10d addresses\n", 2, 3, 2) +
+		fmt.Sprintf("  writes       %10d accesses %10d bytes %10d addresses\n", 2, 4, 4) +
+		fmt.Sprintf("  working set  %10d bytes    %10d lines of 64 bytes\n", 6, 4) +
+		fmt.Sprintf("\n  line     %10s %10s\n", "reads", "writes") +
+		fmt.Sprintf("  00100    %10d %10d\n", 3, 1) +
+		fmt.Sprintf("  00000    %10d %10d\n", 0, 1)
+	if out.String() != expected {
+		t.Errorf("memory statistics:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	// Lines 4 and 5, read in green and written in red
+	path := filepath.Join(t.TempDir(), "heatmap.png")
+	m = NewMemoryStats()
+	m.observeRead(0x100, 1)
+	m.observeWrite(0x141, 1)
+	if err := m.SaveHeatmap(path); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixels := []struct {
+		x, y    int
+		r, g, b uint8
+	}{
+		{0, 0, 0, 255, 0},
+		{1, 0, 0, 0, 0},
+		{1, 1, 255, 0, 0},
+		{0, 1, 0, 0, 0},
+	}
+	if size := img.Bounds().Size(); size.X != memoryLineSize || size.Y != 2 {
+		t.Fatalf("heatmap of %v, expected two lines", size)
+	}
+	for _, p := range pixels {
+		c := color.RGBAModel.Convert(img.At(p.x, p.y)).(color.RGBA)
+		if c.R != p.r || c.G != p.g || c.B != p.b {
+			t.Errorf("pixel %d,%d is %v, expected %d %d %d", p.x, p.y, c, p.r, p.g, p.b)
+		}
+	}
+}
+
+// A program that only use registers still get a heatmap
+func TestEmptyHeatmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "heatmap.png")
+	code, err := os.ReadFile("part1/listing_0037_single_register_mov")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Execute(bytes.NewReader(code), ExecuteOptions{Heatmap: path, Output: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != memoryLineSize || size.Y != 1 {
+		t.Errorf("heatmap of %v, expected one line", size)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+// Model of the 8259 programmable interrupt controller (PIC) of the PC, alone
+// without a slave.
+//
+// Devices raise the 8 interrupt request lines, IRQ 0 has the highest priority.
+// A request is remembered in the IRR until the CPU acknowledge it, then it is
+// in service in the ISR until the handler send an end of interrupt (EOI).
+// Requests masked in the IMR are not given to the CPU. Requests are edge
+// triggered and the priorities are fixed, the rotations are not supported.
+//
+// Port 0x20 take ICW1, OCW2 and OCW3 and read the IRR or the ISR, port 0x21
+// take ICW2 to ICW4 during the initialization and the IMR after.
+type PIC struct {
+	irr  byte // Interrupt request register
+	isr  byte // In service register
+	imr  byte // Interrupt mask register
+	base byte // Vector of IRQ 0, from ICW2
+
+	next    int  // Next ICW expected on port 0x21, 0 when initialized
+	single  bool // No ICW3
+	icw4    bool // ICW4 is expected
+	autoEOI bool // The request is not kept in service
+	readISR bool // Port 0x20 read the ISR instead of the IRR
+	poll    bool // The next read of port 0x20 is a poll
+}
+
+// Everything is masked until the program initialize the PIC, the vectors are
+// those of the PC BIOS.
+func NewPIC() *PIC {
+	return &PIC{imr: 0xFF, base: 0x08}
+}
+
+func (p *PIC) portRead(port uint16) byte {
+	if port&1 == 1 {
+		return p.imr
+	}
+	if p.poll {
+		// The poll command acknowledge the highest request
+		p.poll = false
+		irq, ok := p.highest()
+		if !ok {
+			return 0
+		}
+		p.acknowledge(irq)
+		return 0x80 | byte(irq)
+	}
+	if p.readISR {
+		return p.isr
+	}
+	return p.irr
+}
+
+func (p *PIC) portWrite(port uint16, value byte) {
+	if port&1 == 1 {
+		switch p.next {
+		case 2:
+			p.base = value & 0xF8
+			p.next = 3
+			if p.single {
+				p.next = 4
+			}
+			if p.next == 4 && !p.icw4 {
+				p.next = 0
+			}
+		case 3:
+			// ICW3, the slaves are not modeled
+			p.next = 4
+			if !p.icw4 {
+				p.next = 0
+			}
+		case 4:
+			p.autoEOI = value&0b10 != 0
+			p.next = 0
+		default:
+			p.imr = value
+		}
+		return
+	}
+
+	switch {
+	case value&0x10 != 0:
+		// ICW1 start the initialization
+		p.single, p.icw4 = value&0b10 != 0, value&0b1 != 0
+		p.next = 2
+		p.irr, p.isr, p.imr = 0, 0, 0
+		p.readISR, p.poll, p.autoEOI = false, false, false
+	case value&0x08 != 0:
+		// OCW3
+		if value&0b10 != 0 {
+			p.readISR = value&0b1 != 0
+		}
+		p.poll = value&0b100 != 0
+	default:
+		// OCW2, only the end of interrupt commands
+		switch value >> 5 {
+		case 0b001:
+			for irq := 0; irq < 8; irq++ {
+				if p.isr&(1<<irq) != 0 {
+					p.isr &^= 1 << irq
+					break
+				}
+			}
+		case 0b011:
+			p.isr &^= 1 << (value & 0b111)
+		}
+	}
+}
+
+// A device raise an interrupt request line
+func (p *PIC) request(irq int) {
+	p.irr |= 1 << irq
+}
+
+// Highest priority request that is not masked and not blocked by an interrupt
+// in service of the same or higher priority.
+func (p *PIC) highest() (int, bool) {
+	for irq := 0; irq < 8; irq++ {
+		if p.isr&(1<<irq) != 0 {
+			return 0, false
+		}
+		if p.irr&^p.imr&(1<<irq) != 0 {
+			return irq, true
+		}
+	}
+	return 0, false
+}
+
+func (p *PIC) acknowledge(irq int) {
+	p.irr &^= 1 << irq
+	if !p.autoEOI {
+		p.isr |= 1 << irq
+	}
+}
+
+// Give the highest request and its vector to the CPU, ok is false when there
+// is no request to give.
+func (p *PIC) interrupt() (irq int, vector byte, ok bool) {
+	if p.next != 0 {
+		return 0, 0, false
+	}
+	irq, ok = p.highest()
+	if !ok {
+		return 0, 0, false
+	}
+	p.acknowledge(irq)
+	return irq, p.base + byte(irq), true
+}
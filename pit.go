@@ -0,0 +1,223 @@
+package main
+
+// Model of the 8253 programmable interval timer (PIT) of the PC.
+//
+// The PIT is clocked at 1.193182 MHz, a quarter of the 4.77 MHz of the CPU,
+// so it count once every 4 cycles. Counter 0 is the system timer on IRQ 0,
+// counter 1 refresh the memory and counter 2 drive the speaker, its gate is
+// bit 0 of port B of the PPI.
+//
+// Ports 0x40 to 0x42 are the counters and 0x43 the control word. Modes 1 and
+// 5 are started by the gate, the gates of counters 0 and 1 are always high so
+// they start when the count is written like modes 0 and 4.
+type PIT struct {
+	counters [3]pitCounter
+	cycles   int // Cycles of the CPU already turned into PIT clocks
+	phase    int // Cycles of the CPU not turned into a PIT clock yet
+
+	// Optional, called when the output of a counter rise
+	output func(counter int)
+}
+
+type pitCounter struct {
+	mode     byte
+	access   byte // 1 LSB only, 2 MSB only, 3 LSB then MSB
+	bcd      bool
+	reload   int // Initial count, 65536 for 0
+	count    int
+	counting bool // A count was written since the control word
+	done     bool // The one shot modes reached the terminal count
+	out      bool
+	gate     bool
+
+	low      byte // LSB waiting for the MSB
+	writeMSB bool // The next write is the MSB
+	readMSB  bool // The next read is the MSB
+	latched  bool
+	latch    uint16
+}
+
+// CPU cycles per PIT clock
+const pitDivider = 4
+
+func NewPIT() *PIT {
+	p := &PIT{}
+	for n := range p.counters {
+		p.counters[n].gate = n != 2
+		p.counters[n].access = 3
+	}
+	return p
+}
+
+func (p *PIT) portRead(port uint16) byte {
+	if port&3 == 3 {
+		return 0xFF // The control word cannot be read on the 8253
+	}
+	c := &p.counters[port&3]
+	value := c.latch
+	if !c.latched {
+		value = c.value()
+	}
+
+	msb := c.access == 2 || c.access == 3 && c.readMSB
+	if c.access == 3 {
+		c.readMSB = !c.readMSB
+	}
+	if c.latched && (c.access != 3 || !c.readMSB) {
+		c.latched = false
+	}
+	if msb {
+		return byte(value >> 8)
+	}
+	return byte(value)
+}
+
+func (p *PIT) portWrite(port uint16, value byte) {
+	if port&3 == 3 {
+		p.control(value)
+		return
+	}
+	c := &p.counters[port&3]
+	switch c.access {
+	case 1:
+		c.load(uint16(value))
+	case 2:
+		c.load(uint16(value) << 8)
+	case 3:
+		if !c.writeMSB {
+			c.low = value
+			c.writeMSB = true
+			return
+		}
+		c.writeMSB = false
+		c.load(uint16(value)<<8 | uint16(c.low))
+	}
+}
+
+// Control word: counter, access, mode and BCD
+func (p *PIT) control(value byte) {
+	n := value >> 6
+	if n == 3 {
+		return // Read back command of the 8254
+	}
+	c := &p.counters[n]
+	access := value >> 4 & 0b11
+	if access == 0 {
+		// Counter latch command
+		if !c.latched {
+			c.latched, c.latch = true, c.value()
+		}
+		return
+	}
+
+	mode := value >> 1 & 0b111
+	if mode >= 6 {
+		mode -= 4 // 110 and 111 are modes 2 and 3
+	}
+	c.mode, c.access, c.bcd = mode, access, value&1 == 1
+	c.counting, c.done, c.latched = false, false, false
+	c.writeMSB, c.readMSB = false, false
+	c.out = mode != 0
+}
+
+// Count as read by the program
+func (c *pitCounter) value() uint16 {
+	count := c.count
+	if !c.bcd {
+		return uint16(count)
+	}
+	count %= 10000
+	return uint16(count/1000<<12 | count/100%10<<8 | count/10%10<<4 | count%10)
+}
+
+// A count is written, a new count in modes 2 and 3 wait for the end of the
+// current period.
+func (c *pitCounter) load(value uint16) {
+	c.reload = int(value)
+	if c.bcd {
+		c.reload = int(value>>12)*1000 + int(value>>8&0xF)*100 + int(value>>4&0xF)*10 + int(value&0xF)
+	}
+	if c.reload == 0 {
+		c.reload = 0x10000
+		if c.bcd {
+			c.reload = 10000
+		}
+	}
+
+	if (c.mode == 2 || c.mode == 3) && c.counting {
+		return
+	}
+	c.count = c.reload
+	c.counting, c.done = true, false
+	c.out = c.mode != 0
+}
+
+// The gate of counter 2 is driven by the PPI, in modes 2 and 3 a low gate
+// force the output high and the rising edge restart the count.
+func (p *PIT) setGate(n int, gate bool) {
+	c := &p.counters[n]
+	if gate == c.gate {
+		return
+	}
+	c.gate = gate
+	switch {
+	case !gate && (c.mode == 2 || c.mode == 3):
+		c.out = true
+	case gate && c.counting && c.mode != 0 && c.mode != 4:
+		c.count, c.done = c.reload, false
+	}
+}
+
+func (p *PIT) advance(cycles int) {
+	clocks := (cycles - p.cycles) / pitDivider
+	p.cycles += clocks * pitDivider
+	p.phase = cycles - p.cycles
+	for n := range p.counters {
+		c := &p.counters[n]
+		if !c.counting {
+			continue
+		}
+		for t := 0; t < clocks; t++ {
+			if c.gate && c.tick() && p.output != nil {
+				p.output(n)
+			}
+		}
+	}
+}
+
+// One PIT clock, return true when the output rise
+func (c *pitCounter) tick() bool {
+	switch c.mode {
+	case 2:
+		// The output go low for the last clock of each period
+		c.count--
+		if c.count == 0 {
+			c.count = c.reload
+			return true
+		}
+	case 3:
+		// Square wave, high for the first half of the period
+		c.count -= 2
+		if c.count <= 0 {
+			c.count = c.reload
+			c.out = !c.out
+			return c.out
+		}
+	default:
+		// One shot, the output rise at the terminal count and the counter
+		// keep going.
+		c.count--
+		if c.count == 0 {
+			c.count = 0x10000
+			if c.bcd {
+				c.count = 10000
+			}
+			if !c.done {
+				c.done = true
+				c.out = true
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// The I/O ports are a second address space of 64K bytes, accessed by IN and
+// OUT. Devices register the ports they answer, reading a port that nobody
+// answer give 0xFF like an open bus and writes to it are lost.
+//
+// A word is two bytes at port and port+1, like the 8088 would do.
+//
+// The state of the devices of the PC is saved with each instruction of the
+// undo log, going backward over IN and OUT bring them back. The devices of
+// ExecuteOptions.Devices are not saved.
+type PortBus struct {
+	ranges  []portRange
+	clocked []clockedDevice
+
+	// Devices of a PC, nil when they are not on the bus
+	pit   *PIT
+	pic   *PIC
+	ppi   *PPI
+	debug *DebugPort
+	post  *POSTPort
+}
+
+type portRange struct {
+	first  uint16
+	last   uint16
+	device device
+}
+
+// A device answer the IN and OUT of its ports
+type device interface {
+	portRead(port uint16) byte
+	portWrite(port uint16, value byte)
+}
+
+// Devices that change with time, like a timer, are advanced after every
+// instruction with the cycles since the start of the program.
+type clockedDevice interface {
+	advance(cycles int)
+}
+
+func NewPortBus() *PortBus {
+	return &PortBus{}
+}
+
+// Ports of the devices of an IBM PC, the POST card of port 0x80 and the debug
+// port used by emulators like Bochs.
+func NewPCPortBus() (*PortBus, error) {
+	bus := NewPortBus()
+	bus.pit = NewPIT()
+	bus.pic = NewPIC()
+	bus.ppi = NewPPI(bus.pit)
+	bus.debug = NewDebugPort()
+	bus.post = NewPOSTPort()
+	for _, r := range []portRange{
+		{0x20, 0x21, bus.pic},
+		{0x40, 0x43, bus.pit},
+		{0x60, 0x63, bus.ppi},
+		{0x80, 0x80, bus.post},
+		{0xE9, 0xE9, bus.debug},
+	} {
+		err := bus.register(r.first, r.last, r.device)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Counter 0 is the system timer and the keyboard interrupt on each key
+	bus.pit.output = func(counter int) {
+		if counter == 0 {
+			bus.pic.request(0)
+		}
+	}
+	bus.ppi.keyPressed = func() { bus.pic.request(1) }
+	return bus, nil
+}
+
+// A device added to the ports of the PC by ExecuteOptions.Devices, like the
+// card of an expansion slot.
+type PortDevice struct {
+	First  uint16
+	Last   uint16
+	Device device
+}
+
+// Give the ports first to last to a device, they must not be taken already
+func (bus *PortBus) register(first uint16, last uint16, d device) error {
+	if first > last {
+		return fmt.Errorf("invalid port range 0x%04x-0x%04x", first, last)
+	}
+	for _, r := range bus.ranges {
+		if first <= r.last && last >= r.first {
+			return fmt.Errorf("ports 0x%04x-0x%04x overlap 0x%04x-0x%04x", first, last, r.first, r.last)
+		}
+	}
+	bus.ranges = append(bus.ranges, portRange{first, last, d})
+	if c, ok := d.(clockedDevice); ok {
+		bus.clocked = append(bus.clocked, c)
+	}
+	return nil
+}
+
+func (bus *PortBus) find(port uint16) device {
+	for _, r := range bus.ranges {
+		if port >= r.first && port <= r.last {
+			return r.device
+		}
+	}
+	return nil
+}
+
+func (bus *PortBus) read(port uint16) byte {
+	if d := bus.find(port); d != nil {
+		return d.portRead(port)
+	}
+	return 0xFF
+}
+
+func (bus *PortBus) write(port uint16, value byte) {
+	if d := bus.find(port); d != nil {
+		d.portWrite(port, value)
+	}
+}
+
+// Part of the state of the devices of the PC that decide what they will do
+// next, the output of the debug port does not change anything.
+type devicesState struct {
+	pit      [3]pitCounter
+	phase    int // Cycles of the CPU since the last PIT clock, while it count
+	pic      PIC
+	portB    byte
+	keyboard int // Scan codes read
+}
+
+func (bus *PortBus) state() devicesState {
+	state := devicesState{}
+	if bus.pit != nil {
+		state.pit = bus.pit.counters
+		for _, c := range bus.pit.counters {
+			if c.counting {
+				state.phase = bus.pit.phase
+			}
+		}
+	}
+	if bus.pic != nil {
+		state.pic = *bus.pic
+	}
+	if bus.ppi != nil {
+		state.portB, state.keyboard = bus.ppi.portB, bus.ppi.read
+	}
+	return state
+}
+
+// Bring the devices back to a state saved when the CPU was at this cycle.
+// The PIT is clocked every pitDivider cycles since the start, its phase is
+// given by the cycle.
+func (bus *PortBus) restore(state devicesState, cycles int) {
+	if bus.pit != nil {
+		bus.pit.counters = state.pit
+		bus.pit.cycles, bus.pit.phase = cycles-cycles%pitDivider, cycles%pitDivider
+	}
+	if bus.pic != nil {
+		*bus.pic = state.pic
+	}
+	if bus.ppi != nil {
+		bus.ppi.portB, bus.ppi.read = state.portB, state.keyboard
+	}
+}
+
+func (bus *PortBus) advance(cycles int) {
+	for _, c := range bus.clocked {
+		c.advance(cycles)
+	}
+}
+
+// ======================
+// ===== DEBUG PORT =====
+// ======================
+
+// Print what the program write to it, the simplest way for firmware to say
+// something. Reading it give 0xE9 so that a program can check it is there.
+type DebugPort struct {
+	output []byte
+}
+
+func NewDebugPort() *DebugPort {
+	return &DebugPort{}
+}
+
+func (d *DebugPort) portRead(port uint16) byte {
+	return 0xE9
+}
+
+func (d *DebugPort) portWrite(port uint16, value byte) {
+	d.output = append(d.output, value)
+}
+
+// Print the bytes written, control characters other than new lines are
+// escaped.
+func (d *DebugPort) Print(out io.Writer) {
+	for _, b := range d.output {
+		if b == '\n' || b >= 0x20 && b < 0x7F {
+			out.Write([]byte{b})
+		} else {
+			fmt.Fprintf(out, "\\x%02x", b)
+		}
+	}
+	if len(d.output) > 0 && d.output[len(d.output)-1] != '\n' {
+		fmt.Fprint(out, "\n")
+	}
+}
+
+// ======================
+// ===== POST CODES =====
+// ======================
+
+// The BIOS write a code to port 0x80 before each step of the power on self
+// test (POST), a POST card show the last one to find where a PC hang. Every
+// code is kept, reading the port give the last one.
+type POSTPort struct {
+	codes []byte
+}
+
+func NewPOSTPort() *POSTPort {
+	return &POSTPort{}
+}
+
+func (p *POSTPort) portRead(port uint16) byte {
+	if len(p.codes) == 0 {
+		return 0xFF
+	}
+	return p.codes[len(p.codes)-1]
+}
+
+func (p *POSTPort) portWrite(port uint16, value byte) {
+	p.codes = append(p.codes, value)
+}
+
+// Print the codes in the order they were written, 16 per line
+func (p *POSTPort) Print(out io.Writer) {
+	for n, code := range p.codes {
+		separator := " "
+		if n%16 == 15 || n == len(p.codes)-1 {
+			separator = "\n"
+		}
+		fmt.Fprintf(out, "%02x%s", code, separator)
+	}
+}
+
+// ========================
+// ===== INSTRUCTIONS =====
+// ========================
+
+// Read a byte or a word from a port
+func (store *Storage) portIn(port uint16, size int) []byte {
+	if store.biu != nil {
+		store.biu.transfer(int(port), size)
+	}
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = store.ports.read(port + uint16(i))
+	}
+	return value
+}
+
+func (store *Storage) portOut(port uint16, value []byte) {
+	if store.biu != nil {
+		store.biu.transfer(int(port), len(value))
+	}
+	fmt.Fprintf(store.trace, "[port 0x%02x <- 0x%02x] ", port, value)
+	for i, b := range value {
+		store.ports.write(port+uint16(i), b)
+	}
+}
+
+// The port of IN and OUT, an immediate or DX
+func (store *Storage) portOf(operand string) uint16 {
+	if port, err := strconv.Atoi(operand); err == nil {
+		return uint16(port)
+	}
+	return store.getRegister("dx")
+}
+
+// Input from a port to AL or AX
+func in(store *Storage, i Instruction) {
+	store.write(i.operandLeft, store.portIn(store.portOf(i.operandRight), int(i.w)+1))
+}
+
+// Output AL or AX to a port
+func out(store *Storage, i Instruction) {
+	store.portOut(store.portOf(i.operandLeft), store.read(i.operandRight, int8(i.w)+1))
+}
+
+// Step of SI and DI for string instructions, backward when DF is set
+func (store *Storage) stringStep(size int) uint16 {
+	if store.getFlag(directionFlag) {
+		return uint16(-size)
+	}
+	return uint16(size)
+}
+
+// Input from port DX to ES:DI
+func ins(store *Storage, i Instruction) {
+	size := int(i.w) + 1
+	di := store.getRegister("di")
+	value := store.portIn(store.getRegister("dx"), size)
+	store.writeMemoryAt(physicalAddress(store.getRegister("es"), di), di, value)
+	store.write("di", binary.LittleEndian.AppendUint16(nil, di+store.stringStep(size)))
+}
+
+// Output DS:SI to port DX
+func outs(store *Storage, i Instruction) {
+	size := int(i.w) + 1
+	si := store.getRegister("si")
+	value := store.readMemoryAt(physicalAddress(store.getRegister("ds"), si), size)
+	store.portOut(store.getRegister("dx"), value)
+	store.write("si", binary.LittleEndian.AppendUint16(nil, si+store.stringStep(size)))
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// A device that remember what is written to it and answer its port number
+type recordingDevice struct {
+	written []byte
+}
+
+func (d *recordingDevice) portRead(port uint16) byte {
+	return byte(port)
+}
+
+func (d *recordingDevice) portWrite(port uint16, value byte) {
+	d.written = append(d.written, value)
+}
+
+func TestPortDevices(t *testing.T) {
+	code, err := Assemble(strings.NewReader("mov dx, 0x301\nmov al, 7\nout dx, al\nmov ax, 0x1234\nout dx, ax\nin ax, dx\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &recordingDevice{}
+	out := &bytes.Buffer{}
+	err = Execute(bytes.NewReader(code), ExecuteOptions{
+		Devices:  []PortDevice{{0x300, 0x302, d}},
+		PrintHex: true,
+		Output:   out,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.written, []byte{0x07, 0x34, 0x12}) {
+		t.Errorf("device got % x, expected 07 34 12", d.written)
+	}
+	if !strings.Contains(out.String(), "│ ax │ 0x01 │ 0x02 │") {
+		t.Errorf("in ax, dx did not read the device\n%s", out)
+	}
+
+	// The ports of the PC are taken
+	bus, err := NewPCPortBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		first, last uint16
+		expected    string
+	}{
+		{0x21, 0x22, "ports 0x0021-0x0022 overlap 0x0020-0x0021"},
+		{0x3F, 0x40, "ports 0x003f-0x0040 overlap 0x0040-0x0043"},
+		{0x301, 0x300, "invalid port range 0x0301-0x0300"},
+		{0x300, 0x302, ""},
+		{0x302, 0x302, "ports 0x0302-0x0302 overlap 0x0300-0x0302"},
+	}
+	for _, test := range tests {
+		err := bus.register(test.first, test.last, &recordingDevice{})
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		if message != test.expected {
+			t.Errorf("register 0x%x-0x%x: %q, expected %q", test.first, test.last, message, test.expected)
+		}
+	}
+}
+
+// ===============
+// ===== PIC =====
+// ===============
+
+// The initialization of the PC BIOS: edge triggered, single, ICW4, vectors
+// at 8, 8086 mode.
+func newInitializedPIC(icw4 byte, imr byte) *PIC {
+	p := NewPIC()
+	for _, write := range []struct {
+		port  uint16
+		value byte
+	}{{0x20, 0x13}, {0x21, 0x08}, {0x21, icw4}, {0x21, imr}} {
+		p.portWrite(write.port, write.value)
+	}
+	return p
+}
+
+func TestPICInitialization(t *testing.T) {
+	p := NewPIC()
+	p.request(0)
+	if _, _, ok := p.interrupt(); ok {
+		t.Errorf("interrupt before the initialization")
+	}
+
+	p.portWrite(0x20, 0x13)
+	if _, _, ok := p.interrupt(); ok {
+		t.Errorf("interrupt during the initialization")
+	}
+	p.portWrite(0x21, 0x70)
+	p.portWrite(0x21, 0x01)
+	if p.base != 0x70 || p.next != 0 || p.imr != 0 {
+		t.Errorf("after ICW4: base 0x%02x next %d imr 0x%02x, expected 0x70 0 0", p.base, p.next, p.imr)
+	}
+
+	// ICW1 clear the requests, without ICW4 the initialization end at ICW2
+	p.request(3)
+	p.portWrite(0x20, 0x12)
+	p.portWrite(0x21, 0x08)
+	if p.irr != 0 || p.next != 0 {
+		t.Errorf("ICW1 without ICW4: irr 0x%02x next %d, expected 0 0", p.irr, p.next)
+	}
+	p.portWrite(0x21, 0xFB)
+	if p.imr != 0xFB {
+		t.Errorf("OCW1: imr 0x%02x, expected 0xfb", p.imr)
+	}
+	if p.portRead(0x21) != 0xFB {
+		t.Errorf("port 0x21 read 0x%02x, expected the imr 0xfb", p.portRead(0x21))
+	}
+}
+
+// Requests are given by priority, an interrupt in service block the lower
+// priorities until its EOI but not the higher ones.
+func TestPICPriority(t *testing.T) {
+	p := newInitializedPIC(0x01, 0x00)
+	p.request(3)
+	p.request(5)
+
+	steps := []struct {
+		action   string // "int", "request N", or a write to port 0x20
+		ocw      byte
+		expected int // IRQ given, -1 for none
+		isr      byte
+	}{
+		{"int", 0, 3, 0b00001000},
+		{"int", 0, -1, 0b00001000},      // 5 is blocked by 3
+		{"request 1", 0, 1, 0b00001010}, // 1 is nested in 3
+		{"ocw", 0x20, -1, 0b00001000},   // Non specific EOI of 1, 5 still blocked
+		{"ocw", 0x63, 5, 0b00100000},    // Specific EOI of 3
+		{"ocw", 0x20, -1, 0b00000000},
+	}
+	for n, step := range steps {
+		switch {
+		case step.action == "ocw":
+			p.portWrite(0x20, step.ocw)
+		case step.action == "request 1":
+			p.request(1)
+		}
+		irq, vector, ok := p.interrupt()
+		if !ok {
+			irq = -1
+		}
+		if irq != step.expected || ok && vector != 0x08+byte(irq) {
+			t.Errorf("step %d: irq %d vector 0x%02x, expected %d", n, irq, vector, step.expected)
+		}
+		if p.isr != step.isr {
+			t.Errorf("step %d: isr %08b, expected %08b", n, p.isr, step.isr)
+		}
+	}
+}
+
+func TestPICMaskAndOCW3(t *testing.T) {
+	p := newInitializedPIC(0x01, 0xFD)
+	p.request(0)
+	p.request(1)
+	if irq, _, _ := p.interrupt(); irq != 1 {
+		t.Errorf("irq %d given, expected 1 because 0 is masked", irq)
+	}
+
+	tests := []struct {
+		ocw3     byte
+		expected byte
+	}{
+		{0x0A, 0b00000001}, // IRR, 0 is still requested
+		{0x0B, 0b00000010}, // ISR
+		{0x08, 0b00000010}, // Without RR the register does not change
+		{0x0A, 0b00000001},
+	}
+	for _, test := range tests {
+		p.portWrite(0x20, test.ocw3)
+		if value := p.portRead(0x20); value != test.expected {
+			t.Errorf("OCW3 0x%02x: read %08b, expected %08b", test.ocw3, value, test.expected)
+		}
+	}
+
+	// Poll acknowledge the highest request, even masked ones are not given
+	p.portWrite(0x21, 0x00)
+	p.portWrite(0x20, 0x20)
+	p.portWrite(0x20, 0x0C)
+	if value := p.portRead(0x20); value != 0x80 {
+		t.Errorf("poll read 0x%02x, expected 0x80", value)
+	}
+	p.portWrite(0x20, 0x0C)
+	if value := p.portRead(0x20); value != 0x00 {
+		t.Errorf("poll with 0 in service read 0x%02x, expected 0", value)
+	}
+}
+
+func TestPICAutoEOI(t *testing.T) {
+	p := newInitializedPIC(0x03, 0x00)
+	p.request(4)
+	p.request(6)
+	for _, expected := range []int{4, 6} {
+		irq, _, ok := p.interrupt()
+		if !ok || irq != expected || p.isr != 0 {
+			t.Errorf("irq %d isr %08b, expected %d and nothing in service", irq, p.isr, expected)
+		}
+	}
+}
+
+// ===============
+// ===== PIT =====
+// ===============
+
+// Program counter 0 with the count and advance the clock, 4 CPU cycles per
+// PIT clock.
+func TestPITModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		control byte
+		count   uint16
+		clocks  int
+		rises   int    // Rising edges of the output
+		value   uint16 // Count read back with a latch
+		out     bool
+	}{
+		{"mode 0 before the terminal count", 0x30, 10, 9, 0, 1, false},
+		{"mode 0 at the terminal count", 0x30, 10, 10, 1, 0, true},
+		{"mode 0 keep counting", 0x30, 10, 15, 1, 0xFFFB, true},
+		{"mode 0 one shot", 0x30, 10, 10 + 0x10000, 1, 0, true},
+		{"mode 2 period", 0x34, 5, 5, 1, 5, true},
+		{"mode 2 rate", 0x34, 5, 23, 4, 2, true},
+		{"mode 3 half period", 0x36, 8, 2, 0, 4, true},
+		{"mode 3 low", 0x36, 8, 4, 0, 8, false},
+		{"mode 3 square wave", 0x36, 8, 8 * 5, 5, 8, true},
+		{"mode 3 through mode 7", 0x3E, 8, 8 * 5, 5, 8, true},
+		{"BCD", 0x31, 0x0100, 1, 0, 0x0099, false},
+		{"0 is 65536", 0x34, 0, 0xFFFF, 0, 1, true},
+	}
+	for _, test := range tests {
+		p := NewPIT()
+		rises := 0
+		p.output = func(counter int) { rises++ }
+		p.portWrite(0x43, test.control)
+		p.portWrite(0x40, byte(test.count))
+		p.portWrite(0x40, byte(test.count>>8))
+		p.advance(test.clocks*pitDivider + pitDivider - 1)
+
+		p.portWrite(0x43, 0x00)
+		value := uint16(p.portRead(0x40)) | uint16(p.portRead(0x40))<<8
+		if rises != test.rises || value != test.value || p.counters[0].out != test.out {
+			t.Errorf("%s: %d rises count 0x%04x out %t, expected %d 0x%04x %t", test.name, rises, value, p.counters[0].out, test.rises, test.value, test.out)
+		}
+	}
+}
+
+// The latch keep the count until it is read, the counter go on
+func TestPITLatch(t *testing.T) {
+	p := NewPIT()
+	p.portWrite(0x43, 0x34)
+	p.portWrite(0x40, 100)
+	p.portWrite(0x40, 0)
+	p.advance(30 * pitDivider)
+	p.portWrite(0x43, 0x00)
+	p.advance(40 * pitDivider)
+	p.portWrite(0x43, 0x00) // Ignored, already latched
+
+	reads := []byte{70, 0, 60, 0}
+	for n, expected := range reads {
+		if value := p.portRead(0x40); value != expected {
+			t.Errorf("read %d: %d, expected %d", n, value, expected)
+		}
+	}
+
+	// A new count in mode 2 wait for the end of the period
+	p.portWrite(0x40, 10)
+	p.portWrite(0x40, 0)
+	if p.counters[0].count != 60 {
+		t.Errorf("count %d after a new count, expected 60 until the end of the period", p.counters[0].count)
+	}
+	p.advance(131 * pitDivider)
+	if p.counters[0].count != 9 {
+		t.Errorf("count %d after the period, expected 9", p.counters[0].count)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Model of the 8255 programmable peripheral interface (PPI) of the PC, wired
+// to the keyboard, the configuration switches, the speaker and the gate of
+// counter 2 of the PIT.
+//
+//   - Port A (0x60) is the scan code of the last key, or the switches when bit
+//     7 of port B is set.
+//   - Port B (0x61) is written by the program: bit 0 is the gate of counter 2,
+//     bit 1 the speaker data, bit 3 select the high nibble of the switches on
+//     port C and bit 7 clear the keyboard.
+//   - Port C (0x62) is read: bits 0 to 3 are a nibble of the switches and bit
+//     5 the output of counter 2.
+//   - Port 0x63 take the mode of the 8255, the PC always use the same so it
+//     is ignored.
+//
+// The keyboard send the scan codes given to it one after the other, the
+// next one come when the program clear the keyboard.
+type PPI struct {
+	pit      *PIT
+	portB    byte
+	switches byte   // Configuration switches of the PC
+	keyboard []byte // Scan codes given, keyboard[read] is on port A
+	read     int    // Scan codes cleared by the program
+
+	// Optional, called when a scan code arrive on port A
+	keyPressed func()
+}
+
+// The switches say: no floppy, no 8087, 64K on the motherboard and a color
+// display in 80 columns. Bit 1 is set when an 8087 is added.
+func NewPPI(pit *PIT) *PPI {
+	return &PPI{pit: pit, switches: 0b00101100}
+}
+
+// Add scan codes to the keyboard buffer
+func (p *PPI) press(scanCodes ...byte) {
+	waiting := p.read < len(p.keyboard)
+	p.keyboard = append(p.keyboard, scanCodes...)
+	if !waiting && p.read < len(p.keyboard) && p.keyPressed != nil {
+		p.keyPressed()
+	}
+}
+
+func (p *PPI) portRead(port uint16) byte {
+	switch port & 3 {
+	case 0:
+		if p.portB&0x80 != 0 {
+			return p.switches
+		}
+		if p.read == len(p.keyboard) {
+			return 0
+		}
+		return p.keyboard[p.read]
+	case 1:
+		return p.portB
+	case 2:
+		value := p.switches & 0x0F
+		if p.portB&0x08 != 0 {
+			value = p.switches >> 4
+		}
+		if p.pit.counters[2].out {
+			value |= 0x20
+		}
+		return value
+	}
+	return 0xFF
+}
+
+func (p *PPI) portWrite(port uint16, value byte) {
+	if port&3 != 1 {
+		return
+	}
+	clear := p.portB&0x80 == 0 && value&0x80 != 0
+	p.portB = value
+	p.pit.setGate(2, value&1 != 0)
+	if clear && p.read < len(p.keyboard) {
+		p.read++
+		if p.read < len(p.keyboard) && p.keyPressed != nil {
+			p.keyPressed()
+		}
+	}
+}
+
+// Parse scan codes in hexadecimal separated by commas or spaces, like
+// "1e,9e" for a press and a release of A.
+func parseScanCodes(text string) ([]byte, error) {
+	codes := []byte{}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' }) {
+		code, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(field), "0x"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scan code %q", field)
+		}
+		codes = append(codes, byte(code))
+	}
+	return codes, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Count how many times each instruction is executed and how many cycles it
+// cost, both per address and per operator.
+type Profile struct {
+	addresses map[int]*profileEntry
+	operators map[string]*profileEntry
+	cycles    int
+}
+
+type profileEntry struct {
+	location string // segment:offset of the instruction
+	name     string // Disassembled instruction or operator
+	count    int
+	cycles   int
+}
+
+func NewProfile() *Profile {
+	return &Profile{
+		addresses: map[int]*profileEntry{},
+		operators: map[string]*profileEntry{},
+	}
+}
+
+func (p *Profile) record(cs uint16, ip uint16, i Instruction, cycles int) {
+	address := physicalAddress(cs, ip)
+	entry, ok := p.addresses[address]
+	if !ok {
+		entry = &profileEntry{location: fmt.Sprintf("%04x:%04x", cs, ip), name: i.String()}
+		p.addresses[address] = entry
+	}
+	entry.count++
+	entry.cycles += cycles
+
+	entry, ok = p.operators[i.operator]
+	if !ok {
+		entry = &profileEntry{name: i.operator}
+		p.operators[i.operator] = entry
+	}
+	entry.count++
+	entry.cycles += cycles
+
+	p.cycles += cycles
+}
+
+// Print the hotspots, the instructions that cost the most cycles first.
+// Only the top instructions are printed, all operators are.
+func (p *Profile) Print(out io.Writer, top int) {
+	addresses := make([]int, 0, len(p.addresses))
+	for address := range p.addresses {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(a, b int) bool {
+		entryA, entryB := p.addresses[addresses[a]], p.addresses[addresses[b]]
+		if entryA.cycles != entryB.cycles {
+			return entryA.cycles > entryB.cycles
+		}
+		return addresses[a] < addresses[b]
+	})
+	if len(addresses) > top {
+		addresses = addresses[:top]
+	}
+
+	fmt.Fprintf(out, "  address    %-26s %10s %10s %7s\n", "instruction", "count", "cycles", "%")
+	for _, address := range addresses {
+		entry := p.addresses[address]
+		fmt.Fprintf(out, "  %s  %s\n", entry.location, entry.format(p.cycles))
+	}
+
+	operators := make([]*profileEntry, 0, len(p.operators))
+	for _, entry := range p.operators {
+		operators = append(operators, entry)
+	}
+	sort.Slice(operators, func(a, b int) bool {
+		if operators[a].cycles != operators[b].cycles {
+			return operators[a].cycles > operators[b].cycles
+		}
+		return operators[a].name < operators[b].name
+	})
+
+	fmt.Fprintf(out, "\n             %-26s %10s %10s %7s\n", "operator", "count", "cycles", "%")
+	for _, entry := range operators {
+		fmt.Fprintf(out, "             %s\n", entry.format(p.cycles))
+	}
+	fmt.Fprintf(out, "\n             %-26s %10s %10d\n", "total", "", p.cycles)
+}
+
+func (e *profileEntry) format(total int) string {
+	percent := 0.0
+	if total > 0 {
+		percent = float64(e.cycles) * 100 / float64(total)
+	}
+	return fmt.Sprintf("%-26s %10d %10d %6.2f%%", e.name, e.count, e.cycles, percent)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Map between the addresses of the instructions and the lines of the source
+// they come from.
+type SourceMap struct {
+	name      string         // Name of the source for humans
+	path      string         // Empty when the source is generated from a disassembly or a listing
+	lines     []string       // Content of the source
+	addresses map[int]int    // Line number to physical address
+	lineOf    map[int]int    // Physical address to line number
+	labels    map[int]string // Physical address to label
+}
+
+func newSourceMap(name string, path string, lines []string) *SourceMap {
+	return &SourceMap{
+		name:      name,
+		path:      path,
+		lines:     lines,
+		addresses: map[int]int{},
+		lineOf:    map[int]int{},
+		labels:    map[int]string{},
+	}
+}
+
+func (m *SourceMap) add(line int, address int) {
+	m.addresses[line] = address
+	m.lineOf[address] = line
+}
+
+// Several labels can point to the same address, the first one win
+func (m *SourceMap) addLabel(label string, address int) {
+	if _, exist := m.labels[address]; !exist {
+		m.labels[address] = label
+	}
+}
+
+// Build the source map of a program loaded at base by assembling its source
+// with the built-in assembler. The source must assemble to the program, the
+// lines would point to the wrong instructions otherwise.
+func sourceMapFromAssembly(path string, store *Storage, base int) (*SourceMap, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	code, statements, err := assemble(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if !bytes.Equal(code, store.memory[base:store.codeEnd]) {
+		return nil, fmt.Errorf("%s does not assemble to the program", path)
+	}
+
+	m := newSourceMap(filepath.Base(path), path, strings.Split(string(content), "\n"))
+	for _, s := range statements {
+		if s.label != "" {
+			m.addLabel(s.label, base+s.offset)
+		}
+		if s.size == 0 || s.operator == "db" || s.operator == "dw" {
+			continue
+		}
+		m.add(s.line, base+s.offset)
+	}
+	return m, nil
+}
+
+// Disassemble the code loaded from start, one instruction per line. Bytes
+// that cannot be decoded become `db` lines.
+func sourceMapFromDisassembly(store *Storage, start int) *SourceMap {
+	m := newSourceMap("disassembly", "", []string{})
+	bus := &memoryReader{store, start, false}
+	for {
+		address := bus.address
+		i, err := store.cpu.Decode(bus)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrNotImplemented) || errors.Is(err, io.ErrUnexpectedEOF) {
+			m.lines = append(m.lines, fmt.Sprintf("db 0x%02x", store.memory[address]))
+			bus.address = address + 1
+			continue
+		}
+		if err != nil {
+			break
+		}
+		m.lines = append(m.lines, i.String())
+		m.add(len(m.lines), address)
+	}
+	return m
+}
+
+// Build the source map of a program loaded at base from the listing written
+// by `nasm -l`. Each line of the listing is made of the line number in the
+// source, the offset and the bytes of the machine code (when the line produce
+// some) and the source line:
+//
+//	3 00000000 BD0001                  mov bp, 256
+//	4                                  y_loop_start:
+//
+// Machine code too long for one line continue on the next ones, with the same
+// line number and no source. Lines coming from a macro expansion have their
+// nesting level before the source (`<1>`), we keep the line of the macro call.
+func sourceMapFromListing(path string, base int) (*SourceMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	offsets := map[int]int{} // Line number to offset of its first byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if len(text) < 7 {
+			continue
+		}
+		line, err := strconv.Atoi(strings.TrimSpace(text[:6]))
+		if err != nil || line <= 0 {
+			return nil, fmt.Errorf("%s: not a NASM listing", path)
+		}
+
+		if len(text) >= 15 {
+			offset, err := strconv.ParseUint(text[7:15], 16, 32)
+			if _, seen := offsets[line]; err == nil && !seen {
+				offsets[line] = int(offset)
+			}
+		}
+
+		if len(text) >= 40 && strings.TrimSpace(text[35:40]) == "" {
+			for len(lines) < line {
+				lines = append(lines, "")
+			}
+			lines[line-1] = text[40:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Labels and directives are found by the parser of the assembler, the
+	// address of a label is the address of the first byte after it.
+	statements, err := parseAssembly(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	withCode := make([]int, 0, len(offsets))
+	for line := range offsets {
+		withCode = append(withCode, line)
+	}
+	sort.Ints(withCode)
+
+	m := newSourceMap(filepath.Base(path), "", lines)
+	for _, s := range statements {
+		if s.label != "" {
+			next := sort.SearchInts(withCode, s.line)
+			if next < len(withCode) {
+				m.addLabel(s.label, base+offsets[withCode[next]])
+			}
+		}
+		offset, ok := offsets[s.line]
+		if ok && s.operator != "db" && s.operator != "dw" {
+			m.add(s.line, base+offset)
+		}
+	}
+	return m, nil
+}
+
+// Return the line of the instruction at address
+func (m *SourceMap) line(address int) (int, bool) {
+	line, ok := m.lineOf[address]
+	return line, ok
+}
+
+// Return the address of the first instruction at or after line, and the line
+// of that instruction.
+func (m *SourceMap) address(line int) (int, int, bool) {
+	lines := make([]int, 0, len(m.addresses))
+	for l := range m.addresses {
+		if l >= line {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) == 0 {
+		return 0, 0, false
+	}
+	sort.Ints(lines)
+	return m.addresses[lines[0]], lines[0], true
+}
+
+// Return the label at address
+func (m *SourceMap) label(address int) (string, bool) {
+	label, ok := m.labels[address]
+	return label, ok
+}
+
+// Return the source line at address without its indentation, empty when there
+// is none.
+func (m *SourceMap) text(address int) string {
+	line, ok := m.lineOf[address]
+	if !ok || line > len(m.lines) {
+		return ""
+	}
+	return strings.TrimSpace(m.lines[line-1])
+}
+
+// Describe address relative to the closest label before it, like
+// `x_loop_start+6`. Empty when there is no label before address.
+func (m *SourceMap) symbol(address int) string {
+	closest, found := 0, false
+	for labelAddress := range m.labels {
+		if labelAddress <= address && (!found || labelAddress > closest) {
+			closest, found = labelAddress, true
+		}
+	}
+	if !found {
+		return ""
+	}
+	if closest == address {
+		return m.labels[closest]
+	}
+	return fmt.Sprintf("%s+%d", m.labels[closest], address-closest)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// Load a program of part1/ at 1000:0000
+func loadListing(t *testing.T, path string) (*Storage, int) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	store := NewStorage(io.Discard)
+	base, err := store.loadProgram(file, codeSegment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, base
+}
+
+func TestSourceMapFromAssembly(t *testing.T) {
+	store, base := loadListing(t, "part1/listing_0041_add_sub_cmp_jnz")
+	m, err := sourceMapFromAssembly("part1/listing_0041_add_sub_cmp_jnz.asm", store, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line, ok := m.line(base); !ok || line != 19 {
+		t.Errorf("first instruction at line %d, expected 19", line)
+	}
+
+	// The source of listing 54 does not assemble to its binary
+	store, base = loadListing(t, "part1/listing_0054_draw_rectangle")
+	_, err = sourceMapFromAssembly("part1/listing_0054_draw_rectangle.asm", store, base)
+	if err == nil {
+		t.Error("no error for a source that does not match the program")
+	}
+}
+
+func TestSourceMapFromListing(t *testing.T) {
+	_, base := loadListing(t, "part1/listing_0049_conditional_jumps")
+	m, err := sourceMapFromListing("part1/listing_0049_conditional_jumps.lst", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset int
+		line   int
+		source string
+	}{
+		{0x0, 19, "mov cx, 3"},
+		{0x3, 20, "mov bx, 1000"},
+		{0x6, 22, "add bx, 10"},
+		{0x9, 23, "sub cx, 1"},
+		{0xC, 24, "jnz loop_start"},
+	}
+	for _, test := range tests {
+		line, ok := m.line(base + test.offset)
+		if !ok || line != test.line {
+			t.Errorf("offset %d: line %d, expected %d", test.offset, line, test.line)
+			continue
+		}
+		// The source is kept as written, without the separator of the listing
+		if m.lines[line-1] != test.source {
+			t.Errorf("line %d: %q, expected %q", line, m.lines[line-1], test.source)
+		}
+	}
+	if label, ok := m.label(base + 6); !ok || label != "loop_start" {
+		t.Errorf("label %q at offset 6, expected loop_start", label)
+	}
+	if len(m.lines) != 24 || m.lines[16] != "bits 16" {
+		t.Errorf("%d lines, line 17 is %q", len(m.lines), m.lines[16])
+	}
+}
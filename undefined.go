@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Find the values used by the program before it write them, like the
+// memcheck tool of Valgrind. A program that work only because the simulator
+// start with everything at zero would not work on a real PC.
+//
+// Each byte of the registers and of the memory is defined once it is written,
+// the memory use the bits of the memory map. Reading an undefined byte with
+// an operand give a warning. The result written is defined anyway, but the
+// flags computed by an instruction that read an undefined value are not and
+// using them later, to branch for example, give another warning.
+//
+// The methods do nothing on a nil *UndefinedUses so that the checks cost
+// nothing when they are not wanted.
+type UndefinedUses struct {
+	registers [28]bool // One per byte of Storage.internal, the flags are apart
+	flags     uint16   // Flags computed from defined values
+
+	executing   bool   // Only the instructions are checked, not the debuggers
+	tainted     bool   // The current instruction read an undefined value
+	address     string // CS:IP of the current instruction
+	instruction string
+	reported    map[string]bool // Warnings of the current instruction
+
+	warnings []undefinedWarning
+	seen     map[string]int // Index of each warning in warnings
+}
+
+type undefinedWarning struct {
+	address     string
+	instruction string
+	message     string
+	count       int
+}
+
+// The status flags, the control flags are not computed from values
+const statusFlags = carryFlag | parityFlag | auxCarryFlag | zeroFlag | signFlag | overflowFlag
+
+func NewUndefinedUses() *UndefinedUses {
+	return &UndefinedUses{seen: map[string]int{}}
+}
+
+// An instruction start, everything read until end is read by it
+func (u *UndefinedUses) begin(cs uint16, ip uint16, i *Instruction) {
+	if u == nil {
+		return
+	}
+	u.executing, u.tainted, u.reported = true, false, map[string]bool{}
+	u.address, u.instruction = fmt.Sprintf("%04x:%04x", cs, ip), i.String()
+}
+
+func (u *UndefinedUses) end() {
+	if u == nil {
+		return
+	}
+	u.executing, u.tainted = false, false
+}
+
+// Bytes of registers written
+func (u *UndefinedUses) define(offset int8, size int) {
+	if u == nil {
+		return
+	}
+	for b := int(offset); b < int(offset)+size && b < len(u.registers); b++ {
+		u.registers[b] = true
+	}
+}
+
+// Flags written, they stay undefined when they come from undefined values
+func (u *UndefinedUses) defineFlags(flags uint16) {
+	if u == nil {
+		return
+	}
+	if u.tainted {
+		u.flags &^= flags
+	} else {
+		u.flags |= flags
+	}
+}
+
+func (u *UndefinedUses) checkRegister(trace io.Writer, reg string, offset int8, size int8) {
+	if u == nil || !u.executing {
+		return
+	}
+	for b := offset; b < offset+size; b++ {
+		if !u.registers[b] {
+			u.warn(trace, reg, "read of undefined "+reg)
+			return
+		}
+	}
+}
+
+func (u *UndefinedUses) checkMemory(trace io.Writer, m *MemoryMap, location string, physical int, size int) {
+	if u == nil || !u.executing {
+		return
+	}
+	for a := physical; a < physical+size; a++ {
+		if !m.isInitialized(a % (len(m.initialized) * 64)) {
+			u.warn(trace, fmt.Sprintf("0x%05x", a), "read of undefined memory "+location)
+			return
+		}
+	}
+}
+
+func (u *UndefinedUses) checkFlags(trace io.Writer, flags uint16) {
+	if u == nil || !u.executing {
+		return
+	}
+	undefined := flags & statusFlags &^ u.flags
+	if undefined == 0 {
+		return
+	}
+	names := []string{}
+	for _, flag := range flagNames {
+		if undefined&flag.mask != 0 {
+			names = append(names, flag.name)
+		}
+	}
+	u.warn(trace, strings.Join(names, " "), "use of undefined "+strings.Join(names, " "))
+}
+
+func (u *UndefinedUses) warn(trace io.Writer, what string, message string) {
+	u.tainted = true
+	if u.reported[message] {
+		return
+	}
+	u.reported[message] = true
+	fmt.Fprintf(trace, "[undefined %s] ", what)
+
+	key := u.address + " " + message
+	if n, ok := u.seen[key]; ok {
+		u.warnings[n].count++
+		return
+	}
+	u.seen[key] = len(u.warnings)
+	u.warnings = append(u.warnings, undefinedWarning{u.address, u.instruction, message, 1})
+}
+
+// Print each warning once with the instruction where it happened
+func (u *UndefinedUses) Print(out io.Writer) {
+	for _, w := range u.warnings {
+		fmt.Fprintf(out, "%s  %-20s %s", w.address, w.instruction, w.message)
+		if w.count > 1 {
+			fmt.Fprintf(out, " (%d times)", w.count)
+		}
+		fmt.Fprint(out, "\n")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestUndefinedUses(t *testing.T) {
+	tests := []struct {
+		source   string
+		warnings string
+	}{
+		{"mov bx, 1\nmov ax, bx\n", ""},
+		{"mov ax, bx\n", "1000:0000  mov ax, bx           read of undefined bx\n"},
+		{"mov al, 1\nmov bx, ax\n", "1000:0002  mov bx, ax           read of undefined ax\n"},
+		{"mov al, 1\nmov bl, al\n", ""},
+		{"mov bx, 0x100\nmov ax, [bx]\n", "1000:0003  mov ax, [bx]         read of undefined memory [bx]\n"},
+		{"mov bx, 0x100\nmov word [bx], 1\nmov ax, [bx]\n", ""},
+		{"mov bx, 0x100\nmov byte [bx], 1\nmov ax, [bx]\n", "1000:0006  mov ax, [bx]         read of undefined memory [bx]\n"},
+		// The code is defined by the loader
+		{"mov bx, 0x1000\nmov ds, bx\nmov bx, 0\nmov ax, [bx]\n", ""},
+		{"mov ax, 1\nadd ax, 1\njne $+2\n", ""},
+		{"add ax, 1\njne $+2\n", "1000:0000  add ax, 1            read of undefined ax\n1000:0003  jne $+2              use of undefined ZF\n"},
+		{"add ax, 1\nmov bx, 1\nadd bx, 1\njne $+2\n", "1000:0000  add ax, 1            read of undefined ax\n"},
+		{"mov cx, 2\nmov ax, dx\nsub cx, 1\njne 3\n", "1000:0003  mov ax, dx           read of undefined dx (2 times)\n"},
+	}
+	for _, test := range tests {
+		code, err := Assemble(strings.NewReader(test.source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trace := &bytes.Buffer{}
+		store := NewStorage(trace)
+		store.undefined = NewUndefinedUses()
+		store.load(bytes.NewReader(code), codeSegment, 0)
+		if err := store.run(context.Background(), Limits{}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		out := &strings.Builder{}
+		store.undefined.Print(out)
+		if out.String() != test.warnings {
+			t.Errorf("%q warnings:\n%s\nexpected:\n%s", test.source, out, test.warnings)
+		}
+		if strings.Contains(trace.String(), "[undefined ") != (test.warnings != "") {
+			t.Errorf("%q trace:\n%s", test.source, trace)
+		}
+	}
+}
+
+// Without the option nothing is checked
+func TestUndefinedUsesDisabled(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := Execute(strings.NewReader("\x89\xd8"), ExecuteOptions{PrintHex: true, Output: out}) // mov ax, bx
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "undefined") {
+		t.Errorf("undefined values reported without -warn-undefined\n%s", out)
+	}
+
+	out.Reset()
+	err = Execute(strings.NewReader("\x89\xd8"), ExecuteOptions{PrintHex: true, Output: out, WarnUndefined: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "UNDEFINED VALUES ───────────────────────\n1000:0000  mov ax, bx           read of undefined bx\n") {
+		t.Errorf("undefined bx not reported\n%s", out)
+	}
+}